@@ -4,14 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"time"
 )
 
+// DefaultMaxChainDepth is the number of intermediate CAs allowed between a certificate and its root by NewCAPool
+const DefaultMaxChainDepth = 1
+
 type CAPool struct {
 	CAs           map[string]*CachedCertificate
 	certBlocklist map[string]struct{}
+
+	// Intermediates holds CA certificates that are not trusted on their own, a certificate they signed is only valid
+	// when the intermediate chains back to one of CAs.
+	Intermediates map[string]*CachedCertificate
+
+	// MaxChainDepth is the number of intermediates allowed between a certificate and the root that trusts it, a
+	// longer chain fails with ErrChainTooLong. 0 disables intermediates.
+	MaxChainDepth int
+
+	// Clock provides the current time to Verify and VerifyCached, it defaults to time.Now.
+	// Tests and simulations can replace it to control certificate expiry.
+	Clock func() time.Time
+
+	// SkewTolerance allows for clock differences between hosts. Certificates are treated as valid when they became
+	// valid, or expired, within SkewTolerance of the time being verified. The default of 0 disables this.
+	SkewTolerance time.Duration
 }
 
 // NewCAPool creates an empty CAPool
@@ -19,6 +40,9 @@ func NewCAPool() *CAPool {
 	ca := CAPool{
 		CAs:           make(map[string]*CachedCertificate),
 		certBlocklist: make(map[string]struct{}),
+		Intermediates: make(map[string]*CachedCertificate),
+		MaxChainDepth: DefaultMaxChainDepth,
+		Clock:         time.Now,
 	}
 
 	return &ca
@@ -30,20 +54,54 @@ func NewCAPool() *CAPool {
 // returned along with the pool. The caller must handle any such errors.
 func NewCAPoolFromPEM(caPEMs []byte) (*CAPool, error) {
 	pool := NewCAPool()
-	var err error
+	expired, err := pool.addCAsFromPEM(caPEMs)
+	if err != nil {
+		return nil, err
+	}
+
+	if expired {
+		return pool, ErrExpired
+	}
+
+	return pool, nil
+}
+
+// NewCAPoolFromDir will create a new CA pool from every .crt and .pem file directly within dir, each of which may
+// contain any number of PEM-encoded nebula CA certificates. Files are read in lexical order. Errors from all files are
+// returned together, each naming the file it came from. As with NewCAPoolFromPEM, if the only problem is that some
+// certificates are expired then ErrExpired is returned along with the pool.
+func NewCAPoolFromDir(dir string) (*CAPool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := NewCAPool()
+	var errs []error
 	var expired bool
-	for {
-		caPEMs, err = pool.AddCAFromPEM(caPEMs)
-		if errors.Is(err, ErrExpired) {
-			expired = true
-			err = nil
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
 		}
+
+		p := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(p)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
-		if len(caPEMs) == 0 || strings.TrimSpace(string(caPEMs)) == "" {
-			break
+
+		fileExpired, err := pool.addCAsFromPEM(b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
 		}
+		expired = expired || fileExpired
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
 
 	if expired {
@@ -53,6 +111,26 @@ func NewCAPoolFromPEM(caPEMs []byte) (*CAPool, error) {
 	return pool, nil
 }
 
+// addCAsFromPEM adds every certificate in caPEMs to the pool, stopping at the first error. Expired certificates are
+// added and reported by returning true instead of an error.
+func (ncp *CAPool) addCAsFromPEM(caPEMs []byte) (bool, error) {
+	var err error
+	var expired bool
+	for {
+		caPEMs, err = ncp.AddCAFromPEM(caPEMs)
+		if errors.Is(err, ErrExpired) {
+			expired = true
+			err = nil
+		}
+		if err != nil {
+			return expired, err
+		}
+		if len(caPEMs) == 0 || strings.TrimSpace(string(caPEMs)) == "" {
+			return expired, nil
+		}
+	}
+}
+
 // AddCAFromPEM verifies a Nebula CA certificate and adds it to the pool.
 // Only the first pem encoded object will be consumed, any remaining bytes are returned.
 // Parsed certificates will be verified and must be a CA
@@ -80,9 +158,49 @@ func (ncp *CAPool) AddCA(c Certificate) error {
 		return fmt.Errorf("%s: %w", c.Name(), ErrNotSelfSigned)
 	}
 
+	cc, err := newCachedCA(c)
+	if err != nil {
+		return err
+	}
+
+	ncp.CAs[cc.Fingerprint] = cc
+
+	if c.Expired(time.Now()) {
+		return fmt.Errorf("%s: %w", c.Name(), ErrExpired)
+	}
+
+	return nil
+}
+
+// AddIntermediate adds an intermediate CA certificate to the pool. The chain from the intermediate to a root is
+// checked during verification, so intermediates and roots may be added in any order.
+func (ncp *CAPool) AddIntermediate(c Certificate) error {
+	if !c.IsCA() {
+		return fmt.Errorf("%s: %w", c.Name(), ErrNotCA)
+	}
+
+	if c.Issuer() == "" {
+		return fmt.Errorf("%s: intermediate certificate has no issuer", c.Name())
+	}
+
+	cc, err := newCachedCA(c)
+	if err != nil {
+		return err
+	}
+
+	ncp.Intermediates[cc.Fingerprint] = cc
+
+	if c.Expired(time.Now()) {
+		return fmt.Errorf("%s: %w", c.Name(), ErrExpired)
+	}
+
+	return nil
+}
+
+func newCachedCA(c Certificate) (*CachedCertificate, error) {
 	sum, err := c.Fingerprint()
 	if err != nil {
-		return fmt.Errorf("could not calculate fingerprint for provided CA; error: %w; %s", err, c.Name())
+		return nil, fmt.Errorf("could not calculate fingerprint for provided CA; error: %w; %s", err, c.Name())
 	}
 
 	cc := &CachedCertificate{
@@ -95,13 +213,7 @@ func (ncp *CAPool) AddCA(c Certificate) error {
 		cc.InvertedGroups[g] = struct{}{}
 	}
 
-	ncp.CAs[sum] = cc
-
-	if c.Expired(time.Now()) {
-		return fmt.Errorf("%s: %w", c.Name(), ErrExpired)
-	}
-
-	return nil
+	return cc, nil
 }
 
 // BlocklistFingerprint adds a cert fingerprint to the blocklist
@@ -114,6 +226,24 @@ func (ncp *CAPool) ResetCertBlocklist() {
 	ncp.certBlocklist = make(map[string]struct{})
 }
 
+// ExportBlocklist returns the blocklisted fingerprints in sorted order so the result is stable and can be diffed.
+func (ncp *CAPool) ExportBlocklist() []string {
+	fps := make([]string, 0, len(ncp.certBlocklist))
+	for fp := range ncp.certBlocklist {
+		fps = append(fps, fp)
+	}
+	slices.Sort(fps)
+	return fps
+}
+
+// ImportBlocklist adds every fingerprint in fps to the blocklist. Existing entries are kept and importing the same
+// fingerprints again has no effect.
+func (ncp *CAPool) ImportBlocklist(fps []string) {
+	for _, fp := range fps {
+		ncp.BlocklistFingerprint(fp)
+	}
+}
+
 // IsBlocklisted tests the provided fingerprint against the pools blocklist.
 // Returns true if the fingerprint is blocked.
 func (ncp *CAPool) IsBlocklisted(fingerprint string) bool {
@@ -124,21 +254,51 @@ func (ncp *CAPool) IsBlocklisted(fingerprint string) bool {
 	return false
 }
 
+// now returns the current time according to the pools Clock
+func (ncp *CAPool) now() time.Time {
+	if ncp.Clock == nil {
+		return time.Now()
+	}
+	return ncp.Clock()
+}
+
+// Verify is the same as VerifyCertificate using the current time from the pools Clock
+func (ncp *CAPool) Verify(c Certificate) (*CachedCertificate, error) {
+	return ncp.VerifyCertificate(ncp.now(), c)
+}
+
+// VerifyCached is the same as VerifyCachedCertificate using the current time from the pools Clock
+func (ncp *CAPool) VerifyCached(c *CachedCertificate) error {
+	return ncp.VerifyCachedCertificate(ncp.now(), c)
+}
+
 // VerifyCertificate verifies the certificate is valid and is signed by a trusted CA in the pool.
 // If the certificate is valid then the returned CachedCertificate can be used in subsequent verification attempts
 // to increase performance.
 func (ncp *CAPool) VerifyCertificate(now time.Time, c Certificate) (*CachedCertificate, error) {
+	cc, _, err := ncp.verifyCertificate(now, c)
+	return cc, err
+}
+
+// VerifyWithSigner is the same as VerifyCertificate except the CA that admitted c is returned instead. For a cross
+// signed certificate this may be any of its signers present in the pool. A nil CA is returned along with any error.
+func (ncp *CAPool) VerifyWithSigner(now time.Time, c Certificate) (*CachedCertificate, error) {
+	_, signer, err := ncp.verifyCertificate(now, c)
+	return signer, err
+}
+
+func (ncp *CAPool) verifyCertificate(now time.Time, c Certificate) (*CachedCertificate, *CachedCertificate, error) {
 	if c == nil {
-		return nil, fmt.Errorf("no certificate")
+		return nil, nil, fmt.Errorf("no certificate")
 	}
 	fp, err := c.Fingerprint()
 	if err != nil {
-		return nil, fmt.Errorf("could not calculate fingerprint to verify: %w", err)
+		return nil, nil, fmt.Errorf("could not calculate fingerprint to verify: %w", err)
 	}
 
 	signer, err := ncp.verify(c, now, fp, "")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	cc := CachedCertificate{
@@ -152,7 +312,7 @@ func (ncp *CAPool) VerifyCertificate(now time.Time, c Certificate) (*CachedCerti
 		cc.InvertedGroups[g] = struct{}{}
 	}
 
-	return &cc, nil
+	return &cc, signer, nil
 }
 
 // VerifyCachedCertificate is the same as VerifyCertificate other than it operates on a pre-verified structure and
@@ -168,44 +328,292 @@ func (ncp *CAPool) verify(c Certificate, now time.Time, certFp string, signerFp
 	}
 
 	signer, err := ncp.GetCAForCert(c)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		err = ncp.verifySigner(c, signer, now, signerFp)
+		if err == nil {
+			return signer, nil
+		}
 	}
 
-	if signer.Certificate.Expired(now) {
-		return nil, ErrRootExpired
+	// A cross signed certificate is also valid if one of its other signers is in the pool
+	if len(c.CrossSignatures()) > 0 {
+		for _, cs := range ncp.CAs {
+			if cs == signer || (len(signerFp) > 0 && signerFp != cs.Fingerprint) {
+				continue
+			}
+
+			if ncp.verifySigner(c, cs, now, signerFp) == nil {
+				return cs, nil
+			}
+		}
+	}
+
+	return nil, err
+}
+
+// verifySigner checks that c was signed by signer and is within its constraints. If signerFp is provided then c has
+// already been verified and only the validity of signer and c at now is checked.
+func (ncp *CAPool) verifySigner(c Certificate, signer *CachedCertificate, now time.Time, signerFp string) error {
+	if ncp.expired(signer.Certificate, now) {
+		return ErrRootExpired
 	}
 
-	if c.Expired(now) {
-		return nil, ErrExpired
+	if ncp.expired(c, now) {
+		return ErrExpired
 	}
 
-	// If we are checking a cached certificate then we can bail early here
+	// If we are checking a cached certificate then we can skip the signature checks
 	// Either the root is no longer trusted or everything is fine
 	if len(signerFp) > 0 {
 		if signerFp != signer.Fingerprint {
-			return nil, ErrFingerprintMismatch
+			return ErrFingerprintMismatch
 		}
-		return signer, nil
+	} else if err := ncp.checkSigner(c, signer); err != nil {
+		return err
+	}
+
+	chain, err := ncp.verifyChain(c, signer, len(signerFp) > 0)
+	if err != nil {
+		return err
 	}
-	if !c.CheckSignature(signer.Certificate.PublicKey()) {
-		return nil, ErrSignatureMismatch
+
+	for _, ca := range chain {
+		if ncp.expired(ca.Certificate, now) {
+			return ErrRootExpired
+		}
 	}
 
-	err = CheckCAConstraints(signer.Certificate, c)
+	return nil
+}
+
+// verifyChain walks from signer to the root in CAs that trusts it, returning every CA above signer. Nothing is
+// returned when signer is a root. Each intermediate must be signed by, and within the constraints of, the CA above it.
+// c must also be within the constraints of every CA in the chain, so constraints can only narrow on the way down.
+// If cached is true then only the links are followed since the signatures were checked when c was first verified.
+// Expiry is left to the caller.
+func (ncp *CAPool) verifyChain(c Certificate, signer *CachedCertificate, cached bool) ([]*CachedCertificate, error) {
+	var chain []*CachedCertificate
+	for {
+		if _, ok := ncp.CAs[signer.Fingerprint]; ok {
+			return chain, nil
+		}
+
+		if len(chain) >= ncp.MaxChainDepth {
+			return nil, ErrChainTooLong
+		}
+
+		if ncp.IsBlocklisted(signer.Fingerprint) {
+			return nil, ErrBlockListed
+		}
+
+		issuer, err := ncp.GetCAForCert(signer.Certificate)
+		if err != nil {
+			return nil, err
+		}
+
+		if !cached {
+			if !issuer.Certificate.IsCA() {
+				return nil, ErrSignerNotCA
+			}
+
+			if !signer.Certificate.CheckSignature(issuer.Certificate.PublicKey()) {
+				return nil, ErrSignatureMismatch
+			}
+
+			if err := CheckCAConstraints(issuer.Certificate, signer.Certificate); err != nil {
+				return nil, err
+			}
+
+			if err := CheckCAConstraints(issuer.Certificate, c); err != nil {
+				return nil, err
+			}
+		}
+
+		chain = append(chain, issuer)
+		signer = issuer
+	}
+}
+
+// expired is the same as Certificate.Expired except the validity window is widened by SkewTolerance on both ends
+func (ncp *CAPool) expired(c Certificate, now time.Time) bool {
+	return c.NotBefore().After(now.Add(ncp.SkewTolerance)) || c.NotAfter().Before(now.Add(-ncp.SkewTolerance))
+}
+
+// checkSigner checks that c was signed by signer and is within its constraints, expiry is not considered
+func (ncp *CAPool) checkSigner(c Certificate, signer *CachedCertificate) error {
+	// The pool only accepts CAs through AddCA, but CAs can be modified directly
+	if !signer.Certificate.IsCA() {
+		return ErrSignerNotCA
+	}
+
+	// A CA certificate can only be verified on its own if it is one of the intermediates and they are enabled
+	if c.IsCA() && !ncp.isIntermediate(c) {
+		return ErrCASignedByCA
+	}
+
+	if !c.CheckAnySignature([][]byte{signer.Certificate.PublicKey()}) {
+		return ErrSignatureMismatch
+	}
+
+	return CheckCAConstraints(signer.Certificate, c)
+}
+
+// isIntermediate reports if c is in Intermediates and MaxChainDepth allows intermediates to be used
+func (ncp *CAPool) isIntermediate(c Certificate) bool {
+	if ncp.MaxChainDepth == 0 {
+		return false
+	}
+
+	fp, err := c.Fingerprint()
 	if err != nil {
-		return nil, err
+		return false
+	}
+
+	_, ok := ncp.Intermediates[fp]
+	return ok
+}
+
+// VerifyIgnoringExpiry performs the same checks as Verify except that an expired certificate or CA does not cause
+// a failure. The returned bool reports if every other check passed, any expiry is returned as ErrExpired or
+// ErrRootExpired in the warnings. When the bool is false the warnings hold the reason for the failure.
+// This is meant for diagnosing old certificates, never use it to decide if a certificate should be trusted.
+func (ncp *CAPool) VerifyIgnoringExpiry(c Certificate) (bool, []error) {
+	if c == nil {
+		return false, []error{fmt.Errorf("no certificate")}
+	}
+
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return false, []error{fmt.Errorf("could not calculate fingerprint to verify: %w", err)}
+	}
+
+	if ncp.IsBlocklisted(fp) {
+		return false, []error{ErrBlockListed}
+	}
+
+	var chain []*CachedCertificate
+	signer, err := ncp.GetCAForCert(c)
+	if err == nil {
+		err = ncp.checkSigner(c, signer)
+	}
+
+	if err == nil {
+		chain, err = ncp.verifyChain(c, signer, false)
+	}
+
+	if err != nil && len(c.CrossSignatures()) > 0 {
+		for _, cs := range ncp.CAs {
+			if cs != signer && ncp.checkSigner(c, cs) == nil {
+				signer, err = cs, nil
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return false, []error{err}
+	}
+
+	var warnings []error
+	now := ncp.now()
+	expired := func(ca *CachedCertificate) bool { return ncp.expired(ca.Certificate, now) }
+	if expired(signer) || slices.ContainsFunc(chain, expired) {
+		warnings = append(warnings, ErrRootExpired)
+	}
+
+	if ncp.expired(c, now) {
+		warnings = append(warnings, ErrExpired)
+	}
+
+	return true, warnings
+}
+
+// VerifyReason describes the outcome of VerifyAt
+type VerifyReason int
+
+const (
+	// VerifyOK means the certificate was valid
+	VerifyOK VerifyReason = iota
+	// VerifyExpired means the certificate, or a CA it relies on, had expired
+	VerifyExpired
+	// VerifyNotYetValid means the certificate, or a CA it relies on, was not valid yet
+	VerifyNotYetValid
+	// VerifyUntrusted means no trusted CA in the pool signed the certificate
+	VerifyUntrusted
+	// VerifyRevoked means the certificate is in the block list
+	VerifyRevoked
+	// VerifyConstraintViolation means the certificate was signed by a trusted CA but does not satisfy its constraints
+	VerifyConstraintViolation
+)
+
+func (r VerifyReason) String() string {
+	switch r {
+	case VerifyOK:
+		return "ok"
+	case VerifyExpired:
+		return "expired"
+	case VerifyNotYetValid:
+		return "not yet valid"
+	case VerifyUntrusted:
+		return "untrusted"
+	case VerifyRevoked:
+		return "revoked"
+	case VerifyConstraintViolation:
+		return "constraint violation"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// VerifyAt reports if c was valid at t, which may be in the past, using the CAs and block list currently in the pool.
+// When c is not valid the reason tells a problem with time apart from a problem with trust. This is meant for audit
+// reporting, use VerifyCertificate when the resulting CachedCertificate is needed.
+func (ncp *CAPool) VerifyAt(t time.Time, c Certificate) (bool, VerifyReason) {
+	_, err := ncp.VerifyCertificate(t, c)
+	if err == nil {
+		return true, VerifyOK
+	}
+
+	notYetValid := func(c Certificate) bool {
+		return c.NotBefore().After(t.Add(ncp.SkewTolerance))
+	}
+
+	switch {
+	case errors.Is(err, ErrBlockListed):
+		return false, VerifyRevoked
+
+	case errors.Is(err, ErrExpired):
+		if notYetValid(c) {
+			return false, VerifyNotYetValid
+		}
+		return false, VerifyExpired
+
+	case errors.Is(err, ErrRootExpired):
+		// Any CA from the signer up to the root may be the one that was not valid yet
+		if signer, err := ncp.GetCAForCert(c); err == nil {
+			chain, _ := ncp.verifyChain(c, signer, true)
+			if notYetValid(signer.Certificate) || slices.ContainsFunc(chain, func(ca *CachedCertificate) bool {
+				return notYetValid(ca.Certificate)
+			}) {
+				return false, VerifyNotYetValid
+			}
+		}
+		return false, VerifyExpired
+
+	case errors.Is(err, ErrConstraintViolation):
+		return false, VerifyConstraintViolation
 	}
 
-	return signer, nil
+	// Anything else means c could not be shown to be trusted
+	return false, VerifyUntrusted
 }
 
-// GetCAForCert attempts to return the signing certificate for the provided certificate.
+// GetCAForCert attempts to return the signing certificate for the provided certificate, which may be an intermediate.
 // No signature validation is performed
 func (ncp *CAPool) GetCAForCert(c Certificate) (*CachedCertificate, error) {
 	issuer := c.Issuer()
 	if issuer == "" {
-		return nil, fmt.Errorf("no issuer in certificate")
+		return nil, ErrNoIssuer
 	}
 
 	signer, ok := ncp.CAs[issuer]
@@ -213,7 +621,112 @@ func (ncp *CAPool) GetCAForCert(c Certificate) (*CachedCertificate, error) {
 		return signer, nil
 	}
 
-	return nil, fmt.Errorf("could not find ca for the certificate")
+	signer, ok = ncp.Intermediates[issuer]
+	if ok {
+		return signer, nil
+	}
+
+	return nil, ErrCANotFound
+}
+
+// signerChains returns a chain for every CA in the pool that signed c, including any cross signers. Each chain starts
+// with the signer followed by the CAs above it as returned by verifyChain. Signers whose chain is not trusted are
+// skipped, if none remain then the error for the issuer of c is returned.
+func (ncp *CAPool) signerChains(c Certificate) ([][]*CachedCertificate, error) {
+	var chains [][]*CachedCertificate
+	add := func(signer *CachedCertificate) error {
+		if !c.CheckAnySignature([][]byte{signer.Certificate.PublicKey()}) {
+			return ErrSignatureMismatch
+		}
+
+		chain, err := ncp.verifyChain(c, signer, false)
+		if err != nil {
+			return err
+		}
+
+		chains = append(chains, append([]*CachedCertificate{signer}, chain...))
+		return nil
+	}
+
+	signer, err := ncp.GetCAForCert(c)
+	if err == nil {
+		err = add(signer)
+	}
+
+	if len(c.CrossSignatures()) > 0 {
+		for _, cs := range ncp.CAs {
+			if cs != signer {
+				_ = add(cs)
+			}
+		}
+	}
+
+	if len(chains) == 0 {
+		return nil, err
+	}
+
+	return chains, nil
+}
+
+// ChainNotAfter returns the time at which the provided certificate will stop being valid for this pool, which is the
+// earliest NotAfter of the certificate, its signing CA, and any intermediates between that CA and a root. If a cross
+// signed certificate has more than one trusted chain then the chain that expires last is used. ErrCANotFound is
+// returned if no signer for the certificate is found. Only signatures and the links of the chain are checked, use
+// VerifyCertificate to fully validate the certificate.
+func (ncp *CAPool) ChainNotAfter(c Certificate) (time.Time, error) {
+	chains, err := ncp.signerChains(c)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var notAfter time.Time
+	for _, chain := range chains {
+		chainNotAfter := c.NotAfter()
+		for _, ca := range chain {
+			if ca.Certificate.NotAfter().Before(chainNotAfter) {
+				chainNotAfter = ca.Certificate.NotAfter()
+			}
+		}
+
+		if chainNotAfter.After(notAfter) {
+			notAfter = chainNotAfter
+		}
+	}
+
+	return notAfter, nil
+}
+
+// ValidityFitsAllSigners checks that the validity window of c fits within the window of every CA in the pool that
+// signed it, including any cross signers and the intermediates and roots above them. This catches a certificate that
+// is trusted through one CA but outlives another it was signed by during a CA migration. If more than one CA is
+// violated then the error names the one that c exceeds by the most. Only signatures and the links of the chain are
+// checked, use VerifyCertificate to fully validate the certificate.
+func (ncp *CAPool) ValidityFitsAllSigners(c Certificate) error {
+	chains, err := ncp.signerChains(c)
+	if err != nil {
+		return err
+	}
+
+	var tightest *CachedCertificate
+	var excess time.Duration
+	for _, chain := range chains {
+		for _, s := range chain {
+			over := max(c.NotAfter().Sub(s.Certificate.NotAfter()), s.Certificate.NotBefore().Sub(c.NotBefore()))
+			if over > excess || (over == excess && tightest != nil && s.Fingerprint < tightest.Fingerprint) {
+				tightest, excess = s, over
+			}
+		}
+	}
+
+	if tightest == nil {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"certificate validity %v to %v does not fit within signing ca %s (%s) validity %v to %v",
+		c.NotBefore(), c.NotAfter(), tightest.Certificate.Name(), tightest.Fingerprint,
+		tightest.Certificate.NotBefore(), tightest.Certificate.NotAfter(),
+	)
 }
 
 // GetFingerprints returns an array of trusted CA fingerprints
@@ -231,45 +744,65 @@ func (ncp *CAPool) GetFingerprints() []string {
 
 // CheckCAConstraints returns an error if the sub certificate violates constraints present in the signer certificate.
 func CheckCAConstraints(signer Certificate, sub Certificate) error {
-	return checkCAConstraints(signer, sub.NotBefore(), sub.NotAfter(), sub.Groups(), sub.Networks(), sub.UnsafeNetworks())
+	return checkCAConstraints(signer, sub.IsCA(), sub.Name(), sub.NotBefore(), sub.NotAfter(), sub.Groups(), sub.Networks(), sub.UnsafeNetworks())
+}
+
+// constraintError is returned when a certificate is outside the constraints of its signer, it matches
+// ErrConstraintViolation with errors.Is
+type constraintError string
+
+func (e constraintError) Error() string {
+	return string(e)
+}
+
+func (e constraintError) Is(target error) bool {
+	return target == ErrConstraintViolation
 }
 
 // checkCAConstraints is a very generic function allowing both Certificates and TBSCertificates to be tested.
-func checkCAConstraints(signer Certificate, notBefore, notAfter time.Time, groups []string, networks, unsafeNetworks []netip.Prefix) error {
+func checkCAConstraints(signer Certificate, isCA bool, name string, notBefore, notAfter time.Time, groups []string, networks, unsafeNetworks []netip.Prefix) error {
 	// Make sure this cert isn't valid after the root
 	if notAfter.After(signer.NotAfter()) {
-		return fmt.Errorf("certificate expires after signing certificate")
+		return constraintError("certificate expires after signing certificate")
 	}
 
 	// Make sure this cert wasn't valid before the root
 	if notBefore.Before(signer.NotBefore()) {
-		return fmt.Errorf("certificate is valid before the signing certificate")
+		return constraintError("certificate is valid before the signing certificate")
 	}
 
-	// If the signer has a limited set of groups make sure the cert only contains a subset
+	// If the signer has a limited set of groups make sure the cert only contains a subset, unless the signer delegates
+	// group assignment with AllowExtraGroups
 	signerGroups := signer.Groups()
-	if len(signerGroups) > 0 {
+	if len(signerGroups) > 0 && !signer.AllowExtraGroups() {
 		for _, g := range groups {
 			if !slices.Contains(signerGroups, g) {
-				return fmt.Errorf("certificate contained a group not present on the signing ca: %s", g)
+				return constraintError(fmt.Sprintf("certificate contained a group not present on the signing ca: %s", g))
 			}
 		}
 	}
 
+	// If the signer constrains names make sure the cert name matches at least one pattern. The name of a CA is only a
+	// label so constraints apply to the leaf certificates at the end of the chain.
+	nameConstraints := signer.NameConstraints()
+	if len(nameConstraints) > 0 && !isCA && !matchesNameConstraint(nameConstraints, name) {
+		return constraintError(fmt.Sprintf("certificate name does not match the name constraints of the signing ca: %s", name))
+	}
+
 	// If the signer has a limited set of ip ranges to issue from make sure the cert only contains a subset
 	signingNetworks := signer.Networks()
 	if len(signingNetworks) > 0 {
 		for _, certNetwork := range networks {
 			found := false
 			for _, signingNetwork := range signingNetworks {
-				if signingNetwork.Contains(certNetwork.Addr()) && signingNetwork.Bits() <= certNetwork.Bits() {
+				if prefixContains(signingNetwork, certNetwork) {
 					found = true
 					break
 				}
 			}
 
 			if !found {
-				return fmt.Errorf("certificate contained a network assignment outside the limitations of the signing ca: %s", certNetwork.String())
+				return constraintError(fmt.Sprintf("certificate contained a network assignment outside the limitations of the signing ca: %s", certNetwork.String()))
 			}
 		}
 	}
@@ -280,17 +813,56 @@ func checkCAConstraints(signer Certificate, notBefore, notAfter time.Time, group
 		for _, certUnsafeNetwork := range unsafeNetworks {
 			found := false
 			for _, caNetwork := range signingUnsafeNetworks {
-				if caNetwork.Contains(certUnsafeNetwork.Addr()) && caNetwork.Bits() <= certUnsafeNetwork.Bits() {
+				if prefixContains(caNetwork, certUnsafeNetwork) {
 					found = true
 					break
 				}
 			}
 
 			if !found {
-				return fmt.Errorf("certificate contained an unsafe network assignment outside the limitations of the signing ca: %s", certUnsafeNetwork.String())
+				return constraintError(fmt.Sprintf("certificate contained an unsafe network assignment outside the limitations of the signing ca: %s", certUnsafeNetwork.String()))
+			}
+		}
+	}
+
+	return nil
+}
+
+// prefixContains returns true if the network described by sub is a subset of signing. The address of sub must fall
+// within signing and sub must be the same size or smaller (an equal or longer prefix length) than signing.
+// A signing /32 will only permit the exact same address as a /32, anything larger is rejected even though the
+// address matches.
+func prefixContains(signing, sub netip.Prefix) bool {
+	return signing.Contains(sub.Addr()) && signing.Bits() <= sub.Bits()
+}
+
+// matchesNameConstraint returns true if name matches any of the patterns. A pattern of *.suffix matches any name
+// ending in .suffix, including names with more than one label before it, any other pattern must match name exactly.
+func matchesNameConstraint(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if suffix, ok := strings.CutPrefix(p, "*"); ok {
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				return true
 			}
+		} else if p == name {
+			return true
 		}
 	}
 
+	return false
+}
+
+// checkNameConstraint returns an error if p is not a pattern understood by matchesNameConstraint
+func checkNameConstraint(p string) error {
+	suffix, wildcard := strings.CutPrefix(p, "*")
+	switch {
+	case p == "":
+		return fmt.Errorf("invalid name constraint %q: pattern is empty", p)
+	case strings.Contains(suffix, "*"):
+		return fmt.Errorf("invalid name constraint %q: * is only allowed as the leading label", p)
+	case wildcard && (len(suffix) < 2 || suffix[0] != '.'):
+		return fmt.Errorf("invalid name constraint %q: * must be followed by a dot and a suffix", p)
+	}
+
 	return nil
 }
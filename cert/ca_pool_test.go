@@ -1,7 +1,13 @@
 package cert
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -107,3 +113,857 @@ IBNWYMep3ysx9zCgknfG5dKtwGTaqF++BWKDYdyl34KX
 	assert.Equal(t, ppppp.CAs[string("a7938893ec8c4ef769b06d7f425e5e46f7a7f5ffa49c3bcf4a86b608caba9159")].Certificate.Name(), rootCAP256.details.Name)
 	assert.Equal(t, len(ppppp.CAs), 1)
 }
+
+func TestNewCAPoolFromDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ca-pool-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca1, _, ca1Key, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	ca2, _, _, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	leaf, _, _, err := newTestCert(ca1, ca1Key, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+
+	write := func(name string, c Certificate) {
+		b, err := c.MarshalPEM()
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), b, 0600))
+	}
+	write("ca1.crt", ca1)
+	write("ca2.pem", ca2)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a cert"), 0600))
+
+	pool, err := NewCAPoolFromDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, pool.CAs, 2)
+	_, err = pool.Verify(leaf)
+	assert.NoError(t, err)
+
+	// A non CA file is reported by name
+	write("leaf.crt", leaf)
+	pool, err = NewCAPoolFromDir(dir)
+	assert.Nil(t, pool)
+	assert.ErrorIs(t, err, ErrNotCA)
+	assert.EqualError(t, err, filepath.Join(dir, "leaf.crt")+": "+leaf.Name()+": certificate is not a CA")
+
+	_, err = NewCAPoolFromDir(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestCAPool_VerifyClock(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	ca, _, caKey, err := newTestCaCert(start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+
+	c, _, _, err := newTestCert(ca, caKey, start, start.Add(5*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	now := start
+	caPool.Clock = func() time.Time { return now }
+
+	cc, err := caPool.Verify(c)
+	assert.NoError(t, err)
+
+	// The last instant the certificate is valid
+	now = c.NotAfter()
+	_, err = caPool.Verify(c)
+	assert.NoError(t, err)
+	assert.NoError(t, caPool.VerifyCached(cc))
+
+	// Just expired
+	now = c.NotAfter().Add(time.Nanosecond)
+	_, err = caPool.Verify(c)
+	assert.ErrorIs(t, err, ErrExpired)
+	assert.ErrorIs(t, caPool.VerifyCached(cc), ErrExpired)
+
+	// The explicit time versions ignore the clock
+	_, err = caPool.VerifyCertificate(start, c)
+	assert.NoError(t, err)
+
+	// The root expiring is also driven by the clock
+	now = ca.NotAfter().Add(time.Nanosecond)
+	_, err = caPool.Verify(c)
+	assert.ErrorIs(t, err, ErrRootExpired)
+
+	// A pool without a clock falls back to the wall clock
+	caPool.Clock = nil
+	_, err = caPool.Verify(c)
+	assert.NoError(t, err)
+}
+
+func TestCAPool_VerifyCrossSigned(t *testing.T) {
+	before := time.Now().Add(-2 * time.Minute)
+	after := time.Now().Add(2 * time.Minute)
+	oldCA, _, oldKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	newCA, _, newKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	otherCA, _, otherKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+
+	c, _, _, err := newTestCert(oldCA, oldKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+
+	dual, err := CrossSign(c, newCA, Curve_CURVE25519, newKey)
+	assert.NoError(t, err)
+	assert.Len(t, dual.CrossSignatures(), 1)
+	assert.Empty(t, c.CrossSignatures())
+	assert.Equal(t, c.Signature(), dual.Signature())
+	assert.True(t, dual.CheckSignature(oldCA.PublicKey()))
+	assert.False(t, dual.CheckSignature(newCA.PublicKey()))
+	assert.True(t, dual.CheckAnySignature([][]byte{newCA.PublicKey()}))
+	assert.False(t, dual.CheckAnySignature([][]byte{otherCA.PublicKey()}))
+
+	// Cross signatures survive a round trip
+	b, err := dual.Marshal()
+	assert.NoError(t, err)
+	dual, err = UnmarshalCertificate(b)
+	assert.NoError(t, err)
+	assert.Len(t, dual.CrossSignatures(), 1)
+
+	newPool := func(cas ...Certificate) *CAPool {
+		p := NewCAPool()
+		for _, ca := range cas {
+			assert.NoError(t, p.AddCA(ca))
+		}
+		return p
+	}
+
+	// Either CA alone trusts the dual signed certificate
+	cc, err := newPool(oldCA).Verify(dual)
+	assert.NoError(t, err)
+	assert.NoError(t, newPool(oldCA).VerifyCached(cc))
+
+	pool := newPool(newCA)
+	cc, err = pool.Verify(dual)
+	assert.NoError(t, err)
+	assert.NoError(t, pool.VerifyCached(cc))
+	newFp, _ := newCA.Fingerprint()
+	assert.Equal(t, newFp, cc.signerFingerprint)
+
+	// The singly signed certificate is only trusted by its issuer
+	_, err = newPool(newCA).Verify(c)
+	assert.Error(t, err)
+
+	// Neither signer present
+	_, err = newPool(otherCA).Verify(dual)
+	assert.Error(t, err)
+
+	// Tampering with the cross signature breaks trust through the new CA only
+	tampered := dual.Copy().(*certificateV1)
+	tampered.crossSignatures[0][0] ^= 0xff
+	_, err = newPool(newCA).Verify(tampered)
+	assert.Error(t, err)
+	_, err = newPool(oldCA).Verify(tampered)
+	assert.NoError(t, err)
+
+	// Cross signatures do not change the fingerprint, a blocklisted certificate can not be cross signed back into trust
+	fp, err := c.Fingerprint()
+	assert.NoError(t, err)
+	dualFp, err := dual.Fingerprint()
+	assert.NoError(t, err)
+	assert.Equal(t, fp, dualFp)
+
+	pool = newPool(oldCA)
+	pool.BlocklistFingerprint(fp)
+	_, err = pool.Verify(dual)
+	assert.ErrorIs(t, err, ErrBlockListed)
+
+	junk := dual.Copy().(*certificateV1)
+	junk.crossSignatures = append(junk.crossSignatures, []byte("junk"))
+	_, err = pool.Verify(junk)
+	assert.ErrorIs(t, err, ErrBlockListed)
+
+	untrusted, err := crossSignV1(c.(*certificateV1), &keySigner{Curve_CURVE25519, otherKey})
+	assert.NoError(t, err)
+	_, err = pool.Verify(untrusted)
+	assert.ErrorIs(t, err, ErrBlockListed)
+
+	// The cross signer constraints apply
+	limitedCA, _, limitedKey, err := newTestCaCert(before, after, nil, nil, []string{"nope"})
+	assert.NoError(t, err)
+	_, err = CrossSign(c, limitedCA, Curve_CURVE25519, limitedKey)
+	assert.EqualError(t, err, "certificate contained a group not present on the signing ca: test-group1")
+	_, err = CrossSign(oldCA, newCA, Curve_CURVE25519, newKey)
+	assert.EqualError(t, err, "can not sign a CA certificate with another")
+}
+
+func TestCAPool_VerifyWithSigner(t *testing.T) {
+	before := time.Now().Add(-2 * time.Minute)
+	after := time.Now().Add(2 * time.Minute)
+	ca, _, caKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	otherCA, _, otherKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	untrustedCA, _, untrustedKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+
+	pool := NewCAPool()
+	assert.NoError(t, pool.AddCA(ca))
+	assert.NoError(t, pool.AddCA(otherCA))
+
+	caFp, err := ca.Fingerprint()
+	assert.NoError(t, err)
+	otherFp, err := otherCA.Fingerprint()
+	assert.NoError(t, err)
+
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	signer, err := pool.VerifyWithSigner(time.Now(), c)
+	assert.NoError(t, err)
+	assert.Equal(t, caFp, signer.Fingerprint)
+
+	c, _, _, err = newTestCert(otherCA, otherKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	signer, err = pool.VerifyWithSigner(time.Now(), c)
+	assert.NoError(t, err)
+	assert.Equal(t, otherFp, signer.Fingerprint)
+
+	c, _, _, err = newTestCert(untrustedCA, untrustedKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	signer, err = pool.VerifyWithSigner(time.Now(), c)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+	assert.Nil(t, signer)
+}
+
+func TestCAPool_VerifySignerRole(t *testing.T) {
+	before := time.Now().Add(-time.Minute).Truncate(time.Second)
+	after := time.Now().Add(time.Minute).Truncate(time.Second)
+	ca, caPub, caKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	caFp, err := ca.Fingerprint()
+	assert.NoError(t, err)
+	c, _, _, err := newTestCert(ca, caKey, before, after, nil, nil, nil)
+	assert.NoError(t, err)
+
+	pool := NewCAPool()
+	assert.NoError(t, pool.AddCA(ca))
+	_, err = pool.Verify(c)
+	assert.NoError(t, err)
+
+	// A non CA certificate holding the same key is placed in the pool in place of the CA
+	mislabeled, err := (&TBSCertificate{
+		Version:   Version1,
+		Name:      "not a ca",
+		Networks:  []netip.Prefix{netip.MustParsePrefix("10.1.1.1/24")},
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: caPub,
+		Curve:     Curve_CURVE25519,
+	}).Sign(ca, Curve_CURVE25519, caKey)
+	assert.NoError(t, err)
+	pool.CAs[caFp] = &CachedCertificate{Certificate: mislabeled, Fingerprint: caFp}
+	_, err = pool.Verify(c)
+	assert.ErrorIs(t, err, ErrSignerNotCA)
+	ok, errs := pool.VerifyIgnoringExpiry(c)
+	assert.False(t, ok)
+	assert.Equal(t, []error{ErrSignerNotCA}, errs)
+
+	// A CA certificate carrying a valid signature from another CA is not trusted
+	pool = NewCAPool()
+	assert.NoError(t, pool.AddCA(ca))
+	sub, _, _, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	subV1 := sub.Copy().(*certificateV1)
+	subV1.details.Issuer = caFp
+	tbs, err := subV1.TBSBytes()
+	assert.NoError(t, err)
+	subV1.signature = ed25519.Sign(caKey, tbs)
+	assert.True(t, subV1.CheckSignature(caPub))
+	_, err = pool.Verify(subV1)
+	assert.ErrorIs(t, err, ErrCASignedByCA)
+}
+
+func TestCAPool_VerifyChain(t *testing.T) {
+	before := time.Now().Add(-time.Minute).Truncate(time.Second)
+	after := time.Now().Add(time.Minute).Truncate(time.Second)
+	newIntermediate := func(signer Certificate, signerKey []byte) (Certificate, []byte) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		c, err := (&TBSCertificate{
+			Version:   Version1,
+			Name:      "intermediate ca",
+			IsCA:      true,
+			NotBefore: before,
+			NotAfter:  after,
+			PublicKey: pub,
+		}).Sign(signer, Curve_CURVE25519, signerKey)
+		assert.NoError(t, err)
+		return c, priv
+	}
+
+	root, _, rootKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	rootFp, err := root.Fingerprint()
+	assert.NoError(t, err)
+	intermediate, intermediateKey := newIntermediate(root, rootKey)
+	intermediateFp, err := intermediate.Fingerprint()
+	assert.NoError(t, err)
+	leaf, _, _, err := newTestCert(intermediate, intermediateKey, before, after, nil, nil, nil)
+	assert.NoError(t, err)
+
+	// leaf -> intermediate -> root
+	pool := NewCAPool()
+	assert.NoError(t, pool.AddCA(root))
+	assert.NoError(t, pool.AddIntermediate(intermediate))
+	cc, err := pool.Verify(leaf)
+	assert.NoError(t, err)
+	assert.Equal(t, intermediateFp, cc.signerFingerprint)
+	assert.NoError(t, pool.VerifyCached(cc))
+	ok, warnings := pool.VerifyIgnoringExpiry(leaf)
+	assert.True(t, ok)
+	assert.Empty(t, warnings)
+
+	// The intermediate can be verified on its own while intermediates are enabled
+	cc, err = pool.Verify(intermediate)
+	assert.NoError(t, err)
+	assert.Equal(t, rootFp, cc.signerFingerprint)
+	pool.MaxChainDepth = 0
+	_, err = pool.Verify(intermediate)
+	assert.ErrorIs(t, err, ErrCASignedByCA)
+	pool.MaxChainDepth = DefaultMaxChainDepth
+
+	// A CA signed by the root that is not one of the intermediates is never valid on its own
+	other, _ := newIntermediate(root, rootKey)
+	_, err = pool.Verify(other)
+	assert.ErrorIs(t, err, ErrCASignedByCA)
+
+	// Only CAs can be intermediates
+	assert.ErrorIs(t, pool.AddIntermediate(leaf), ErrNotCA)
+	assert.EqualError(t, pool.AddIntermediate(root), "test ca: intermediate certificate has no issuer")
+
+	// The intermediate is unknown to the pool
+	pool = NewCAPool()
+	assert.NoError(t, pool.AddCA(root))
+	_, err = pool.Verify(leaf)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+
+	// The intermediate was signed by a root outside the pool
+	otherRoot, _, otherKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	untrusted, untrustedKey := newIntermediate(otherRoot, otherKey)
+	untrustedLeaf, _, _, err := newTestCert(untrusted, untrustedKey, before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, pool.AddIntermediate(untrusted))
+	_, err = pool.Verify(untrustedLeaf)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+	ok, _ = pool.VerifyIgnoringExpiry(untrustedLeaf)
+	assert.False(t, ok)
+
+	// Removing the root revokes certificates that were already verified
+	pool = NewCAPool()
+	assert.NoError(t, pool.AddCA(root))
+	assert.NoError(t, pool.AddIntermediate(intermediate))
+	cc, err = pool.Verify(leaf)
+	assert.NoError(t, err)
+	delete(pool.CAs, rootFp)
+	assert.Error(t, pool.VerifyCached(cc))
+
+	// Blocklisting the intermediate revokes everything it signed
+	assert.NoError(t, pool.AddCA(root))
+	assert.NoError(t, pool.VerifyCached(cc))
+	pool.BlocklistFingerprint(intermediateFp)
+	assert.ErrorIs(t, pool.VerifyCached(cc), ErrBlockListed)
+
+	// Constraints of the root still apply when the intermediate does not constrain anything itself
+	limitedRoot, _, limitedKey, err := newTestCaCert(before, after, nil, nil, []string{"nope"})
+	assert.NoError(t, err)
+	limited, limitedIntermediateKey := newIntermediate(limitedRoot, limitedKey)
+	limitedLeaf, _, _, err := newTestCert(limited, limitedIntermediateKey, before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	pool = NewCAPool()
+	assert.NoError(t, pool.AddCA(limitedRoot))
+	assert.NoError(t, pool.AddIntermediate(limited))
+	_, err = pool.Verify(limitedLeaf)
+	assert.EqualError(t, err, "certificate contained a group not present on the signing ca: test-group1")
+
+	// Each intermediate counts towards MaxChainDepth
+	second, secondKey := newIntermediate(intermediate, intermediateKey)
+	deepLeaf, _, _, err := newTestCert(second, secondKey, before, after, nil, nil, nil)
+	assert.NoError(t, err)
+	pool = NewCAPool()
+	assert.NoError(t, pool.AddCA(root))
+	assert.NoError(t, pool.AddIntermediate(intermediate))
+	assert.NoError(t, pool.AddIntermediate(second))
+	_, err = pool.Verify(deepLeaf)
+	assert.ErrorIs(t, err, ErrChainTooLong)
+	pool.MaxChainDepth = 2
+	_, err = pool.Verify(deepLeaf)
+	assert.NoError(t, err)
+	pool.MaxChainDepth = 0
+	_, err = pool.Verify(leaf)
+	assert.ErrorIs(t, err, ErrChainTooLong)
+}
+
+func TestCAPool_ChainNotAfter(t *testing.T) {
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	ca, _, caKey, err := newTestCaCert(start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	laterCA, _, laterKey, err := newTestCaCert(start, start.Add(20*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	// The leaf expires first
+	c, _, _, err := newTestCert(ca, caKey, start, start.Add(5*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	na, err := caPool.ChainNotAfter(c)
+	assert.NoError(t, err)
+	assert.Equal(t, c.NotAfter(), na)
+
+	// The CA expires first, the leaf is issued by laterCA and outlives ca which only cross signed it. CrossSign refuses
+	// this so the signature is added directly
+	c, _, _, err = newTestCert(laterCA, laterKey, start, start.Add(15*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	dual, err := crossSignV1(c.(*certificateV1), &keySigner{curve: Curve_CURVE25519, key: caKey})
+	assert.NoError(t, err)
+	assert.True(t, dual.NotAfter().After(ca.NotAfter()))
+	na, err = caPool.ChainNotAfter(dual)
+	assert.NoError(t, err)
+	assert.Equal(t, ca.NotAfter(), na)
+
+	// Once the issuer that outlives the leaf is trusted the leaf expires first
+	assert.NoError(t, caPool.AddCA(laterCA))
+	na, err = caPool.ChainNotAfter(dual)
+	assert.NoError(t, err)
+	assert.Equal(t, c.NotAfter(), na)
+
+	// Unknown signer
+	_, err = NewCAPool().ChainNotAfter(c)
+	assert.ErrorIs(t, err, ErrCANotFound)
+
+	// The intermediates between the signer and a root are part of the chain. The leaf outlives its intermediate, Sign
+	// refuses this so the signature is added directly
+	intermediate, intermediateKey := newTestIntermediate(t, laterCA, laterKey, start, start.Add(8*time.Minute))
+	leaf, _, _, err := newTestCert(intermediate, intermediateKey, start, start.Add(5*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	leafV1 := leaf.(*certificateV1)
+	leafV1.details.NotAfter = start.Add(15 * time.Minute)
+	tbs, err := leafV1.TBSBytes()
+	assert.NoError(t, err)
+	leafV1.signature = ed25519.Sign(intermediateKey, tbs)
+
+	caPool = NewCAPool()
+	assert.NoError(t, caPool.AddCA(laterCA))
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	na, err = caPool.ChainNotAfter(leafV1)
+	assert.NoError(t, err)
+	assert.Equal(t, intermediate.NotAfter(), na)
+
+	// An intermediate that does not chain to a root in the pool is not trusted
+	caPool = NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	_, err = caPool.ChainNotAfter(leafV1)
+	assert.ErrorIs(t, err, ErrCANotFound)
+}
+
+func TestCAPool_ValidityFitsAllSigners(t *testing.T) {
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	oldCA, _, oldKey, err := newTestCaCert(start, start.Add(20*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	newCA, _, newKey, err := newTestCaCert(start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	newFp, err := newCA.Fingerprint()
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(oldCA))
+	assert.NoError(t, caPool.AddCA(newCA))
+
+	// Fits within both CAs
+	c, _, _, err := newTestCert(oldCA, oldKey, start, start.Add(5*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	dual, err := CrossSign(c, newCA, Curve_CURVE25519, newKey)
+	assert.NoError(t, err)
+	assert.NoError(t, caPool.ValidityFitsAllSigners(dual))
+
+	// Valid under the old CA but outlives the new one, CrossSign refuses this so the signature is added directly
+	c, _, _, err = newTestCert(oldCA, oldKey, start, start.Add(15*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, caPool.ValidityFitsAllSigners(c))
+	outlives, err := crossSignV1(c.(*certificateV1), &keySigner{curve: Curve_CURVE25519, key: newKey})
+	assert.NoError(t, err)
+	err = caPool.ValidityFitsAllSigners(outlives)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, newFp)
+
+	// Neither signer present
+	assert.ErrorIs(t, NewCAPool().ValidityFitsAllSigners(outlives), ErrCANotFound)
+
+	// Intermediates are checked along with the root they chain to
+	intermediate, intermediateKey := newTestIntermediate(t, oldCA, oldKey, start, start.Add(15*time.Minute))
+	intermediateFp, err := intermediate.Fingerprint()
+	assert.NoError(t, err)
+	leaf, _, _, err := newTestCert(intermediate, intermediateKey, start, start.Add(12*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	caPool = NewCAPool()
+	assert.NoError(t, caPool.AddCA(oldCA))
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	assert.NoError(t, caPool.ValidityFitsAllSigners(leaf))
+
+	outlivesIntermediate := leaf.Copy().(*certificateV1)
+	outlivesIntermediate.details.NotAfter = start.Add(18 * time.Minute)
+	tbs, err := outlivesIntermediate.TBSBytes()
+	assert.NoError(t, err)
+	outlivesIntermediate.signature = ed25519.Sign(intermediateKey, tbs)
+	assert.ErrorContains(t, caPool.ValidityFitsAllSigners(outlivesIntermediate), intermediateFp)
+
+	// An intermediate that does not chain to a root in the pool is not trusted
+	caPool = NewCAPool()
+	assert.NoError(t, caPool.AddCA(newCA))
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	assert.ErrorIs(t, caPool.ValidityFitsAllSigners(leaf), ErrCANotFound)
+}
+
+// newTestIntermediate returns an intermediate CA signed by signer along with its private key
+func newTestIntermediate(t *testing.T, signer Certificate, signerKey []byte, before, after time.Time) (Certificate, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	c, err := (&TBSCertificate{
+		Version:   Version1,
+		Name:      "intermediate ca",
+		IsCA:      true,
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: pub,
+		Curve:     Curve_CURVE25519,
+	}).Sign(signer, Curve_CURVE25519, signerKey)
+	assert.NoError(t, err)
+	return c, priv
+}
+
+func TestCAPool_VerifyAt(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ca, _, caKey, err := newTestCaCert(start, start.Add(2*time.Hour), nil, nil, []string{"a", "b"})
+	assert.NoError(t, err)
+	otherCA, _, otherKey, err := newTestCaCert(start, start.Add(2*time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	c, _, _, err := newTestCert(ca, caKey, start, start.Add(time.Hour), nil, nil, []string{"a"})
+	assert.NoError(t, err)
+
+	ok, reason := caPool.VerifyAt(start.Add(30*time.Minute), c)
+	assert.True(t, ok)
+	assert.Equal(t, VerifyOK, reason)
+
+	// Before and after the leaf was valid
+	ok, reason = caPool.VerifyAt(start.Add(90*time.Minute), c)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyExpired, reason)
+
+	ok, reason = caPool.VerifyAt(start.Add(-time.Minute), c)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyNotYetValid, reason)
+
+	// The CA window applies as well
+	lateCA, _, lateKey, err := newTestCaCert(start.Add(30*time.Minute), start.Add(2*time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, caPool.AddCA(lateCA))
+	late, _, _, err := newTestCert(lateCA, lateKey, start.Add(30*time.Minute), start.Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, reason = caPool.VerifyAt(start.Add(3*time.Hour), late)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyExpired, reason)
+
+	// Signed by a CA outside the pool
+	untrusted, _, _, err := newTestCert(otherCA, otherKey, start, start.Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, reason = caPool.VerifyAt(start.Add(30*time.Minute), untrusted)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyUntrusted, reason)
+
+	// Signed by an intermediate that does not chain to a trusted root
+	root, _, rootKey, err := newTestCaCert(start, start.Add(2*time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	intermediatePub, intermediateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	intermediate, err := (&TBSCertificate{
+		Version:   Version1,
+		Name:      "intermediate ca",
+		IsCA:      true,
+		NotBefore: start,
+		NotAfter:  start.Add(2 * time.Hour),
+		PublicKey: intermediatePub,
+	}).Sign(root, Curve_CURVE25519, rootKey)
+	assert.NoError(t, err)
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	orphan, _, _, err := newTestCert(intermediate, intermediateKey, start, start.Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, reason = caPool.VerifyAt(start.Add(30*time.Minute), orphan)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyUntrusted, reason)
+
+	// The window of every CA in the chain applies
+	assert.NoError(t, caPool.AddCA(root))
+	lateIntermediate, lateIntermediateKey := newTestIntermediate(t, root, rootKey, start.Add(30*time.Minute), start.Add(2*time.Hour))
+	assert.NoError(t, caPool.AddIntermediate(lateIntermediate))
+	chained, _, _, err := newTestCert(lateIntermediate, lateIntermediateKey, start.Add(30*time.Minute), start.Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, reason = caPool.VerifyAt(start.Add(45*time.Minute), chained)
+	assert.True(t, ok)
+	assert.Equal(t, VerifyOK, reason)
+	ok, reason = caPool.VerifyAt(start.Add(10*time.Minute), chained)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyNotYetValid, reason)
+	ok, reason = caPool.VerifyAt(start.Add(3*time.Hour), chained)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyExpired, reason)
+
+	// Signed by a key other than the issuer
+	forged := c.Copy().(*certificateV1)
+	forged.signature[0] ^= 0xff
+	ok, reason = caPool.VerifyAt(start.Add(30*time.Minute), forged)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyUntrusted, reason)
+
+	// A group the CA does not allow, Sign refuses this so the certificate is signed directly
+	violating := c.Copy().(*certificateV1)
+	violating.details.Groups = []string{"c"}
+	b, err := violating.TBSBytes()
+	assert.NoError(t, err)
+	violating.signature = ed25519.Sign(caKey, b)
+	ok, reason = caPool.VerifyAt(start.Add(30*time.Minute), violating)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyConstraintViolation, reason)
+
+	// Revoked
+	fp, err := c.Fingerprint()
+	assert.NoError(t, err)
+	caPool.BlocklistFingerprint(fp)
+	ok, reason = caPool.VerifyAt(start.Add(30*time.Minute), c)
+	assert.False(t, ok)
+	assert.Equal(t, VerifyRevoked, reason)
+	assert.Equal(t, "revoked", reason.String())
+}
+
+func TestCAPool_VerifyIgnoringExpiry(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ca, _, caKey, err := newTestCaCert(start, start.Add(30*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	liveCA, _, liveKey, err := newTestCaCert(start, time.Now().Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+	otherCA, _, otherKey, err := newTestCaCert(start, time.Now().Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.ErrorIs(t, caPool.AddCA(ca), ErrExpired)
+	assert.NoError(t, caPool.AddCA(liveCA))
+
+	// Expired leaf and root are warnings only
+	c, _, _, err := newTestCert(ca, caKey, start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	_, err = caPool.Verify(c)
+	assert.ErrorIs(t, err, ErrRootExpired)
+	ok, warnings := caPool.VerifyIgnoringExpiry(c)
+	assert.True(t, ok)
+	assert.Equal(t, []error{ErrRootExpired, ErrExpired}, warnings)
+
+	// Expired leaf from a live root
+	c, _, _, err = newTestCert(liveCA, liveKey, start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, warnings = caPool.VerifyIgnoringExpiry(c)
+	assert.True(t, ok)
+	assert.Equal(t, []error{ErrExpired}, warnings)
+
+	// Valid
+	c, _, _, err = newTestCert(liveCA, liveKey, start, time.Now().Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, warnings = caPool.VerifyIgnoringExpiry(c)
+	assert.True(t, ok)
+	assert.Empty(t, warnings)
+
+	// Other checks still fail
+	fp, err := c.Fingerprint()
+	assert.NoError(t, err)
+	caPool.BlocklistFingerprint(fp)
+	ok, warnings = caPool.VerifyIgnoringExpiry(c)
+	assert.False(t, ok)
+	assert.Equal(t, []error{ErrBlockListed}, warnings)
+
+	c, _, _, err = newTestCert(otherCA, otherKey, start, start.Add(10*time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	ok, warnings = caPool.VerifyIgnoringExpiry(c)
+	assert.False(t, ok)
+	if assert.Len(t, warnings, 1) {
+		assert.EqualError(t, warnings[0], "could not find ca for the certificate")
+	}
+}
+
+func TestCAPool_SkewTolerance(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil, nil)
+	assert.NoError(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	// Not yet valid
+	c, _, _, err := newTestCert(ca, caKey, time.Now().Add(10*time.Second), time.Now().Add(time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	_, err = caPool.Verify(c)
+	assert.ErrorIs(t, err, ErrExpired)
+
+	caPool.SkewTolerance = 30 * time.Second
+	_, err = caPool.Verify(c)
+	assert.NoError(t, err)
+
+	// Just expired
+	c, _, _, err = newTestCert(ca, caKey, time.Now().Add(-time.Minute), time.Now().Add(-10*time.Second), nil, nil, nil)
+	assert.NoError(t, err)
+	_, err = caPool.Verify(c)
+	assert.NoError(t, err)
+
+	caPool.SkewTolerance = 0
+	_, err = caPool.Verify(c)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestCAPool_ExportImportBlocklist(t *testing.T) {
+	caPool := NewCAPool()
+	assert.Empty(t, caPool.ExportBlocklist())
+
+	caPool.BlocklistFingerprint("cc")
+	caPool.BlocklistFingerprint("aa")
+	caPool.BlocklistFingerprint("bb")
+	exported := caPool.ExportBlocklist()
+	assert.Equal(t, []string{"aa", "bb", "cc"}, exported)
+
+	// Round trips into a new pool
+	other := NewCAPool()
+	other.ImportBlocklist(exported)
+	assert.Equal(t, exported, other.ExportBlocklist())
+	assert.True(t, other.IsBlocklisted("bb"))
+
+	// Importing is additive and idempotent
+	other.ImportBlocklist([]string{"dd", "aa"})
+	other.ImportBlocklist([]string{"dd", "aa"})
+	assert.Equal(t, []string{"aa", "bb", "cc", "dd"}, other.ExportBlocklist())
+}
+
+func TestCAPool_NameConstraints(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	tbs := &TBSCertificate{
+		Version:         Version1,
+		Name:            "constrained ca",
+		IsCA:            true,
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(time.Hour),
+		PublicKey:       pub,
+		Curve:           Curve_CURVE25519,
+		NameConstraints: []string{"*.prod.example", "bastion"},
+	}
+	ca, err := tbs.Sign(nil, Curve_CURVE25519, priv)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*.prod.example", "bastion"}, ca.NameConstraints())
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	sign := func(name string) (Certificate, error) {
+		hostPub, _ := x25519Keypair()
+		tbs := &TBSCertificate{
+			Version:   Version1,
+			Name:      name,
+			Networks:  []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute),
+			PublicKey: hostPub,
+			Curve:     Curve_CURVE25519,
+		}
+		return tbs.Sign(ca, Curve_CURVE25519, priv)
+	}
+
+	for _, name := range []string{"web.prod.example", "db.east.prod.example", "bastion"} {
+		c, err := sign(name)
+		assert.NoError(t, err, name)
+		_, err = caPool.Verify(c)
+		assert.NoError(t, err, name)
+	}
+
+	for _, name := range []string{"web.staging.example", "webprod.example", ".prod.example", "bastion.prod", "a/b.prod.example/x"} {
+		_, err = sign(name)
+		assert.EqualError(t, err, "certificate name does not match the name constraints of the signing ca: "+name)
+	}
+
+	// Constraints only apply to leaf certificates, an intermediate can have any name but its leaves are still checked
+	intermediatePub, intermediatePriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	intermediate, err := (&TBSCertificate{
+		Version:   Version1,
+		Name:      "Prod Intermediate CA",
+		IsCA:      true,
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(30 * time.Minute),
+		PublicKey: intermediatePub,
+		Curve:     Curve_CURVE25519,
+	}).Sign(ca, Curve_CURVE25519, priv)
+	assert.NoError(t, err)
+	assert.NoError(t, CheckCAConstraints(ca, intermediate))
+	assert.NoError(t, caPool.AddIntermediate(intermediate))
+	for name, valid := range map[string]bool{"web.prod.example": true, "web.staging.example": false} {
+		hostPub, _ := x25519Keypair()
+		c, err := (&TBSCertificate{
+			Version:   Version1,
+			Name:      name,
+			Networks:  []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute),
+			PublicKey: hostPub,
+			Curve:     Curve_CURVE25519,
+		}).Sign(intermediate, Curve_CURVE25519, intermediatePriv)
+		assert.NoError(t, err, name)
+		_, err = caPool.Verify(c)
+		if valid {
+			assert.NoError(t, err, name)
+		} else {
+			assert.EqualError(t, err, "certificate name does not match the name constraints of the signing ca: "+name)
+		}
+	}
+
+	// The same check is used when verifying
+	otherCA, _, otherKey, err := newTestCaCert(time.Now(), time.Now().Add(time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	other, _, _, err := newTestCert(otherCA, otherKey, time.Now(), time.Now().Add(time.Minute), nil, nil, nil)
+	assert.NoError(t, err)
+	assert.EqualError(t, CheckCAConstraints(ca, other), "certificate name does not match the name constraints of the signing ca: "+other.Name())
+
+	// Only a CA can carry constraints and they must be valid patterns
+	tbs.IsCA = false
+	_, err = tbs.Sign(ca, Curve_CURVE25519, priv)
+	assert.EqualError(t, err, "only a CA certificate can have name constraints")
+	tbs.IsCA = true
+	for _, p := range []string{"", "*", "*prod.example", "*.", "web.*.example", "*.*.example"} {
+		tbs.NameConstraints = []string{p}
+		_, err = tbs.Sign(nil, Curve_CURVE25519, priv)
+		assert.ErrorContains(t, err, "invalid name constraint", p)
+	}
+}
+
+func BenchmarkCAPool_Verify(b *testing.B) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(b, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"web", "db"})
+	assert.NoError(b, err)
+
+	pool := NewCAPool()
+	assert.NoError(b, pool.AddCA(ca))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := pool.Verify(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,7 +1,18 @@
 package cert
 
 import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"maps"
 	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -63,14 +74,42 @@ type Certificate interface {
 	// CheckSignature can be used to verify that the details of this certificate are valid.
 	Signature() []byte
 
+	// TBSBytes returns the bytes that Signature is computed over. Curve_CURVE25519 signatures are made over these
+	// bytes directly, Curve_P256 signatures are made over their sha256 digest.
+	TBSBytes() ([]byte, error)
+
 	// CheckSignature will check that the certificate Signature() matches the
 	// computed signature. A true result means this certificate has not been tampered with.
 	CheckSignature(signingPublicKey []byte) bool
 
+	// CrossSignatures are any additional signatures over the details of this certificate made by CAs other than
+	// the Issuer. A cross signed certificate is trusted by pools containing any of its signers.
+	CrossSignatures() [][]byte
+
+	// CheckAnySignature will return true if Signature() or any of CrossSignatures() was made by one of the
+	// provided keys.
+	CheckAnySignature(signingPublicKeys [][]byte) bool
+
 	// Fingerprint returns the hex encoded sha256 sum of the certificate.
 	// This acts as a unique fingerprint and can be used to blocklist certificates.
 	Fingerprint() (string, error)
 
+	// SerialNumber returns the serial chosen when the certificate was signed, it is carried across renewals when the
+	// same serial is requested again. Certificates from before serial numbers existed return nil.
+	SerialNumber() []byte
+
+	// AllowExtraGroups will return true if this CA permits the certificates it signs to contain groups it does not
+	// list itself. This is part of the signed details so it can not be added after the fact.
+	AllowExtraGroups() bool
+
+	// NameConstraints returns the patterns, such as *.prod.example, that the name of every non CA certificate signed by
+	// this CA, directly or through intermediates, must match at least one of. An empty list places no constraint on names.
+	NameConstraints() []string
+
+	// Comment is a free-text note kept alongside the certificate in its PEM encoding, see WithComment. It is not signed
+	// and is never part of the wire format, fingerprint, or verification.
+	Comment() string
+
 	// Expired tests if the certificate is valid for the provided time.
 	Expired(t time.Time) bool
 
@@ -81,6 +120,10 @@ type Certificate interface {
 	// This is primarily the format transmitted on the wire.
 	Marshal() ([]byte, error)
 
+	// MarshalInto is the same as Marshal except the bytes are appended to buf, which lets hot paths reuse a buffer
+	// instead of allocating a new one every time. The returned slice may share its backing array with buf.
+	MarshalInto(buf []byte) ([]byte, error)
+
 	// MarshalForHandshakes prepares the bytes needed to use directly in a handshake
 	MarshalForHandshakes() ([]byte, error)
 
@@ -88,6 +131,10 @@ type Certificate interface {
 	// This is primarily the format stored on disk
 	MarshalPEM() ([]byte, error)
 
+	// MarshalPublicKeyToPEM will return a PEM encoded representation of only the public key, with a banner naming the
+	// curve. UnmarshalPublicKeyFromPEM reads it back.
+	MarshalPublicKeyToPEM() []byte
+
 	// MarshalJSON will return the json representation of this certificate
 	MarshalJSON() ([]byte, error)
 
@@ -107,6 +154,11 @@ type CachedCertificate struct {
 	signerFingerprint string
 }
 
+// GroupSet returns a copy of the certificate groups as a set, it is safe to modify.
+func (cc *CachedCertificate) GroupSet() map[string]struct{} {
+	return maps.Clone(cc.InvertedGroups)
+}
+
 // UnmarshalCertificate will attempt to unmarshal a wire protocol level certificate.
 func UnmarshalCertificate(b []byte) (Certificate, error) {
 	c, err := unmarshalCertificateV1(b, true)
@@ -127,3 +179,244 @@ func UnmarshalCertificateFromHandshake(b []byte, publicKey []byte) (Certificate,
 	c.details.PublicKey = publicKey
 	return c, nil
 }
+
+// NetworksOverlap returns true if any of the networks assigned to a contain or are contained by any of the networks
+// assigned to b. This can be used to detect conflicting network assignments before issuing a new certificate.
+func NetworksOverlap(a, b Certificate) bool {
+	for _, an := range a.Networks() {
+		for _, bn := range b.Networks() {
+			if an.Overlaps(bn) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IntersectGroups returns the groups present on both a and b, sorted and without duplicates.
+func IntersectGroups(a, b Certificate) []string {
+	var out []string
+	for _, g := range a.Groups() {
+		if slices.Contains(b.Groups(), g) {
+			out = append(out, g)
+		}
+	}
+
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// UnionGroups returns the groups present on any of certs, sorted and without duplicates.
+func UnionGroups(certs ...Certificate) []string {
+	var out []string
+	for _, c := range certs {
+		out = append(out, c.Groups()...)
+	}
+
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// Equal returns true if a and b marshal to the exact same bytes, including the signature. This can be used to tell if a
+// freshly loaded certificate is the one already in use. Two nil certificates are equal.
+func Equal(a, b Certificate) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	ab, err := a.Marshal()
+	if err != nil {
+		return false
+	}
+
+	bb, err := b.Marshal()
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(ab, bb)
+}
+
+// FingerprintWithHash returns the hex encoded digest of the marshaled certificate using h. Fingerprint is the same as
+// using crypto.SHA256, other hashes are only intended for interop with external inventory systems.
+// SHA1, SHA256, SHA384, and SHA512 are supported, anything else will return ErrUnsupportedFingerprintHash.
+//
+// Cross signatures are left out of the digest. They are not covered by the primary signature so anyone holding the
+// certificate could add one, which must not change its identity or let it slip past the blocklist.
+func FingerprintWithHash(c Certificate, h crypto.Hash) (string, error) {
+	switch h {
+	case crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512:
+	default:
+		return "", fmt.Errorf("%v: %w", h, ErrUnsupportedFingerprintHash)
+	}
+
+	buf := getMarshalBuffer()
+	defer putMarshalBuffer(buf)
+
+	var b []byte
+	var err error
+	switch tc := c.(type) {
+	case *certificateV1:
+		b, err = tc.marshalSignedInto((*buf)[:0])
+	default:
+		b, err = c.MarshalInto((*buf)[:0])
+	}
+	if err != nil {
+		return "", err
+	}
+	*buf = b
+
+	hh := h.New()
+	hh.Write(b)
+	return hex.EncodeToString(hh.Sum(nil)), nil
+}
+
+// marshalBuffers holds scratch buffers for marshaling certificates while fingerprinting and checking signatures
+var marshalBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+func getMarshalBuffer() *[]byte {
+	return marshalBuffers.Get().(*[]byte)
+}
+
+func putMarshalBuffer(b *[]byte) {
+	// Don't hold on to the occasional huge certificate
+	if cap(*b) > 16*1024 {
+		return
+	}
+	marshalBuffers.Put(b)
+}
+
+// RemainingValidity returns the time left between t and when c expires. The result is negative if c has already expired
+// at t.
+func RemainingValidity(c Certificate, t time.Time) time.Duration {
+	return c.NotAfter().Sub(t)
+}
+
+// ValidityFraction returns how far through its lifetime c is at t, 0 when it becomes valid and 1 when it expires.
+// The result is clamped to [0, 1] so times before NotBefore or after NotAfter are reported as the boundaries.
+// This can be used to trigger a renewal once a certificate has used up a given portion of its lifetime.
+func ValidityFraction(c Certificate, t time.Time) float64 {
+	lifetime := c.NotAfter().Sub(c.NotBefore())
+	if lifetime <= 0 {
+		return 1
+	}
+
+	f := float64(t.Sub(c.NotBefore())) / float64(lifetime)
+	return min(max(f, 0), 1)
+}
+
+// ConstraintSummary returns a single line describing what the CA c is allowed to issue, covering groups, networks,
+// unsafe networks, names, and the validity window that signed certificates must fit in. Anything not constrained is
+// reported as any. An empty string is returned if c is not a CA.
+func ConstraintSummary(c Certificate) string {
+	if !c.IsCA() {
+		return ""
+	}
+
+	list := func(s []string) string {
+		if len(s) == 0 {
+			return "any"
+		}
+		return strings.Join(s, ", ")
+	}
+
+	prefixes := func(ps []netip.Prefix) string {
+		s := make([]string, len(ps))
+		for i, p := range ps {
+			s[i] = p.String()
+		}
+		return list(s)
+	}
+
+	groups := list(c.Groups())
+	if c.AllowExtraGroups() {
+		groups = "any"
+	}
+
+	return fmt.Sprintf("groups: %s; networks: %s; unsafe networks: %s; names: %s; valid %s to %s",
+		groups,
+		prefixes(c.Networks()),
+		prefixes(c.UnsafeNetworks()),
+		list(c.NameConstraints()),
+		c.NotBefore().UTC().Format(time.RFC3339),
+		c.NotAfter().UTC().Format(time.RFC3339),
+	)
+}
+
+// Diff returns a human-readable line for every field that differs between a and b, in the order they appear in String.
+// Lists report what b added and removed relative to a, the public key is only reported as changed. An empty result
+// means the details of a and b are the same, signatures are not compared.
+func Diff(a, b Certificate) []string {
+	var out []string
+
+	changed := func(name string, av, bv interface{}) {
+		if av != bv {
+			out = append(out, fmt.Sprintf("%s: %v -> %v", name, av, bv))
+		}
+	}
+
+	listed := func(name string, as, bs []string) {
+		if added := missingFrom(bs, as); len(added) > 0 {
+			out = append(out, fmt.Sprintf("%s added: %s", name, strings.Join(added, ", ")))
+		}
+		if removed := missingFrom(as, bs); len(removed) > 0 {
+			out = append(out, fmt.Sprintf("%s removed: %s", name, strings.Join(removed, ", ")))
+		}
+	}
+
+	prefixes := func(ps []netip.Prefix) []string {
+		s := make([]string, len(ps))
+		for i, p := range ps {
+			s[i] = p.String()
+		}
+		return s
+	}
+
+	changed("Name", a.Name(), b.Name())
+	listed("Ips", prefixes(a.Networks()), prefixes(b.Networks()))
+	listed("Subnets", prefixes(a.UnsafeNetworks()), prefixes(b.UnsafeNetworks()))
+	listed("Groups", a.Groups(), b.Groups())
+	if !a.NotBefore().Equal(b.NotBefore()) {
+		changed("Not before", a.NotBefore(), b.NotBefore())
+	}
+	if !a.NotAfter().Equal(b.NotAfter()) {
+		changed("Not After", a.NotAfter(), b.NotAfter())
+	}
+	changed("Is CA", a.IsCA(), b.IsCA())
+	changed("Issuer", a.Issuer(), b.Issuer())
+	changed("Curve", a.Curve(), b.Curve())
+	if !bytes.Equal(a.PublicKey(), b.PublicKey()) {
+		out = append(out, "Public key changed")
+	}
+	changed("Allow extra groups", a.AllowExtraGroups(), b.AllowExtraGroups())
+	listed("Name constraints", a.NameConstraints(), b.NameConstraints())
+	if !bytes.Equal(a.SerialNumber(), b.SerialNumber()) {
+		changed("Serial number", fmt.Sprintf("%x", a.SerialNumber()), fmt.Sprintf("%x", b.SerialNumber()))
+	}
+
+	return out
+}
+
+// missingFrom returns the entries of a that are not in b, keeping the order of a
+func missingFrom(a, b []string) []string {
+	var out []string
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, v)
+		}
+	}
+	return out
+}
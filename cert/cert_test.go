@@ -1,10 +1,12 @@
 package cert
 
 import (
+	"crypto"
 	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/netip"
@@ -15,6 +17,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestMarshalingNebulaCertificate(t *testing.T) {
@@ -355,6 +358,609 @@ func TestNebulaCertificate_Verify_IPs(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_Verify_HostConstraint(t *testing.T) {
+	caIp := mustParsePrefixUnmapped("10.0.0.5/32")
+	caSubnet := mustParsePrefixUnmapped("192.168.0.5/32")
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []netip.Prefix{caIp}, []netip.Prefix{caSubnet}, []string{"test"})
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+
+	// The exact host is permitted
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{caIp}, []netip.Prefix{caSubnet}, []string{"test"})
+	assert.Nil(t, err)
+	_, err = caPool.VerifyCertificate(time.Now(), c)
+	assert.Nil(t, err)
+
+	// The same host with a larger network is not permitted
+	cIp := mustParsePrefixUnmapped("10.0.0.5/24")
+	_, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{cIp}, []netip.Prefix{caSubnet}, []string{"test"})
+	assert.EqualError(t, err, "certificate contained a network assignment outside the limitations of the signing ca: 10.0.0.5/24")
+
+	// A different host is not permitted
+	cIp = mustParsePrefixUnmapped("10.0.0.6/32")
+	_, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{cIp}, []netip.Prefix{caSubnet}, []string{"test"})
+	assert.EqualError(t, err, "certificate contained a network assignment outside the limitations of the signing ca: 10.0.0.6/32")
+
+	// The same rules apply to unsafe networks
+	cSubnet := mustParsePrefixUnmapped("192.168.0.5/24")
+	_, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{caIp}, []netip.Prefix{cSubnet}, []string{"test"})
+	assert.EqualError(t, err, "certificate contained an unsafe network assignment outside the limitations of the signing ca: 192.168.0.5/24")
+}
+
+func TestNetworksOverlap(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	newCert := func(networks ...string) Certificate {
+		var n []netip.Prefix
+		for _, s := range networks {
+			n = append(n, mustParsePrefixUnmapped(s))
+		}
+		c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, n, nil, nil)
+		assert.Nil(t, err)
+		return c
+	}
+
+	// Same network
+	assert.True(t, NetworksOverlap(newCert("10.1.1.1/24"), newCert("10.1.1.2/24")))
+
+	// One contains the other, in both directions
+	assert.True(t, NetworksOverlap(newCert("10.1.0.1/16"), newCert("10.1.1.2/24")))
+	assert.True(t, NetworksOverlap(newCert("10.1.1.2/24"), newCert("10.1.0.1/16")))
+
+	// Only one of many overlaps
+	assert.True(t, NetworksOverlap(newCert("192.168.0.1/24", "10.1.1.1/32"), newCert("172.16.0.1/24", "10.1.1.1/24")))
+
+	// Disjoint
+	assert.False(t, NetworksOverlap(newCert("10.1.1.1/24"), newCert("10.1.2.1/24")))
+	assert.False(t, NetworksOverlap(newCert("10.1.1.1/32"), newCert("10.1.1.2/32")))
+	assert.False(t, NetworksOverlap(newCert("192.168.0.1/24", "10.1.1.1/24"), newCert("172.16.0.1/16", "10.2.1.1/16")))
+}
+
+func TestGroupSetOperations(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	a, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"web", "prod", "ssh"})
+	assert.Nil(t, err)
+	b, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"ssh", "db", "prod"})
+	assert.Nil(t, err)
+	other, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"dev"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"prod", "ssh"}, IntersectGroups(a, b))
+	assert.Equal(t, []string{"prod", "ssh"}, IntersectGroups(b, a))
+	assert.Empty(t, IntersectGroups(a, other))
+
+	assert.Equal(t, []string{"db", "prod", "ssh", "web"}, UnionGroups(a, b))
+	assert.Equal(t, []string{"db", "dev", "prod", "ssh", "web"}, UnionGroups(a, b, other))
+	assert.Empty(t, UnionGroups())
+
+	// The set is a copy
+	caPool := NewCAPool()
+	assert.Nil(t, caPool.AddCA(ca))
+	cc, err := caPool.Verify(a)
+	assert.Nil(t, err)
+	set := cc.GroupSet()
+	assert.Equal(t, map[string]struct{}{"web": {}, "prod": {}, "ssh": {}}, set)
+	delete(set, "web")
+	assert.Contains(t, cc.InvertedGroups, "web")
+}
+
+func TestMarshalPublicKeyToPEM(t *testing.T) {
+	ca25519, _, key25519, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	caP256, _, keyP256, err := newTestCaCertP256(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	c25519, _, _, err := newTestCert(ca25519, key25519, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	cP256, _, _, err := newTestCert(caP256, keyP256, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name   string
+		c      Certificate
+		banner string
+	}{
+		{"curve25519 ca", ca25519, Ed25519PublicKeyBanner},
+		{"curve25519", c25519, X25519PublicKeyBanner},
+		{"p256 ca", caP256, P256PublicKeyBanner},
+		{"p256", cP256, P256PublicKeyBanner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.c.MarshalPublicKeyToPEM()
+			p, _ := pem.Decode(b)
+			assert.NotNil(t, p)
+			assert.Equal(t, tt.banner, p.Type)
+
+			pub, rest, curve, err := UnmarshalPublicKeyFromPEM(b)
+			assert.Nil(t, err)
+			assert.Empty(t, rest)
+			assert.Equal(t, tt.c.Curve(), curve)
+			assert.Equal(t, tt.c.PublicKey(), pub)
+		})
+	}
+}
+
+func TestMarshalInto(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"web"})
+	assert.Nil(t, err)
+
+	want, err := c.Marshal()
+	assert.Nil(t, err)
+
+	// The certificate is appended after anything already in the buffer
+	buf := make([]byte, 0, 1024)
+	buf = append(buf, "prefix"...)
+	b, err := c.MarshalInto(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]byte("prefix"), want...), b)
+	assert.Equal(t, &buf[0], &b[0])
+
+	// Reusing the buffer gives the same result
+	b, err = c.MarshalInto(b[:0])
+	assert.Nil(t, err)
+	assert.Equal(t, want, b)
+}
+
+func TestEqual(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	// A round trip through the wire format is equal
+	b, err := c.Marshal()
+	assert.Nil(t, err)
+	c2, err := UnmarshalCertificate(b)
+	assert.Nil(t, err)
+	assert.True(t, Equal(c, c2))
+	assert.True(t, Equal(c, c.Copy()))
+
+	// Different signature
+	c3 := c.Copy().(*certificateV1)
+	c3.signature[0] ^= 0xff
+	assert.False(t, Equal(c, c3))
+
+	// Different name
+	c4 := c.Copy().(*certificateV1)
+	c4.details.Name = "other"
+	assert.False(t, Equal(c, c4))
+
+	// nil handling
+	assert.True(t, Equal(nil, nil))
+	assert.False(t, Equal(c, nil))
+	assert.False(t, Equal(nil, c))
+}
+
+func TestFingerprintWithHash(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	fp, err := c.Fingerprint()
+	assert.Nil(t, err)
+
+	fp256, err := FingerprintWithHash(c, crypto.SHA256)
+	assert.Nil(t, err)
+	assert.Equal(t, fp, fp256)
+
+	fp512, err := FingerprintWithHash(c, crypto.SHA512)
+	assert.Nil(t, err)
+	assert.Len(t, fp512, 128)
+	assert.NotEqual(t, fp256, fp512)
+
+	fp1, err := FingerprintWithHash(c, crypto.SHA1)
+	assert.Nil(t, err)
+	assert.Len(t, fp1, 40)
+
+	_, err = FingerprintWithHash(c, crypto.MD5)
+	assert.ErrorIs(t, err, ErrUnsupportedFingerprintHash)
+}
+
+func TestConstraintSummary(t *testing.T) {
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	after := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	tbs := &TBSCertificate{
+		Version:         Version1,
+		Name:            "constrained ca",
+		Groups:          []string{"web", "db"},
+		Networks:        []netip.Prefix{mustParsePrefixUnmapped("10.1.0.0/16")},
+		NameConstraints: []string{"*.prod.example"},
+		IsCA:            true,
+		NotBefore:       before,
+		NotAfter:        after,
+		PublicKey:       pub,
+		Curve:           Curve_CURVE25519,
+	}
+	ca, err := tbs.Sign(nil, Curve_CURVE25519, priv)
+	assert.Nil(t, err)
+	assert.Equal(t, "groups: web, db; networks: 10.1.0.0/16; unsafe networks: any; names: *.prod.example; valid 2024-01-01T00:00:00Z to 2025-01-01T00:00:00Z", ConstraintSummary(ca))
+
+	// Extra groups lift the group constraint
+	tbs.AllowExtraGroups = true
+	ca, err = tbs.Sign(nil, Curve_CURVE25519, priv)
+	assert.Nil(t, err)
+	assert.Contains(t, ConstraintSummary(ca), "groups: any;")
+
+	// Leaf certificates have no summary
+	other, _, otherKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(other, otherKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", ConstraintSummary(c))
+}
+
+func TestDiff(t *testing.T) {
+	before := time.Now().Add(-time.Minute).Truncate(time.Second)
+	after := time.Now().Add(time.Hour).Truncate(time.Second)
+	ca, _, caKey, err := newTestCaCert(before, after, nil, nil, nil)
+	assert.Nil(t, err)
+	a, _, _, err := newTestCert(ca, caKey, before, after.Add(-time.Minute), nil, nil, []string{"web", "db"})
+	assert.Nil(t, err)
+	assert.Empty(t, Diff(a, a))
+
+	// Renewal keeps the public key, so only groups and validity change
+	tbs := Renew(a, before, after)
+	tbs.Groups = []string{"db", "ops"}
+	b, err := tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Groups added: ops",
+		"Groups removed: web",
+		fmt.Sprintf("Not After: %v -> %v", a.NotAfter(), b.NotAfter()),
+	}, Diff(a, b))
+
+	// A new key is reported without the key material
+	c, _, _, err := newTestCert(ca, caKey, before, after.Add(-time.Minute), nil, nil, []string{"web", "db"})
+	assert.Nil(t, err)
+	assert.Contains(t, Diff(a, c), "Public key changed")
+}
+
+func TestRemainingValidity(t *testing.T) {
+	notBefore := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+	notAfter := notBefore.Add(4 * time.Minute)
+	ca, _, caKey, err := newTestCaCert(notBefore, notAfter, nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(ca, caKey, notBefore, notAfter, nil, nil, nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 4*time.Minute, RemainingValidity(c, notBefore))
+	assert.Equal(t, time.Minute, RemainingValidity(c, notAfter.Add(-time.Minute)))
+	assert.Equal(t, time.Duration(0), RemainingValidity(c, notAfter))
+	assert.Equal(t, -time.Minute, RemainingValidity(c, notAfter.Add(time.Minute)))
+
+	assert.Equal(t, 0.0, ValidityFraction(c, notBefore))
+	assert.Equal(t, 0.75, ValidityFraction(c, notBefore.Add(3*time.Minute)))
+	assert.Equal(t, 1.0, ValidityFraction(c, notAfter))
+
+	// Outside of the validity window is clamped
+	assert.Equal(t, 0.0, ValidityFraction(c, notBefore.Add(-time.Hour)))
+	assert.Equal(t, 1.0, ValidityFraction(c, notAfter.Add(time.Hour)))
+}
+
+// memorySigner is a Signer that could be backed by anything, it records the data it was asked to sign
+type memorySigner struct {
+	key    ed25519.PrivateKey
+	signed [][]byte
+}
+
+func (s *memorySigner) Public() []byte {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+func (s *memorySigner) Curve() Curve {
+	return Curve_CURVE25519
+}
+
+func (s *memorySigner) SignRaw(data []byte) ([]byte, error) {
+	s.signed = append(s.signed, data)
+	return ed25519.Sign(s.key, data), nil
+}
+
+func TestTBSCertificate_SignWith(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	s := &memorySigner{key: priv}
+
+	before := time.Now().Add(-2 * time.Minute).Round(time.Second)
+	after := time.Now().Add(2 * time.Minute).Round(time.Second)
+	tbs := &TBSCertificate{
+		Version:   Version1,
+		Name:      "test ca",
+		IsCA:      true,
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: s.Public(),
+	}
+	ca, err := tbs.SignWith(nil, s)
+	assert.Nil(t, err)
+	assert.Len(t, s.signed, 1)
+	assert.True(t, ca.CheckSignature(s.Public()))
+
+	pub, _ := x25519Keypair()
+	tbs = &TBSCertificate{
+		Version:   Version1,
+		Name:      "test host",
+		Networks:  []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: pub,
+	}
+	c, err := tbs.SignWith(ca, s)
+	assert.Nil(t, err)
+	assert.Len(t, s.signed, 2)
+
+	caPool := NewCAPool()
+	assert.Nil(t, caPool.AddCA(ca))
+	_, err = caPool.Verify(c)
+	assert.Nil(t, err)
+
+	// The signature matches what Sign produces with the raw key
+	c2, err := tbs.Sign(ca, Curve_CURVE25519, priv)
+	assert.Nil(t, err)
+	assert.Equal(t, c.Signature(), c2.Signature())
+
+	// Curve mismatches are rejected before the signer is used
+	tbs.Curve = Curve_P256
+	_, err = tbs.SignWith(ca, s)
+	assert.EqualError(t, err, "curve in cert and private key supplied don't match")
+	assert.Len(t, s.signed, 2)
+}
+
+func TestAttachSignature(t *testing.T) {
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	before := time.Now().Add(-2 * time.Minute).Round(time.Second)
+	after := time.Now().Add(2 * time.Minute).Round(time.Second)
+	tbs := &TBSCertificate{
+		Version:   Version1,
+		Name:      "test ca",
+		IsCA:      true,
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: caPub,
+	}
+	unsigned, err := tbs.Unsigned(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, unsigned.Signature())
+
+	b, err := unsigned.TBSBytes()
+	assert.Nil(t, err)
+	ca, err := AttachSignature(unsigned, ed25519.Sign(caPriv, b))
+	assert.Nil(t, err)
+	assert.True(t, ca.CheckSignature(caPub))
+	assert.Empty(t, unsigned.Signature())
+
+	pub, _ := x25519Keypair()
+	tbs = &TBSCertificate{
+		Version:   Version1,
+		Name:      "test host",
+		Networks:  []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+		NotBefore: before,
+		NotAfter:  after,
+		PublicKey: pub,
+	}
+	unsigned, err = tbs.Unsigned(ca)
+	assert.Nil(t, err)
+	b, err = unsigned.TBSBytes()
+	assert.Nil(t, err)
+	c, err := AttachSignature(unsigned, ed25519.Sign(caPriv, b))
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	assert.Nil(t, caPool.AddCA(ca))
+	_, err = caPool.Verify(c)
+	assert.Nil(t, err)
+
+	// Matches what Sign produces with the raw key
+	c2, err := tbs.Sign(ca, Curve_CURVE25519, caPriv)
+	assert.Nil(t, err)
+	assert.True(t, Equal(c, c2))
+
+	_, err = AttachSignature(unsigned, nil)
+	assert.EqualError(t, err, "signature is empty")
+
+	// The same checks as Sign apply
+	tbs.NotAfter = ca.NotAfter().Add(time.Hour)
+	_, err = tbs.Unsigned(ca)
+	assert.EqualError(t, err, "certificate expires after signing certificate")
+}
+
+func TestCertificateV1_SerialNumber(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, ca.SerialNumber(), serialNumberLen)
+
+	pub, _ := x25519Keypair()
+	tbs := &TBSCertificate{
+		Version:      Version1,
+		Name:         "test host",
+		Networks:     []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+		NotBefore:    time.Now().Add(-time.Minute).Round(time.Second),
+		NotAfter:     time.Now().Add(time.Minute).Round(time.Second),
+		PublicKey:    pub,
+		SerialNumber: []byte{1, 2, 3, 4},
+	}
+	c, err := tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, c.SerialNumber())
+	assert.Contains(t, c.String(), "Serial number: 01020304")
+	b, err := c.MarshalJSON()
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"serialNumber":"01020304"`)
+
+	// Survives a round trip
+	b, err = c.Marshal()
+	assert.Nil(t, err)
+	c2, err := unmarshalCertificateV1(b, true)
+	assert.Nil(t, err)
+	assert.Equal(t, c.SerialNumber(), c2.SerialNumber())
+	assert.True(t, c2.CheckSignature(ca.PublicKey()))
+
+	// Is covered by the signature
+	c2.details.SerialNumber[0] = 9
+	assert.False(t, c2.CheckSignature(ca.PublicKey()))
+
+	// A random serial is generated when none is supplied
+	tbs.SerialNumber = nil
+	c3, err := tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.Nil(t, err)
+	assert.Len(t, c3.SerialNumber(), serialNumberLen)
+	assert.NotEqual(t, ca.SerialNumber(), c3.SerialNumber())
+}
+
+func TestRenew(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")}, nil, []string{"a", "b"})
+	assert.Nil(t, err)
+
+	notBefore := time.Now().Truncate(time.Second)
+	notAfter := notBefore.Add(30 * time.Minute)
+	tbs := Renew(c, notBefore, notAfter)
+	rc, err := tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.Nil(t, err)
+
+	assert.Equal(t, c.Name(), rc.Name())
+	assert.Equal(t, c.Groups(), rc.Groups())
+	assert.Equal(t, c.Networks(), rc.Networks())
+	assert.Equal(t, c.PublicKey(), rc.PublicKey())
+	assert.Equal(t, c.SerialNumber(), rc.SerialNumber())
+	assert.Equal(t, notBefore, rc.NotBefore())
+	assert.Equal(t, notAfter, rc.NotAfter())
+	assert.True(t, rc.NotAfter().After(c.NotAfter()))
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+	_, err = caPool.VerifyCertificate(time.Now(), rc)
+	assert.Nil(t, err)
+
+	// The renewed details do not alias the original certificate
+	tbs.Groups[0] = "changed"
+	assert.Equal(t, "a", c.Groups()[0])
+}
+
+func TestTBSCertificate_EstimatedMarshaledSize(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	pub, _ := x25519Keypair()
+	tbs := &TBSCertificate{
+		Version:   Version1,
+		Name:      "test host",
+		Networks:  []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")},
+		Groups:    []string{"a", "b"},
+		NotBefore: time.Now().Add(-time.Minute).Round(time.Second),
+		NotAfter:  time.Now().Add(time.Minute).Round(time.Second),
+		PublicKey: pub,
+		Curve:     Curve_CURVE25519,
+	}
+	estimate := tbs.EstimatedMarshaledSize()
+
+	// An ed25519 signature has a fixed size so the estimate is exact
+	c, err := tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.Nil(t, err)
+	b, err := c.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, len(b), estimate)
+	assert.Less(t, estimate, MaxSafeCertificateSize)
+
+	// Many groups push the certificate past the safe size
+	for i := 0; i < 50; i++ {
+		tbs.Groups = append(tbs.Groups, fmt.Sprintf("a-rather-long-group-name-%d", i))
+	}
+	assert.Greater(t, tbs.EstimatedMarshaledSize(), estimate)
+	assert.Greater(t, tbs.EstimatedMarshaledSize(), MaxSafeCertificateSize)
+}
+
+func TestOnSign(t *testing.T) {
+	var signed []Certificate
+	OnSign = func(c Certificate) {
+		signed = append(signed, c)
+	}
+	defer func() { OnSign = nil }()
+
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(t, err)
+
+	assert.Len(t, signed, 2)
+	assert.Same(t, ca, signed[0])
+	assert.Same(t, c, signed[1])
+
+	// A failed signing does not call the hook
+	tbs := &TBSCertificate{Version: Version1, Name: "bad", IsCA: false, Curve: Curve_CURVE25519}
+	_, err = tbs.Sign(nil, Curve_CURVE25519, caKey)
+	assert.NotNil(t, err)
+	assert.Len(t, signed, 2)
+}
+
+func TestNebulaCertificate_Verify_AllowExtraGroups(t *testing.T) {
+	newCA := func(allowExtraGroups bool) (Certificate, []byte) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		tbs := &TBSCertificate{
+			Version:          Version1,
+			Name:             "test ca",
+			Groups:           []string{"test-group1"},
+			IsCA:             true,
+			NotBefore:        time.Unix(time.Now().Add(-2*time.Minute).Unix(), 0),
+			NotAfter:         time.Unix(time.Now().Add(2*time.Minute).Unix(), 0),
+			PublicKey:        pub,
+			AllowExtraGroups: allowExtraGroups,
+		}
+		ca, err := tbs.Sign(nil, Curve_CURVE25519, priv)
+		assert.Nil(t, err)
+		return ca, priv
+	}
+
+	// A normal CA refuses to sign a cert with a group it does not list
+	ca, caKey := newCA(false)
+	assert.False(t, ca.AllowExtraGroups())
+	_, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"test-group1", "extra"})
+	assert.EqualError(t, err, "certificate contained a group not present on the signing ca: extra")
+
+	// A CA with AllowExtraGroups can sign it and the result verifies
+	ca, caKey = newCA(true)
+	assert.True(t, ca.AllowExtraGroups())
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, []string{"test-group1", "extra"})
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	assert.NoError(t, caPool.AddCA(ca))
+	_, err = caPool.VerifyCertificate(time.Now(), c)
+	assert.Nil(t, err)
+
+	// The flag survives a round trip and is covered by the signature
+	b, err := ca.Marshal()
+	assert.Nil(t, err)
+	ca2, err := UnmarshalCertificate(b)
+	assert.Nil(t, err)
+	assert.True(t, ca2.AllowExtraGroups())
+	assert.True(t, ca2.CheckSignature(ca2.PublicKey()))
+
+	ca2.(*certificateV1).details.AllowExtraGroups = false
+	assert.False(t, ca2.CheckSignature(ca2.PublicKey()))
+
+	// Only a CA can carry the flag
+	_, caKey = newCA(false)
+	tbs := &TBSCertificate{Version: Version1, Name: "leaf", PublicKey: make([]byte, 32), AllowExtraGroups: true}
+	_, err = tbs.Sign(ca, Curve_CURVE25519, caKey)
+	assert.EqualError(t, err, "only a CA certificate can allow extra groups")
+}
+
 func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	caIp1 := mustParsePrefixUnmapped("10.0.0.0/16")
 	caIp2 := mustParsePrefixUnmapped("192.168.0.0/24")
@@ -528,6 +1134,62 @@ func TestUnmarshalNebulaCertificate(t *testing.T) {
 	data := []byte("\x98\x00\x00")
 	_, err := unmarshalCertificateV1(data, true)
 	assert.EqualError(t, err, "encoded Details was nil")
+
+	// Masks must be a prefix
+	raw := &RawNebulaCertificate{Details: &RawNebulaCertificateDetails{
+		Name:      "testing",
+		Ips:       []uint32{0x0a010101, 0xffffff00},
+		PublicKey: make([]byte, publicKeyLen),
+	}}
+	data, err = proto.Marshal(raw)
+	assert.Nil(t, err)
+	c, err := unmarshalCertificateV1(data, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Prefix{mustParsePrefixUnmapped("10.1.1.1/24")}, c.Networks())
+
+	raw.Details.Ips[1] = 0xff00ff00
+	data, err = proto.Marshal(raw)
+	assert.Nil(t, err)
+	_, err = unmarshalCertificateV1(data, true)
+	assert.EqualError(t, err, "encoded IPs: mask 255.0.255.0 is not a valid prefix")
+
+	raw.Details.Ips[1] = 0xffffff00
+	raw.Details.Subnets = []uint32{0x09010101, 0x00ffffff}
+	data, err = proto.Marshal(raw)
+	assert.Nil(t, err)
+	_, err = unmarshalCertificateV1(data, true)
+	assert.EqualError(t, err, "encoded Subnets: mask 0.255.255.255 is not a valid prefix")
+}
+
+func FuzzUnmarshalCertificate(f *testing.F) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(f, err)
+	c, pub, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.Nil(f, err)
+	for _, s := range []Certificate{ca, c} {
+		b, err := s.Marshal()
+		assert.Nil(f, err)
+		f.Add(b)
+	}
+	f.Add([]byte("\x98\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Handshakes carry the certificate without its public key
+		_, _ = UnmarshalCertificateFromHandshake(b, pub)
+
+		c, err := UnmarshalCertificate(b)
+		if err != nil {
+			return
+		}
+
+		// Anything that parses must be safe to use
+		_ = c.String()
+		_, _ = c.MarshalJSON()
+		_, _ = c.MarshalPEM()
+		_, _ = c.Fingerprint()
+		_ = c.CheckSignature(c.PublicKey())
+		_ = c.Copy()
+	})
 }
 
 func newTestCaCert(before, after time.Time, ips, subnets []netip.Prefix, groups []string) (Certificate, []byte, []byte, error) {
@@ -1,33 +1,29 @@
 package cert
 
 import (
-	"bytes"
-	"crypto/ecdh"
-	"crypto/ecdsa"
-	"crypto/ed25519"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"math/big"
 	"net"
 	"net/netip"
 	"time"
 
-	"github.com/slackhq/nebula/pkclient"
-	"golang.org/x/crypto/curve25519"
 	"google.golang.org/protobuf/proto"
 )
 
 const publicKeyLen = 32
 
 type certificateV1 struct {
-	details   detailsV1
-	signature []byte
+	details         detailsV1
+	signature       []byte
+	crossSignatures [][]byte
+
+	// comment is carried in the PEM headers only, it is not signed and not part of the wire format
+	comment string
 }
 
 type detailsV1 struct {
@@ -41,6 +37,10 @@ type detailsV1 struct {
 	IsCA      bool
 	Issuer    string
 
+	AllowExtraGroups bool
+	SerialNumber     []byte
+	NameConstraints  []string
+
 	Curve Curve
 }
 
@@ -62,6 +62,18 @@ func (nc *certificateV1) IsCA() bool {
 	return nc.details.IsCA
 }
 
+func (nc *certificateV1) AllowExtraGroups() bool {
+	return nc.details.AllowExtraGroups
+}
+
+func (nc *certificateV1) NameConstraints() []string {
+	return nc.details.NameConstraints
+}
+
+func (nc *certificateV1) SerialNumber() []byte {
+	return nc.details.SerialNumber
+}
+
 func (nc *certificateV1) Issuer() string {
 	return nc.details.Issuer
 }
@@ -95,31 +107,61 @@ func (nc *certificateV1) UnsafeNetworks() []netip.Prefix {
 }
 
 func (nc *certificateV1) Fingerprint() (string, error) {
-	b, err := nc.Marshal()
-	if err != nil {
-		return "", err
-	}
+	return FingerprintWithHash(nc, crypto.SHA256)
+}
+
+func (nc *certificateV1) CrossSignatures() [][]byte {
+	return nc.crossSignatures
+}
+
+func (nc *certificateV1) Comment() string {
+	return nc.comment
+}
+
+func (nc *certificateV1) TBSBytes() ([]byte, error) {
+	return nc.tbsBytesInto(nil)
+}
 
-	sum := sha256.Sum256(b)
-	return hex.EncodeToString(sum[:]), nil
+// tbsBytesInto appends the bytes returned by TBSBytes to buf
+func (nc *certificateV1) tbsBytesInto(buf []byte) ([]byte, error) {
+	return proto.MarshalOptions{}.MarshalAppend(buf, nc.getRawDetails())
 }
 
 func (nc *certificateV1) CheckSignature(key []byte) bool {
-	b, err := proto.Marshal(nc.getRawDetails())
+	buf := getMarshalBuffer()
+	defer putMarshalBuffer(buf)
+
+	b, err := nc.tbsBytesInto((*buf)[:0])
 	if err != nil {
 		return false
 	}
-	switch nc.details.Curve {
-	case Curve_CURVE25519:
-		return ed25519.Verify(key, b, nc.signature)
-	case Curve_P256:
-		x, y := elliptic.Unmarshal(elliptic.P256(), key)
-		pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
-		hashed := sha256.Sum256(b)
-		return ecdsa.VerifyASN1(pubKey, hashed[:], nc.signature)
-	default:
+	*buf = b
+	return VerifySignature(nc.details.Curve, key, b, nc.signature)
+}
+
+func (nc *certificateV1) CheckAnySignature(keys [][]byte) bool {
+	buf := getMarshalBuffer()
+	defer putMarshalBuffer(buf)
+
+	b, err := nc.tbsBytesInto((*buf)[:0])
+	if err != nil {
 		return false
 	}
+	*buf = b
+
+	for _, key := range keys {
+		if VerifySignature(nc.details.Curve, key, b, nc.signature) {
+			return true
+		}
+
+		for _, sig := range nc.crossSignatures {
+			if VerifySignature(nc.details.Curve, key, b, sig) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func (nc *certificateV1) Expired(t time.Time) bool {
@@ -130,50 +172,13 @@ func (nc *certificateV1) VerifyPrivateKey(curve Curve, key []byte) error {
 	if curve != nc.details.Curve {
 		return fmt.Errorf("curve in cert and private key supplied don't match")
 	}
-	if nc.details.IsCA {
-		switch curve {
-		case Curve_CURVE25519:
-			// the call to PublicKey below will panic slice bounds out of range otherwise
-			if len(key) != ed25519.PrivateKeySize {
-				return fmt.Errorf("key was not 64 bytes, is invalid ed25519 private key")
-			}
-
-			if !ed25519.PublicKey(nc.details.PublicKey).Equal(ed25519.PrivateKey(key).Public()) {
-				return fmt.Errorf("public key in cert and private key supplied don't match")
-			}
-		case Curve_P256:
-			privkey, err := ecdh.P256().NewPrivateKey(key)
-			if err != nil {
-				return fmt.Errorf("cannot parse private key as P256: %w", err)
-			}
-			pub := privkey.PublicKey().Bytes()
-			if !bytes.Equal(pub, nc.details.PublicKey) {
-				return fmt.Errorf("public key in cert and private key supplied don't match")
-			}
-		default:
-			return fmt.Errorf("invalid curve: %s", curve)
-		}
-		return nil
-	}
-
-	var pub []byte
-	switch curve {
-	case Curve_CURVE25519:
-		var err error
-		pub, err = curve25519.X25519(key, curve25519.Basepoint)
-		if err != nil {
-			return err
-		}
-	case Curve_P256:
-		privkey, err := ecdh.P256().NewPrivateKey(key)
-		if err != nil {
-			return err
-		}
-		pub = privkey.PublicKey().Bytes()
-	default:
-		return fmt.Errorf("invalid curve: %s", curve)
+	// CA certificates hold an ed25519 signing key while host certificates hold an X25519 key for curve25519,
+	// PublicKeyForRole derives the right one for the role of this certificate.
+	pub, err := PublicKeyForRole(curve, key, nc.details.IsCA)
+	if err != nil {
+		return err
 	}
-	if !bytes.Equal(pub, nc.details.PublicKey) {
+	if !ConstantTimeEqual(pub, nc.details.PublicKey) {
 		return fmt.Errorf("public key in cert and private key supplied don't match")
 	}
 
@@ -187,9 +192,22 @@ func (nc *certificateV1) getRawDetails() *RawNebulaCertificateDetails {
 		Groups:    nc.details.Groups,
 		NotBefore: nc.details.NotBefore.Unix(),
 		NotAfter:  nc.details.NotAfter.Unix(),
-		PublicKey: make([]byte, len(nc.details.PublicKey)),
+		PublicKey: nc.details.PublicKey,
 		IsCA:      nc.details.IsCA,
 		Curve:     nc.details.Curve,
+
+		AllowExtraGroups: nc.details.AllowExtraGroups,
+		SerialNumber:     nc.details.SerialNumber,
+		NameConstraints:  nc.details.NameConstraints,
+	}
+
+	// The raw details are only ever marshaled, so the public key is shared rather than copied and the network lists are
+	// sized up front. This is on the verify path.
+	if len(nc.details.Ips) > 0 {
+		rd.Ips = make([]uint32, 0, 2*len(nc.details.Ips))
+	}
+	if len(nc.details.Subnets) > 0 {
+		rd.Subnets = make([]uint32, 0, 2*len(nc.details.Subnets))
 	}
 
 	for _, ipNet := range nc.details.Ips {
@@ -202,8 +220,6 @@ func (nc *certificateV1) getRawDetails() *RawNebulaCertificateDetails {
 		rd.Subnets = append(rd.Subnets, addr2int(ipNet.Addr()), ip2int(mask))
 	}
 
-	copy(rd.PublicKey, nc.details.PublicKey[:])
-
 	// I know, this is terrible
 	rd.Issuer, _ = hex.DecodeString(nc.details.Issuer)
 
@@ -252,6 +268,15 @@ func (nc *certificateV1) String() string {
 	s += fmt.Sprintf("\t\tNot before: %v\n", nc.details.NotBefore)
 	s += fmt.Sprintf("\t\tNot After: %v\n", nc.details.NotAfter)
 	s += fmt.Sprintf("\t\tIs CA: %v\n", nc.details.IsCA)
+	if nc.details.AllowExtraGroups {
+		s += fmt.Sprintf("\t\tAllow extra groups: %v\n", nc.details.AllowExtraGroups)
+	}
+	if len(nc.details.SerialNumber) > 0 {
+		s += fmt.Sprintf("\t\tSerial number: %x\n", nc.details.SerialNumber)
+	}
+	if len(nc.details.NameConstraints) > 0 {
+		s += fmt.Sprintf("\t\tName constraints: %v\n", nc.details.NameConstraints)
+	}
 	s += fmt.Sprintf("\t\tIssuer: %s\n", nc.details.Issuer)
 	s += fmt.Sprintf("\t\tPublic key: %x\n", nc.details.PublicKey)
 	s += fmt.Sprintf("\t\tCurve: %s\n", nc.details.Curve)
@@ -261,6 +286,16 @@ func (nc *certificateV1) String() string {
 		s += fmt.Sprintf("\tFingerprint: %s\n", fp)
 	}
 	s += fmt.Sprintf("\tSignature: %x\n", nc.Signature())
+	if len(nc.crossSignatures) > 0 {
+		s += "\tCross signatures: [\n"
+		for _, sig := range nc.crossSignatures {
+			s += fmt.Sprintf("\t\t%x\n", sig)
+		}
+		s += "\t]\n"
+	}
+	if nc.comment != "" {
+		s += fmt.Sprintf("\tComment: %s\n", nc.comment)
+	}
 	s += "}"
 
 	return s
@@ -278,12 +313,27 @@ func (nc *certificateV1) MarshalForHandshakes() ([]byte, error) {
 }
 
 func (nc *certificateV1) Marshal() ([]byte, error) {
+	return nc.MarshalInto(nil)
+}
+
+func (nc *certificateV1) MarshalInto(buf []byte) ([]byte, error) {
+	rc := RawNebulaCertificate{
+		Details:    nc.getRawDetails(),
+		Signature:  nc.signature,
+		Signatures: nc.crossSignatures,
+	}
+
+	return proto.MarshalOptions{}.MarshalAppend(buf, &rc)
+}
+
+// marshalSignedInto is the same as MarshalInto without the cross signatures, leaving only what the issuer signed
+func (nc *certificateV1) marshalSignedInto(buf []byte) ([]byte, error) {
 	rc := RawNebulaCertificate{
 		Details:   nc.getRawDetails(),
 		Signature: nc.signature,
 	}
 
-	return proto.Marshal(&rc)
+	return proto.MarshalOptions{}.MarshalAppend(buf, &rc)
 }
 
 func (nc *certificateV1) MarshalPEM() ([]byte, error) {
@@ -291,27 +341,60 @@ func (nc *certificateV1) MarshalPEM() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return pem.EncodeToMemory(&pem.Block{Type: CertificateBanner, Bytes: b}), nil
+	p := &pem.Block{Type: CertificateBanner, Bytes: b}
+	if nc.comment != "" {
+		p.Headers = map[string]string{commentPEMHeader: nc.comment}
+	}
+	return pem.EncodeToMemory(p), nil
+}
+
+func (nc *certificateV1) MarshalPublicKeyToPEM() []byte {
+	if nc.details.IsCA && nc.details.Curve == Curve_CURVE25519 {
+		// A curve25519 CA holds an ed25519 signing key rather than an X25519 key, see PublicKeyForRole
+		return pem.EncodeToMemory(&pem.Block{Type: Ed25519PublicKeyBanner, Bytes: nc.details.PublicKey})
+	}
+	return MarshalPublicKeyToPEM(nc.details.Curve, nc.details.PublicKey)
 }
 
 func (nc *certificateV1) MarshalJSON() ([]byte, error) {
 	fp, _ := nc.Fingerprint()
+	details := m{
+		"name":      nc.details.Name,
+		"ips":       nc.details.Ips,
+		"subnets":   nc.details.Subnets,
+		"groups":    nc.details.Groups,
+		"notBefore": nc.details.NotBefore,
+		"notAfter":  nc.details.NotAfter,
+		"publicKey": fmt.Sprintf("%x", nc.details.PublicKey),
+		"isCa":      nc.details.IsCA,
+		"issuer":    nc.details.Issuer,
+		"curve":     nc.details.Curve.String(),
+	}
+	if nc.details.AllowExtraGroups {
+		details["allowExtraGroups"] = true
+	}
+	if len(nc.details.SerialNumber) > 0 {
+		details["serialNumber"] = fmt.Sprintf("%x", nc.details.SerialNumber)
+	}
+	if len(nc.details.NameConstraints) > 0 {
+		details["nameConstraints"] = nc.details.NameConstraints
+	}
+
 	jc := m{
-		"details": m{
-			"name":      nc.details.Name,
-			"ips":       nc.details.Ips,
-			"subnets":   nc.details.Subnets,
-			"groups":    nc.details.Groups,
-			"notBefore": nc.details.NotBefore,
-			"notAfter":  nc.details.NotAfter,
-			"publicKey": fmt.Sprintf("%x", nc.details.PublicKey),
-			"isCa":      nc.details.IsCA,
-			"issuer":    nc.details.Issuer,
-			"curve":     nc.details.Curve.String(),
-		},
+		"details":     details,
 		"fingerprint": fp,
 		"signature":   fmt.Sprintf("%x", nc.Signature()),
 	}
+	if len(nc.crossSignatures) > 0 {
+		crossSignatures := make([]string, len(nc.crossSignatures))
+		for i, sig := range nc.crossSignatures {
+			crossSignatures[i] = fmt.Sprintf("%x", sig)
+		}
+		jc["crossSignatures"] = crossSignatures
+	}
+	if nc.comment != "" {
+		jc["comment"] = nc.comment
+	}
 	return json.Marshal(jc)
 }
 
@@ -327,12 +410,18 @@ func (nc *certificateV1) Copy() Certificate {
 			PublicKey: make([]byte, len(nc.details.PublicKey)),
 			IsCA:      nc.details.IsCA,
 			Issuer:    nc.details.Issuer,
+
+			AllowExtraGroups: nc.details.AllowExtraGroups,
+			SerialNumber:     copyBytes(nc.details.SerialNumber),
+			NameConstraints:  copyStrings(nc.details.NameConstraints),
 		},
 		signature: make([]byte, len(nc.signature)),
 	}
 
 	copy(c.signature, nc.signature)
 	copy(c.details.Groups, nc.details.Groups)
+	c.crossSignatures = copySignatures(nc.crossSignatures)
+	c.comment = nc.comment
 	copy(c.details.PublicKey, nc.details.PublicKey)
 
 	for i, p := range nc.details.Ips {
@@ -380,12 +469,17 @@ func unmarshalCertificateV1(b []byte, assertPublicKey bool) (*certificateV1, err
 			PublicKey: make([]byte, len(rc.Details.PublicKey)),
 			IsCA:      rc.Details.IsCA,
 			Curve:     rc.Details.Curve,
+
+			AllowExtraGroups: rc.Details.AllowExtraGroups,
+			SerialNumber:     copyBytes(rc.Details.SerialNumber),
+			NameConstraints:  copyStrings(rc.Details.NameConstraints),
 		},
 		signature: make([]byte, len(rc.Signature)),
 	}
 
 	copy(nc.signature, rc.Signature)
 	copy(nc.details.Groups, rc.Details.Groups)
+	nc.crossSignatures = copySignatures(rc.Signatures)
 	nc.details.Issuer = hex.EncodeToString(rc.Details.Issuer)
 
 	if len(rc.Details.PublicKey) < publicKeyLen && assertPublicKey {
@@ -398,7 +492,10 @@ func unmarshalCertificateV1(b []byte, assertPublicKey bool) (*certificateV1, err
 		if i%2 == 0 {
 			ip = int2addr(rawIp)
 		} else {
-			ones, _ := net.IPMask(int2ip(rawIp)).Size()
+			ones, err := maskSize(rawIp)
+			if err != nil {
+				return nil, fmt.Errorf("encoded IPs: %w", err)
+			}
 			nc.details.Ips[i/2] = netip.PrefixFrom(ip, ones)
 		}
 	}
@@ -407,7 +504,10 @@ func unmarshalCertificateV1(b []byte, assertPublicKey bool) (*certificateV1, err
 		if i%2 == 0 {
 			ip = int2addr(rawIp)
 		} else {
-			ones, _ := net.IPMask(int2ip(rawIp)).Size()
+			ones, err := maskSize(rawIp)
+			if err != nil {
+				return nil, fmt.Errorf("encoded Subnets: %w", err)
+			}
 			nc.details.Subnets[i/2] = netip.PrefixFrom(ip, ones)
 		}
 	}
@@ -415,8 +515,19 @@ func unmarshalCertificateV1(b []byte, assertPublicKey bool) (*certificateV1, err
 	return &nc, nil
 }
 
-func signV1(t *TBSCertificate, curve Curve, key []byte, client *pkclient.PKClient) (*certificateV1, error) {
-	c := &certificateV1{
+// maskSize returns the prefix length of an encoded IPv4 mask. Masks with gaps, such as 255.0.255.0, have no prefix
+// length and would otherwise silently become a /0.
+func maskSize(rawMask uint32) (int, error) {
+	ones, bits := net.IPMask(int2ip(rawMask)).Size()
+	if bits == 0 {
+		return 0, fmt.Errorf("mask %s is not a valid prefix", int2addr(rawMask))
+	}
+	return ones, nil
+}
+
+// newCertificateV1 returns an unsigned certificate with the details from t
+func newCertificateV1(t *TBSCertificate) *certificateV1 {
+	return &certificateV1{
 		details: detailsV1{
 			Name:      t.Name,
 			Ips:       t.Networks,
@@ -428,47 +539,93 @@ func signV1(t *TBSCertificate, curve Curve, key []byte, client *pkclient.PKClien
 			IsCA:      t.IsCA,
 			Curve:     t.Curve,
 			Issuer:    t.issuer,
+
+			AllowExtraGroups: t.AllowExtraGroups,
+			SerialNumber:     copyBytes(t.SerialNumber),
+			NameConstraints:  copyStrings(t.NameConstraints),
 		},
 	}
-	b, err := proto.Marshal(c.getRawDetails())
+}
+
+func signV1(t *TBSCertificate, s Signer) (*certificateV1, error) {
+	c := newCertificateV1(t)
+	b, err := c.TBSBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signDetailsV1(b, s)
+	if err != nil {
+		return nil, err
+	}
+
+	c.signature = sig
+	return c, nil
+}
+
+// crossSignV1 returns a copy of c with an additional signature over its details
+func crossSignV1(c *certificateV1, s Signer) (*certificateV1, error) {
+	b, err := c.TBSBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signDetailsV1(b, s)
 	if err != nil {
 		return nil, err
 	}
 
-	var sig []byte
+	nc := c.Copy().(*certificateV1)
+	nc.crossSignatures = append(nc.crossSignatures, sig)
+	return nc, nil
+}
 
-	switch curve {
+// signDetailsV1 produces a signature over the marshaled details b
+func signDetailsV1(b []byte, s Signer) ([]byte, error) {
+	switch s.Curve() {
 	case Curve_CURVE25519:
-		signer := ed25519.PrivateKey(key)
-		sig = ed25519.Sign(signer, b)
+		return s.SignRaw(b)
 	case Curve_P256:
-		if client != nil {
-			sig, err = client.SignASN1(b)
-		} else {
-			signer := &ecdsa.PrivateKey{
-				PublicKey: ecdsa.PublicKey{
-					Curve: elliptic.P256(),
-				},
-				// ref: https://github.com/golang/go/blob/go1.19/src/crypto/x509/sec1.go#L95
-				D: new(big.Int).SetBytes(key),
-			}
-			// ref: https://github.com/golang/go/blob/go1.19/src/crypto/x509/sec1.go#L119
-			signer.X, signer.Y = signer.Curve.ScalarBaseMult(key)
-
-			// We need to hash first for ECDSA
-			// - https://pkg.go.dev/crypto/ecdsa#SignASN1
-			hashed := sha256.Sum256(b)
-			sig, err = ecdsa.SignASN1(rand.Reader, signer, hashed[:])
-			if err != nil {
-				return nil, err
-			}
-		}
+		// We need to hash first for ECDSA
+		// - https://pkg.go.dev/crypto/ecdsa#SignASN1
+		hashed := sha256.Sum256(b)
+		return s.SignRaw(hashed[:])
 	default:
-		return nil, fmt.Errorf("invalid curve: %s", c.details.Curve)
+		return nil, fmt.Errorf("invalid curve: %s", s.Curve())
 	}
+}
 
-	c.signature = sig
-	return c, nil
+// copySignatures returns a deep copy of sigs, or nil if there are none
+func copySignatures(sigs [][]byte) [][]byte {
+	if len(sigs) == 0 {
+		return nil
+	}
+
+	c := make([][]byte, len(sigs))
+	for i, sig := range sigs {
+		c[i] = copyBytes(sig)
+	}
+	return c
+}
+
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+
+	c := make([]string, len(s))
+	copy(c, s)
+	return c
 }
 
 func ip2int(ip []byte) uint32 {
@@ -3,14 +3,20 @@ package cert
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"math"
 
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -33,6 +39,103 @@ type Argon2Parameters struct {
 	salt        []byte
 }
 
+// PublicKeyForRole returns the public key bytes a certificate would carry for the private key, which depends on the
+// role of the certificate.
+//
+// A CA certificate carries a signing key. For Curve_CURVE25519 that is an ed25519 key (64 byte private key) and the
+// public key is the Edwards point. A non-CA certificate carries a Diffie-Hellman key used in the handshake, for
+// Curve_CURVE25519 that is an X25519 key (32 byte private key) and the public key is the Montgomery point. The two are
+// not interchangeable, a key derived for one role will never match a certificate of the other role.
+//
+// For Curve_P256 both roles use the same uncompressed point encoding.
+func PublicKeyForRole(curve Curve, key []byte, isCA bool) ([]byte, error) {
+	switch curve {
+	case Curve_CURVE25519:
+		if isCA {
+			// ed25519.PrivateKey.Public will panic slice bounds out of range otherwise
+			if len(key) != ed25519.PrivateKeySize {
+				return nil, fmt.Errorf("key was not 64 bytes, is invalid ed25519 private key")
+			}
+			return ed25519.PrivateKey(key).Public().(ed25519.PublicKey), nil
+		}
+		return curve25519.X25519(key, curve25519.Basepoint)
+	case Curve_P256:
+		privkey, err := ecdh.P256().NewPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse private key as P256: %w", err)
+		}
+		return privkey.PublicKey().Bytes(), nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+// GenerateKeypair returns a new random key pair for curve, suitable for a certificate of the given role. See
+// PublicKeyForRole for how the roles differ. For Curve_P256 the public key is always the uncompressed point since that
+// is the only encoding certificates and handshakes accept, and the private key is the raw scalar for either role.
+func GenerateKeypair(curve Curve, isCA bool) (pub, priv []byte, err error) {
+	switch curve {
+	case Curve_CURVE25519:
+		if isCA {
+			pub, priv, err = ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error while generating ed25519 keys: %w", err)
+			}
+			return pub, priv, nil
+		}
+
+		priv = make([]byte, curve25519.ScalarSize)
+		if _, err = io.ReadFull(rand.Reader, priv); err != nil {
+			return nil, nil, fmt.Errorf("error while generating x25519 keys: %w", err)
+		}
+		pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while generating x25519 keys: %w", err)
+		}
+		return pub, priv, nil
+	case Curve_P256:
+		// ecdsa and ecdh keys on P256 share the same encoding, ecdh lets us get at the bytes directly
+		key, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while generating P256 keys: %w", err)
+		}
+		return key.PublicKey().Bytes(), key.Bytes(), nil
+	default:
+		return nil, nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+// VerifySignature returns true if sig is a valid signature over tbs by the CA public key pub, using the same rules as
+// Certificate.CheckSignature. For Curve_CURVE25519 sig is an ed25519 signature of tbs as is, for Curve_P256 it is an
+// ASN.1 encoded ecdsa signature of the sha256 digest of tbs.
+func VerifySignature(curve Curve, pub, tbs, sig []byte) bool {
+	switch curve {
+	case Curve_CURVE25519:
+		// ed25519.Verify will panic otherwise
+		if len(pub) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(pub, tbs, sig)
+	case Curve_P256:
+		x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+		if x == nil {
+			return false
+		}
+		pubKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		hashed := sha256.Sum256(tbs)
+		return ecdsa.VerifyASN1(pubKey, hashed[:], sig)
+	default:
+		return false
+	}
+}
+
+// ConstantTimeEqual returns true if a and b are equal, taking the same time regardless of where they differ. Use this
+// instead of bytes.Equal when either side is derived from a private key, a passphrase, or encrypted key material, so
+// the time taken does not reveal how much of a guess was correct. Only the lengths may be learned.
+func ConstantTimeEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
 // NewArgon2Parameters Returns a new Argon2Parameters object with current version set
 func NewArgon2Parameters(memory uint32, parallelism uint8, iterations uint32) *Argon2Parameters {
 	return &Argon2Parameters{
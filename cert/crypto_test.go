@@ -1,7 +1,11 @@
 package cert
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/argon2"
@@ -110,3 +114,132 @@ func TestEncryptAndMarshalSigningPrivateKey(t *testing.T) {
 
 	// EncryptAndMarshalEd25519PrivateKey does not create any errors itself
 }
+
+func TestPublicKeyForRole(t *testing.T) {
+	// CA curve25519 keys are ed25519 signing keys
+	caPub, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	pub, err := PublicKeyForRole(Curve_CURVE25519, caPriv, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(caPub), pub)
+
+	// An ed25519 key is not a valid X25519 key and will never derive the Edwards public key
+	_, err = PublicKeyForRole(Curve_CURVE25519, caPriv, false)
+	assert.Error(t, err)
+	pub, err = PublicKeyForRole(Curve_CURVE25519, caPriv.Seed(), false)
+	assert.NoError(t, err)
+	assert.NotEqual(t, []byte(caPub), pub)
+
+	// Host curve25519 keys are X25519 keys
+	hostPub, hostPriv := x25519Keypair()
+	pub, err = PublicKeyForRole(Curve_CURVE25519, hostPriv, false)
+	assert.NoError(t, err)
+	assert.Equal(t, hostPub, pub)
+
+	_, err = PublicKeyForRole(Curve_CURVE25519, hostPriv, true)
+	assert.EqualError(t, err, "key was not 64 bytes, is invalid ed25519 private key")
+
+	// P256 keys are the same for both roles
+	p256Pub, p256Priv := p256Keypair()
+	pub, err = PublicKeyForRole(Curve_P256, p256Priv, false)
+	assert.NoError(t, err)
+	assert.Equal(t, p256Pub, pub)
+	pub, err = PublicKeyForRole(Curve_P256, p256Priv, true)
+	assert.NoError(t, err)
+	assert.Equal(t, p256Pub, pub)
+
+	_, err = PublicKeyForRole(Curve_P256, []byte("nope"), true)
+	assert.ErrorContains(t, err, "cannot parse private key as P256")
+
+	_, err = PublicKeyForRole(Curve(99), hostPriv, false)
+	assert.EqualError(t, err, "invalid curve: 99")
+}
+
+func TestGenerateKeypair(t *testing.T) {
+	for _, curve := range []Curve{Curve_CURVE25519, Curve_P256} {
+		caPub, caKey, err := GenerateKeypair(curve, true)
+		assert.NoError(t, err)
+
+		ca, err := (&TBSCertificate{
+			Version:   Version1,
+			Name:      "test ca",
+			IsCA:      true,
+			NotBefore: time.Now().Add(-time.Minute).Truncate(time.Second),
+			NotAfter:  time.Now().Add(time.Minute).Truncate(time.Second),
+			PublicKey: caPub,
+			Curve:     curve,
+		}).Sign(nil, curve, caKey)
+		assert.NoError(t, err, curve)
+		assert.True(t, ca.CheckSignature(caPub), curve)
+		assert.NoError(t, ca.VerifyPrivateKey(curve, caKey), curve)
+
+		pub, key, err := GenerateKeypair(curve, false)
+		assert.NoError(t, err)
+
+		c, err := (&TBSCertificate{
+			Version:   Version1,
+			Name:      "test",
+			Networks:  []netip.Prefix{netip.MustParsePrefix("10.1.1.1/24")},
+			NotBefore: ca.NotBefore(),
+			NotAfter:  ca.NotAfter(),
+			PublicKey: pub,
+			Curve:     curve,
+		}).Sign(ca, curve, caKey)
+		assert.NoError(t, err, curve)
+		assert.True(t, c.CheckSignature(caPub), curve)
+		assert.NoError(t, c.VerifyPrivateKey(curve, key), curve)
+
+		// A key generated for the other role does not pair with the certificate
+		_, otherKey, err := GenerateKeypair(curve, true)
+		assert.NoError(t, err)
+		assert.Error(t, c.VerifyPrivateKey(curve, otherKey), curve)
+	}
+
+	_, _, err := GenerateKeypair(Curve(99), false)
+	assert.EqualError(t, err, "invalid curve: 99")
+}
+
+func TestVerifySignature(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	c, _, _, err := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+
+	caP256, _, caKeyP256, err := newTestCaCertP256(time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+	cP256, _, _, err := newTestCert(caP256, caKeyP256, time.Time{}, time.Time{}, nil, nil, nil)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		ca Certificate
+		c  Certificate
+	}{{ca, c}, {caP256, cP256}} {
+		curve := tc.ca.Curve()
+		tbs, err := tc.c.TBSBytes()
+		assert.NoError(t, err)
+		assert.True(t, VerifySignature(curve, tc.ca.PublicKey(), tbs, tc.c.Signature()), curve)
+
+		// Tampered details
+		bad := append([]byte{}, tbs...)
+		bad[len(bad)-1] ^= 0xff
+		assert.False(t, VerifySignature(curve, tc.ca.PublicKey(), bad, tc.c.Signature()), curve)
+
+		// Tampered signature
+		sig := append([]byte{}, tc.c.Signature()...)
+		sig[len(sig)-1] ^= 0xff
+		assert.False(t, VerifySignature(curve, tc.ca.PublicKey(), tbs, sig), curve)
+
+		// Malformed key
+		assert.False(t, VerifySignature(curve, []byte{1, 2, 3}, tbs, tc.c.Signature()), curve)
+	}
+
+	assert.False(t, VerifySignature(Curve(99), ca.PublicKey(), []byte("tbs"), c.Signature()))
+}
+
+func TestConstantTimeEqual(t *testing.T) {
+	assert.True(t, ConstantTimeEqual([]byte{1, 2, 3}, []byte{1, 2, 3}))
+	assert.True(t, ConstantTimeEqual(nil, []byte{}))
+	assert.False(t, ConstantTimeEqual([]byte{1, 2, 3}, []byte{1, 2, 4}))
+	assert.False(t, ConstantTimeEqual([]byte{1, 2, 3}, []byte{1, 2}))
+	assert.False(t, ConstantTimeEqual([]byte{1}, nil))
+}
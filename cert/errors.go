@@ -10,12 +10,21 @@ var (
 	ErrExpired                 = errors.New("certificate is expired")
 	ErrNotCA                   = errors.New("certificate is not a CA")
 	ErrNotSelfSigned           = errors.New("certificate is not self-signed")
+	ErrSignerNotCA             = errors.New("signing certificate is not a CA")
+	ErrCASignedByCA            = errors.New("certificate is a CA signed by another CA")
+	ErrChainTooLong            = errors.New("certificate chain has too many intermediates")
+	ErrNoIssuer                = errors.New("no issuer in certificate")
+	ErrCANotFound              = errors.New("could not find ca for the certificate")
+	ErrConstraintViolation     = errors.New("certificate does not satisfy the constraints of the signing ca")
 	ErrBlockListed             = errors.New("certificate is in the block list")
 	ErrFingerprintMismatch     = errors.New("certificate fingerprint did not match")
 	ErrSignatureMismatch       = errors.New("certificate signature did not match")
 	ErrInvalidPublicKeyLength  = errors.New("invalid public key length")
 	ErrInvalidPrivateKeyLength = errors.New("invalid private key length")
 
+	ErrUnsupportedCertificateVersion = errors.New("certificate version is not supported")
+	ErrUnsupportedFingerprintHash    = errors.New("fingerprint hash is not supported")
+
 	ErrPrivateKeyEncrypted = errors.New("private key must be decrypted")
 
 	ErrInvalidPEMBlock                   = errors.New("input did not contain a valid PEM encoded block")
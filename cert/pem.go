@@ -1,8 +1,16 @@
 package cert
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 
 	"golang.org/x/crypto/ed25519"
 )
@@ -20,10 +28,32 @@ const (
 	P256PublicKeyBanner                = "NEBULA P256 PUBLIC KEY"
 	EncryptedECDSAP256PrivateKeyBanner = "NEBULA ECDSA P256 ENCRYPTED PRIVATE KEY"
 	ECDSAP256PrivateKeyBanner          = "NEBULA ECDSA P256 PRIVATE KEY"
+
+	PKCS8PrivateKeyBanner = "PRIVATE KEY"
+
+	// commentPEMHeader is the PEM header that holds Certificate.Comment
+	commentPEMHeader = "Comment"
 )
 
+// WithComment returns a copy of c with its comment replaced. The comment is stored in the PEM headers by MarshalPEM and
+// can be changed at any time since it is not signed. An empty comment removes it. Comments must be a single line.
+func WithComment(c Certificate, comment string) (Certificate, error) {
+	if strings.ContainsAny(comment, "\r\n") {
+		return nil, fmt.Errorf("comment must be a single line")
+	}
+
+	switch tc := c.Copy().(type) {
+	case *certificateV1:
+		tc.comment = comment
+		return tc, nil
+	default:
+		return nil, fmt.Errorf("unknown cert version %d", c.Version())
+	}
+}
+
 // UnmarshalCertificateFromPEM will try to unmarshal the first pem block in a byte array, returning any non consumed
-// data or an error on failure
+// data or an error on failure. The non consumed data is returned on error as well so a bundle can be iterated past a bad
+// entry.
 func UnmarshalCertificateFromPEM(b []byte) (Certificate, []byte, error) {
 	p, r := pem.Decode(b)
 	if p == nil {
@@ -34,17 +64,64 @@ func UnmarshalCertificateFromPEM(b []byte) (Certificate, []byte, error) {
 	case CertificateBanner:
 		c, err := unmarshalCertificateV1(p.Bytes, true)
 		if err != nil {
-			return nil, nil, err
+			return nil, r, err
 		}
+		c.comment = p.Headers[commentPEMHeader]
 		return c, r, nil
 	case CertificateV2Banner:
 		//TODO
-		panic("TODO")
+		return nil, r, ErrUnsupportedCertificateVersion
 	default:
 		return nil, r, ErrInvalidPEMCertificateBanner
 	}
 }
 
+// UnmarshalCertificatesFromReader unmarshals every pem encoded certificate in r. Only one pem block is held in memory at
+// a time, so large bundles do not need to be read in full first. Anything outside of a pem block is ignored.
+// On error the certificates unmarshaled so far are returned, a stream that ends inside a pem block returns
+// io.ErrUnexpectedEOF.
+func UnmarshalCertificatesFromReader(r io.Reader) ([]Certificate, error) {
+	var certs []Certificate
+	var block []byte
+	inBlock := false
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return certs, fmt.Errorf("error while reading certificate %d: %w", len(certs), err)
+		}
+
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("-----BEGIN ")) {
+			inBlock = true
+			block = block[:0]
+		}
+
+		if inBlock {
+			block = append(block, line...)
+			if bytes.HasPrefix(trimmed, []byte("-----END ")) {
+				inBlock = false
+				c, _, uErr := UnmarshalCertificateFromPEM(block)
+				if uErr != nil {
+					return certs, fmt.Errorf("error while unmarshaling certificate %d: %w", len(certs), uErr)
+				}
+				certs = append(certs, c)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if inBlock {
+		return certs, fmt.Errorf("error while reading certificate %d: %w", len(certs), io.ErrUnexpectedEOF)
+	}
+
+	return certs, nil
+}
+
 func MarshalPublicKeyToPEM(curve Curve, b []byte) []byte {
 	switch curve {
 	case Curve_CURVE25519:
@@ -153,3 +230,39 @@ func UnmarshalSigningPrivateKeyFromPEM(b []byte) ([]byte, []byte, Curve, error)
 	}
 	return k.Bytes, r, curve, nil
 }
+
+// UnmarshalPrivateKeyFromPKCS8 will try to unmarshal the first pem block in a byte array as a standard PKCS#8 private
+// key, such as those generated by openssl. Only Ed25519 and ECDSA P256 keys are supported and the returned key bytes
+// are in the same format as UnmarshalSigningPrivateKeyFromPEM
+func UnmarshalPrivateKeyFromPKCS8(b []byte) (Curve, []byte, error) {
+	k, _ := pem.Decode(b)
+	if k == nil {
+		return 0, nil, ErrInvalidPEMBlock
+	}
+
+	if k.Type != PKCS8PrivateKeyBanner {
+		return 0, nil, fmt.Errorf("bytes did not contain a proper PKCS#8 private key banner")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(k.Bytes)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse PKCS#8 private key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return Curve_CURVE25519, []byte(key), nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return 0, nil, fmt.Errorf("unsupported ECDSA curve: %s", key.Curve.Params().Name)
+		}
+
+		eKey, err := key.ECDH()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to convert ECDSA key: %w", err)
+		}
+		return Curve_P256, eKey.Bytes(), nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported PKCS#8 private key type: %T", key)
+	}
+}
@@ -1,13 +1,31 @@
 package cert
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
+	"math/big"
 	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/slackhq/nebula/pkclient"
 )
 
+// serialNumberLen is the size of a generated TBSCertificate.SerialNumber
+const serialNumberLen = 16
+
+// MaxSafeCertificateSize is the largest marshaled certificate that comfortably fits in a handshake packet sent over a
+// path with the 1280 byte minimum IPv6 MTU. Larger certificates may cause handshakes to be fragmented or dropped.
+const MaxSafeCertificateSize = 1000
+
+// OnSign, if set, is called with every certificate successfully produced by TBSCertificate.Sign or SignPkcs11.
+// It is intended for embedders that need an audit trail of issued certificates and can not affect the result.
+var OnSign func(c Certificate)
+
 // TBSCertificate represents a certificate intended to be signed.
 // It is invalid to use this structure as a Certificate.
 type TBSCertificate struct {
@@ -22,13 +40,145 @@ type TBSCertificate struct {
 	PublicKey      []byte
 	Curve          Curve
 	issuer         string
+
+	// AllowExtraGroups may only be set on a CA, see Certificate.AllowExtraGroups
+	AllowExtraGroups bool
+
+	// SerialNumber identifies the certificate independently of its fingerprint, reuse it when renewing to track the
+	// same logical certificate. A random serial is generated and stored here if it is empty when signing.
+	SerialNumber []byte
+
+	// NameConstraints may only be set on a CA, see Certificate.NameConstraints
+	NameConstraints []string
+}
+
+// Renew returns a TBSCertificate with the same identity as c, valid from notBefore until notAfter. The name,
+// networks, groups, public key, and serial number are copied so the renewed certificate can be signed without the
+// node needing a new keypair.
+func Renew(c Certificate, notBefore, notAfter time.Time) *TBSCertificate {
+	return &TBSCertificate{
+		Version:          c.Version(),
+		Name:             c.Name(),
+		Networks:         append([]netip.Prefix(nil), c.Networks()...),
+		UnsafeNetworks:   append([]netip.Prefix(nil), c.UnsafeNetworks()...),
+		Groups:           append([]string(nil), c.Groups()...),
+		IsCA:             c.IsCA(),
+		NotBefore:        notBefore,
+		NotAfter:         notAfter,
+		PublicKey:        copyBytes(c.PublicKey()),
+		Curve:            c.Curve(),
+		AllowExtraGroups: c.AllowExtraGroups(),
+		SerialNumber:     copyBytes(c.SerialNumber()),
+		NameConstraints:  copyStrings(c.NameConstraints()),
+	}
+}
+
+// EstimatedMarshaledSize returns the size in bytes the certificate is expected to marshal to once signed, assuming the
+// largest signature for the curve. This allows tooling to warn before issuing a certificate larger than
+// MaxSafeCertificateSize.
+func (t *TBSCertificate) EstimatedMarshaledSize() int {
+	e := *t
+	if len(e.SerialNumber) == 0 {
+		e.SerialNumber = make([]byte, serialNumberLen)
+	}
+	if !e.IsCA && e.issuer == "" {
+		// The issuer is the hex encoded sha256 fingerprint of the signer
+		e.issuer = strings.Repeat("0", sha256.Size*2)
+	}
+
+	c := newCertificateV1(&e)
+	switch e.Curve {
+	case Curve_P256:
+		// The largest ASN.1 encoded ecdsa P256 signature
+		c.signature = make([]byte, 72)
+	default:
+		c.signature = make([]byte, ed25519.SignatureSize)
+	}
+
+	b, err := c.Marshal()
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// Signer produces certificate signatures with a private key that may live outside of this process, such as in an HSM
+// or a cloud KMS.
+type Signer interface {
+	// Public returns the public key that pairs with the signing key, in the same form as Certificate.PublicKey
+	Public() []byte
+
+	// Curve returns the curve of the signing key
+	Curve() Curve
+
+	// SignRaw returns a signature over data. Curve_CURVE25519 signers must return an ed25519 signature of data as is.
+	// Curve_P256 signers are given a sha256 digest and must return an ASN.1 encoded ecdsa signature of it.
+	SignRaw(data []byte) ([]byte, error)
+}
+
+// keySigner is a Signer backed by an in memory private key
+type keySigner struct {
+	curve Curve
+	key   []byte
+}
+
+func (s *keySigner) Public() []byte {
+	pub, _ := PublicKeyForRole(s.curve, s.key, true)
+	return pub
+}
+
+func (s *keySigner) Curve() Curve {
+	return s.curve
+}
+
+func (s *keySigner) SignRaw(data []byte) ([]byte, error) {
+	switch s.curve {
+	case Curve_CURVE25519:
+		return ed25519.Sign(ed25519.PrivateKey(s.key), data), nil
+	case Curve_P256:
+		signer := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+			},
+			// ref: https://github.com/golang/go/blob/go1.19/src/crypto/x509/sec1.go#L95
+			D: new(big.Int).SetBytes(s.key),
+		}
+		// ref: https://github.com/golang/go/blob/go1.19/src/crypto/x509/sec1.go#L119
+		signer.X, signer.Y = signer.Curve.ScalarBaseMult(s.key)
+		return ecdsa.SignASN1(rand.Reader, signer, data)
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", s.curve)
+	}
+}
+
+// pkcs11Signer is a Signer backed by a PKCS#11 module, only P256 is supported
+type pkcs11Signer struct {
+	client *pkclient.PKClient
+}
+
+// NewPkcs11Signer returns a Signer for the P256 key held by client
+func NewPkcs11Signer(client *pkclient.PKClient) Signer {
+	return &pkcs11Signer{client: client}
+}
+
+func (s *pkcs11Signer) Public() []byte {
+	pub, _ := s.client.GetPubKey()
+	return pub
+}
+
+func (s *pkcs11Signer) Curve() Curve {
+	return Curve_P256
+}
+
+func (s *pkcs11Signer) SignRaw(data []byte) ([]byte, error) {
+	return s.client.SignDigestASN1(data)
 }
 
 // Sign will create a sealed certificate using details provided by the TBSCertificate as long as those
 // details do not violate constraints of the signing certificate.
 // If the TBSCertificate is a CA then signer must be nil.
 func (t *TBSCertificate) Sign(signer Certificate, curve Curve, key []byte) (Certificate, error) {
-	return t.sign(signer, curve, key, nil)
+	return t.SignWith(signer, &keySigner{curve: curve, key: key})
 }
 
 func (t *TBSCertificate) SignPkcs11(signer Certificate, curve Curve, client *pkclient.PKClient) (Certificate, error) {
@@ -36,41 +186,179 @@ func (t *TBSCertificate) SignPkcs11(signer Certificate, curve Curve, client *pkc
 		return nil, fmt.Errorf("only P256 is supported by PKCS#11")
 	}
 
-	return t.sign(signer, curve, nil, client)
+	return t.SignWith(signer, &pkcs11Signer{client: client})
 }
 
-func (t *TBSCertificate) sign(signer Certificate, curve Curve, key []byte, client *pkclient.PKClient) (Certificate, error) {
-	if curve != t.Curve {
+// SignWith is the same as Sign except the signature is produced by s, which allows the signing key to be held
+// elsewhere.
+func (t *TBSCertificate) SignWith(signer Certificate, s Signer) (Certificate, error) {
+	if s.Curve() != t.Curve {
 		return nil, fmt.Errorf("curve in cert and private key supplied don't match")
 	}
 
+	err := t.prepare(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Certificate
+	switch t.Version {
+	case Version1:
+		v1, err := signV1(t, s)
+		if err != nil {
+			return nil, err
+		}
+		c = v1
+	default:
+		return nil, fmt.Errorf("unknown cert version %d", t.Version)
+	}
+
+	if OnSign != nil {
+		OnSign(c)
+	}
+
+	return c, nil
+}
+
+// Unsigned checks the TBSCertificate the same way as Sign and returns a certificate without a signature. This is for
+// signing workflows where the key is not reachable at all, the TBSBytes of the returned certificate can be taken to
+// the key and the resulting signature added with AttachSignature.
+func (t *TBSCertificate) Unsigned(signer Certificate) (Certificate, error) {
+	err := t.prepare(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.Version {
+	case Version1:
+		return newCertificateV1(t), nil
+	default:
+		return nil, fmt.Errorf("unknown cert version %d", t.Version)
+	}
+}
+
+// AttachSignature returns a copy of c with its signature set to sig, see TBSCertificate.Unsigned.
+// The signature can not be checked here since the signing certificate is unknown, verify the result with a CAPool.
+func AttachSignature(c Certificate, sig []byte) (Certificate, error) {
+	if len(sig) == 0 {
+		return nil, fmt.Errorf("signature is empty")
+	}
+
+	var nc Certificate
+	switch tc := c.(type) {
+	case *certificateV1:
+		v1 := tc.Copy().(*certificateV1)
+		v1.signature = make([]byte, len(sig))
+		copy(v1.signature, sig)
+		nc = v1
+	default:
+		return nil, fmt.Errorf("unknown cert version %d", c.Version())
+	}
+
+	if OnSign != nil {
+		OnSign(nc)
+	}
+
+	return nc, nil
+}
+
+// prepare ensures the TBSCertificate can be signed by signer and records the issuer
+func (t *TBSCertificate) prepare(signer Certificate) error {
 	//TODO: make sure we have all minimum properties to sign, like a public key
 
-	if signer != nil {
-		if t.IsCA {
-			return nil, fmt.Errorf("can not sign a CA certificate with another")
+	if t.AllowExtraGroups && !t.IsCA {
+		return fmt.Errorf("only a CA certificate can allow extra groups")
+	}
+
+	if len(t.NameConstraints) > 0 {
+		if !t.IsCA {
+			return fmt.Errorf("only a CA certificate can have name constraints")
+		}
+
+		for _, p := range t.NameConstraints {
+			if err := checkNameConstraint(p); err != nil {
+				return err
+			}
 		}
+	}
 
-		err := checkCAConstraints(signer, t.NotBefore, t.NotAfter, t.Groups, t.Networks, t.UnsafeNetworks)
+	if len(t.SerialNumber) == 0 {
+		t.SerialNumber = make([]byte, serialNumberLen)
+		_, err := rand.Read(t.SerialNumber)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error generating serial number: %w", err)
+		}
+	}
+
+	if signer != nil {
+		err := checkCAConstraints(signer, t.IsCA, t.Name, t.NotBefore, t.NotAfter, t.Groups, t.Networks, t.UnsafeNetworks)
+		if err != nil {
+			return err
 		}
 
 		issuer, err := signer.Fingerprint()
 		if err != nil {
-			return nil, fmt.Errorf("error computing issuer: %v", err)
+			return fmt.Errorf("error computing issuer: %v", err)
 		}
 		t.issuer = issuer
 	} else {
 		if !t.IsCA {
-			return nil, fmt.Errorf("self signed certificates must have IsCA set to true")
+			return fmt.Errorf("self signed certificates must have IsCA set to true")
 		}
 	}
 
-	switch t.Version {
-	case Version1:
-		return signV1(t, curve, key, client)
+	return nil
+}
+
+// CrossSign returns a copy of c carrying an additional signature made by signer. The certificate remains trusted by
+// pools containing its original issuer and becomes trusted by pools containing signer, which allows migrating
+// between CAs without reissuing every certificate at the same moment. The constraints of signer must be satisfied.
+func CrossSign(c Certificate, signer Certificate, curve Curve, key []byte) (Certificate, error) {
+	return CrossSignWith(c, signer, &keySigner{curve: curve, key: key})
+}
+
+func CrossSignPkcs11(c Certificate, signer Certificate, curve Curve, client *pkclient.PKClient) (Certificate, error) {
+	if curve != Curve_P256 {
+		return nil, fmt.Errorf("only P256 is supported by PKCS#11")
+	}
+
+	return CrossSignWith(c, signer, &pkcs11Signer{client: client})
+}
+
+// CrossSignWith is the same as CrossSign except the signature is produced by s.
+func CrossSignWith(c Certificate, signer Certificate, s Signer) (Certificate, error) {
+	if s.Curve() != c.Curve() {
+		return nil, fmt.Errorf("curve in cert and private key supplied don't match")
+	}
+
+	if c.IsCA() {
+		return nil, fmt.Errorf("can not sign a CA certificate with another")
+	}
+
+	if !signer.IsCA() {
+		return nil, fmt.Errorf("signing certificate must be a CA")
+	}
+
+	err := CheckCAConstraints(signer, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var nc Certificate
+	switch tc := c.(type) {
+	case *certificateV1:
+		v1, err := crossSignV1(tc, s)
+		if err != nil {
+			return nil, err
+		}
+		nc = v1
 	default:
-		return nil, fmt.Errorf("unknown cert version %d", t.Version)
+		return nil, fmt.Errorf("unknown cert version %d", c.Version())
 	}
+
+	if OnSign != nil {
+		OnSign(nc)
+	}
+
+	return nc, nil
 }
@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"flag"
 	"fmt"
 	"io"
@@ -16,7 +13,6 @@ import (
 	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/pkclient"
-	"golang.org/x/crypto/ed25519"
 )
 
 type caFlags struct {
@@ -27,6 +23,8 @@ type caFlags struct {
 	outCertPath      *string
 	outQRPath        *string
 	groups           *string
+	allowExtraGroups *bool
+	nameConstraints  *string
 	ips              *string
 	subnets          *string
 	argonMemory      *uint
@@ -47,6 +45,8 @@ func newCaFlags() *caFlags {
 	cf.outCertPath = cf.set.String("out-crt", "ca.crt", "Optional: path to write the certificate to")
 	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
+	cf.allowExtraGroups = cf.set.Bool("allow-extra-groups", false, "Optional: allow subordinate certs to use groups that are not listed in -groups")
+	cf.nameConstraints = cf.set.String("name-constraints", "", "Optional: comma separated list of name patterns such as *.prod.example. This will limit which names subordinate certs can use")
 	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use for ip addresses")
 	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. This will limit which ipv4 addresses and networks subordinate certs can use in subnets")
 	cf.argonMemory = cf.set.Uint("argon-memory", 2*1024*1024, "Optional: Argon2 memory parameter (in KiB) used for encrypted private key passphrase")
@@ -113,6 +113,16 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		}
 	}
 
+	var nameConstraints []string
+	if *cf.nameConstraints != "" {
+		for _, rn := range strings.Split(*cf.nameConstraints, ",") {
+			n := strings.TrimSpace(rn)
+			if n != "" {
+				nameConstraints = append(nameConstraints, n)
+			}
+		}
+	}
+
 	var ips []netip.Prefix
 	if *cf.ips != "" {
 		for _, rs := range strings.Split(*cf.ips, ",") {
@@ -196,29 +206,16 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		switch *cf.curve {
 		case "25519", "X25519", "Curve25519", "CURVE25519":
 			curve = cert.Curve_CURVE25519
-			pub, rawPriv, err = ed25519.GenerateKey(rand.Reader)
-			if err != nil {
-				return fmt.Errorf("error while generating ed25519 keys: %s", err)
-			}
 		case "P256":
-			var key *ecdsa.PrivateKey
 			curve = cert.Curve_P256
-			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-			if err != nil {
-				return fmt.Errorf("error while generating ecdsa keys: %s", err)
-			}
-
-			// ecdh.PrivateKey lets us get at the encoded bytes, even though
-			// we aren't using ECDH here.
-			eKey, err := key.ECDH()
-			if err != nil {
-				return fmt.Errorf("error while converting ecdsa key: %s", err)
-			}
-			rawPriv = eKey.Bytes()
-			pub = eKey.PublicKey().Bytes()
 		default:
 			return fmt.Errorf("invalid curve: %s", *cf.curve)
 		}
+
+		pub, rawPriv, err = cert.GenerateKeypair(curve, true)
+		if err != nil {
+			return err
+		}
 	}
 
 	t := &cert.TBSCertificate{
@@ -232,6 +229,9 @@ func ca(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error
 		PublicKey:      pub,
 		IsCA:           true,
 		Curve:          curve,
+
+		AllowExtraGroups: *cf.allowExtraGroups,
+		NameConstraints:  nameConstraints,
 	}
 
 	if !isP11 {
@@ -59,14 +59,17 @@ func keygen(args []string, out io.Writer, errOut io.Writer) error {
 	} else {
 		switch *cf.curve {
 		case "25519", "X25519", "Curve25519", "CURVE25519":
-			pub, rawPriv = x25519Keypair()
 			curve = cert.Curve_CURVE25519
 		case "P256":
-			pub, rawPriv = p256Keypair()
 			curve = cert.Curve_P256
 		default:
 			return fmt.Errorf("invalid curve: %s", *cf.curve)
 		}
+
+		pub, rawPriv, err = cert.GenerateKeypair(curve, false)
+		if err != nil {
+			return err
+		}
 	}
 
 	if isP11 {
@@ -63,6 +63,9 @@ func printCert(args []string, out io.Writer, errOut io.Writer) error {
 		} else {
 			out.Write([]byte(c.String()))
 			out.Write([]byte("\n"))
+			if c.IsCA() {
+				out.Write([]byte("Constraints: " + cert.ConstraintSummary(c) + "\n"))
+			}
 		}
 
 		if *pf.outQRPath != "" {
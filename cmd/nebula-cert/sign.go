@@ -1,20 +1,22 @@
 package main
 
 import (
-	"crypto/ecdh"
-	"crypto/rand"
+	"bytes"
+	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/pkclient"
-	"golang.org/x/crypto/curve25519"
+	"gopkg.in/yaml.v2"
 )
 
 type signFlags struct {
@@ -30,6 +32,8 @@ type signFlags struct {
 	outQRPath   *string
 	groups      *string
 	subnets     *string
+	manifest    *string
+	outDir      *string
 	p11url      *string
 }
 
@@ -47,6 +51,8 @@ func newSignFlags() *signFlags {
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
 	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of ipv4 address and network in CIDR notation. Subnets this cert can serve for")
+	sf.manifest = sf.set.String("manifest", "", "Optional: path to a yaml or csv manifest of certificates to sign. Each entry has a name, ips, subnets, groups and duration. Replaces -name and -ip")
+	sf.outDir = sf.set.String("out-dir", ".", "Optional: directory to write the certificates and keys signed from -manifest to")
 	sf.p11url = p11Flag(sf.set)
 	return &sf
 }
@@ -68,11 +74,23 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	if err := mustFlagString("ca-crt", sf.caCertPath); err != nil {
 		return err
 	}
-	if err := mustFlagString("name", sf.name); err != nil {
-		return err
-	}
-	if err := mustFlagString("ip", sf.ip); err != nil {
-		return err
+	isManifest := len(*sf.manifest) > 0
+	if isManifest {
+		if isP11 {
+			return newHelpErrorf("cannot set both -manifest and -pkcs11")
+		}
+		for _, f := range []string{"name", "ip", "in-pub", "out-key", "out-crt", "out-qr"} {
+			if v := sf.set.Lookup(f).Value.String(); v != "" {
+				return newHelpErrorf("cannot set both -manifest and -%s", f)
+			}
+		}
+	} else {
+		if err := mustFlagString("name", sf.name); err != nil {
+			return err
+		}
+		if err := mustFlagString("ip", sf.ip); err != nil {
+			return err
+		}
 	}
 	if !isP11 && *sf.inPubPath != "" && *sf.outKeyPath != "" {
 		return newHelpErrorf("cannot set both -in-pub and -out-key")
@@ -135,50 +153,22 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		if err := caCert.VerifyPrivateKey(curve, caKey); err != nil {
 			return fmt.Errorf("refusing to sign, root certificate does not match private key")
 		}
+	} else if err := checkPkcs11CA(caCert); err != nil {
+		// Catch a mismatched ca before talking to the token
+		return err
 	}
 
 	if caCert.Expired(time.Now()) {
 		return fmt.Errorf("ca certificate is expired")
 	}
 
-	// if no duration is given, expire one second before the root expires
-	if *sf.duration <= 0 {
-		*sf.duration = time.Until(caCert.NotAfter()) - time.Second*1
+	if isManifest {
+		return signManifest(*sf.manifest, *sf.outDir, *sf.duration, caCert, curve, caKey)
 	}
 
-	network, err := netip.ParsePrefix(*sf.ip)
+	t, err := newSignTBS(caCert, *sf.name, []string{*sf.ip}, *sf.groups, *sf.subnets, *sf.duration)
 	if err != nil {
-		return newHelpErrorf("invalid ip definition: %s", *sf.ip)
-	}
-	if !network.Addr().Is4() {
-		return newHelpErrorf("invalid ip definition: can only be ipv4, have %s", *sf.ip)
-	}
-
-	var groups []string
-	if *sf.groups != "" {
-		for _, rg := range strings.Split(*sf.groups, ",") {
-			g := strings.TrimSpace(rg)
-			if g != "" {
-				groups = append(groups, g)
-			}
-		}
-	}
-
-	var subnets []netip.Prefix
-	if *sf.subnets != "" {
-		for _, rs := range strings.Split(*sf.subnets, ",") {
-			rs := strings.Trim(rs, " ")
-			if rs != "" {
-				s, err := netip.ParsePrefix(rs)
-				if err != nil {
-					return newHelpErrorf("invalid subnet definition: %s", rs)
-				}
-				if !s.Addr().Is4() {
-					return newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
-				}
-				subnets = append(subnets, s)
-			}
-		}
+		return err
 	}
 
 	var pub, rawPriv []byte
@@ -215,21 +205,14 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 			return fmt.Errorf("error while getting public key with PKCS#11: %w", err)
 		}
 	} else {
-		pub, rawPriv = newKeypair(curve)
+		pub, rawPriv, err = cert.GenerateKeypair(curve, false)
+		if err != nil {
+			return err
+		}
 	}
 
-	t := &cert.TBSCertificate{
-		Version:        cert.Version1,
-		Name:           *sf.name,
-		Networks:       []netip.Prefix{network},
-		Groups:         groups,
-		UnsafeNetworks: subnets,
-		NotBefore:      time.Now(),
-		NotAfter:       time.Now().Add(*sf.duration),
-		PublicKey:      pub,
-		IsCA:           false,
-		Curve:          curve,
-	}
+	t.PublicKey = pub
+	t.Curve = curve
 
 	if *sf.outKeyPath == "" {
 		*sf.outKeyPath = *sf.name + ".key"
@@ -243,6 +226,10 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		return fmt.Errorf("refusing to overwrite existing cert: %s", *sf.outCertPath)
 	}
 
+	if size := t.EstimatedMarshaledSize(); size > cert.MaxSafeCertificateSize {
+		fmt.Fprintf(errOut, "Warning: certificate is estimated to be %d bytes, more than %d bytes may cause handshakes to fail\n", size, cert.MaxSafeCertificateSize)
+	}
+
 	var c cert.Certificate
 
 	if p11Client == nil {
@@ -251,9 +238,9 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 			return fmt.Errorf("error while signing: %w", err)
 		}
 	} else {
-		c, err = t.SignPkcs11(caCert, curve, p11Client)
+		c, err = signPkcs11(t, caCert, cert.NewPkcs11Signer(p11Client))
 		if err != nil {
-			return fmt.Errorf("error while signing with PKCS#11: %w", err)
+			return err
 		}
 	}
 
@@ -293,38 +280,267 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	return nil
 }
 
-func newKeypair(curve cert.Curve) ([]byte, []byte) {
-	switch curve {
-	case cert.Curve_CURVE25519:
-		return x25519Keypair()
-	case cert.Curve_P256:
-		return p256Keypair()
-	default:
-		return nil, nil
+// newSignTBS validates the details of a single certificate to be signed by caCert. The public key and curve are left
+// for the caller to fill in. If duration is not positive the certificate expires one second before caCert.
+func newSignTBS(caCert cert.Certificate, name string, ips []string, groups, subnets string, duration time.Duration) (*cert.TBSCertificate, error) {
+	// if no duration is given, expire one second before the root expires
+	if duration <= 0 {
+		duration = time.Until(caCert.NotAfter()) - time.Second*1
+	}
+
+	var networks []netip.Prefix
+	for _, ip := range ips {
+		network, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return nil, newHelpErrorf("invalid ip definition: %s", ip)
+		}
+		if !network.Addr().Is4() {
+			return nil, newHelpErrorf("invalid ip definition: can only be ipv4, have %s", ip)
+		}
+		networks = append(networks, network)
 	}
+	if len(networks) == 0 {
+		return nil, newHelpErrorf("no ip definition was provided")
+	}
+
+	t := &cert.TBSCertificate{
+		Version:   cert.Version1,
+		Name:      name,
+		Networks:  networks,
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(duration),
+		IsCA:      false,
+	}
+
+	if groups != "" {
+		for _, rg := range strings.Split(groups, ",") {
+			g := strings.TrimSpace(rg)
+			if g != "" {
+				t.Groups = append(t.Groups, g)
+			}
+		}
+	}
+
+	if subnets != "" {
+		for _, rs := range strings.Split(subnets, ",") {
+			rs := strings.Trim(rs, " ")
+			if rs != "" {
+				s, err := netip.ParsePrefix(rs)
+				if err != nil {
+					return nil, newHelpErrorf("invalid subnet definition: %s", rs)
+				}
+				if !s.Addr().Is4() {
+					return nil, newHelpErrorf("invalid subnet definition: can only be ipv4, have %s", rs)
+				}
+				t.UnsafeNetworks = append(t.UnsafeNetworks, s)
+			}
+		}
+	}
+
+	return t, nil
 }
 
-func x25519Keypair() ([]byte, []byte) {
-	privkey := make([]byte, 32)
-	if _, err := io.ReadFull(rand.Reader, privkey); err != nil {
-		panic(err)
+// manifestEntry describes a single certificate to sign with -manifest
+type manifestEntry struct {
+	Name     string   `yaml:"name"`
+	Ips      []string `yaml:"ips"`
+	Subnets  []string `yaml:"subnets"`
+	Groups   []string `yaml:"groups"`
+	Duration string   `yaml:"duration"`
+}
+
+// readManifest loads the entries from a yaml list or from a csv file with a header row naming the columns.
+// Lists in csv columns are comma separated, the same as the sign flags.
+func readManifest(path string) ([]manifestEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading manifest: %s", err)
 	}
 
-	pubkey, err := curve25519.X25519(privkey, curve25519.Basepoint)
+	var entries []manifestEntry
+	if strings.ToLower(filepath.Ext(path)) != ".csv" {
+		err = yaml.UnmarshalStrict(b, &entries)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing manifest: %s", err)
+		}
+		return entries, nil
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error while parsing manifest: %s", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	splitList := func(s string) []string {
+		var l []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				l = append(l, v)
+			}
+		}
+		return l
 	}
 
-	return pubkey, privkey
+	header := records[0]
+	for _, record := range records[1:] {
+		var e manifestEntry
+		for i, column := range header {
+			switch strings.TrimSpace(column) {
+			case "name":
+				e.Name = strings.TrimSpace(record[i])
+			case "ips":
+				e.Ips = splitList(record[i])
+			case "subnets":
+				e.Subnets = splitList(record[i])
+			case "groups":
+				e.Groups = splitList(record[i])
+			case "duration":
+				e.Duration = strings.TrimSpace(record[i])
+			default:
+				return nil, fmt.Errorf("error while parsing manifest: unknown column %q", column)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
 }
 
-func p256Keypair() ([]byte, []byte) {
-	privkey, err := ecdh.P256().GenerateKey(rand.Reader)
+// checkPkcs11CA returns an error if caCert can not be used to sign with PKCS#11, which only supports P256 keys
+func checkPkcs11CA(caCert cert.Certificate) error {
+	if caCert.Curve() != cert.Curve_P256 {
+		return fmt.Errorf("refusing to sign with PKCS#11, root certificate curve is %s but only P256 is supported", caCert.Curve())
+	}
+	return nil
+}
+
+// signPkcs11 signs t with s, the ca key held in a PKCS#11 token
+func signPkcs11(t *cert.TBSCertificate, caCert cert.Certificate, s cert.Signer) (cert.Certificate, error) {
+	if err := checkPkcs11CA(caCert); err != nil {
+		return nil, err
+	}
+
+	c, err := t.SignWith(caCert, s)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error while signing with PKCS#11: %w", err)
+	}
+	return c, nil
+}
+
+// signManifest signs a certificate and generates a new key for every entry in the manifest, writing them to outDir as
+// <name>.crt and <name>.key. Every entry is validated and signed before anything is written so a bad entry does not
+// leave a partially provisioned directory behind.
+func signManifest(path string, outDir string, defaultDuration time.Duration, caCert cert.Certificate, curve cert.Curve, caKey []byte) error {
+	entries, err := readManifest(path)
+	if err != nil {
+		return err
 	}
-	pubkey := privkey.PublicKey()
-	return pubkey.Bytes(), privkey.Bytes()
+	if len(entries) == 0 {
+		return fmt.Errorf("manifest does not contain any entries")
+	}
+
+	type signed struct {
+		crtPath string
+		crt     []byte
+		keyPath string
+		key     []byte
+	}
+
+	var errs []error
+	var results []signed
+	seen := map[string]bool{}
+
+	for i, e := range entries {
+		entryErr := func(err error) {
+			errs = append(errs, fmt.Errorf("entry %d (%s): %s", i+1, e.Name, err))
+		}
+
+		if e.Name == "" {
+			entryErr(fmt.Errorf("name is required"))
+			continue
+		}
+		// The name is used as a file name in -out-dir, it must not be able to point anywhere else
+		if e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, `/\`) || filepath.Base(e.Name) != e.Name {
+			entryErr(fmt.Errorf("name can not contain a path"))
+			continue
+		}
+		if seen[e.Name] {
+			entryErr(fmt.Errorf("duplicate name"))
+			continue
+		}
+		seen[e.Name] = true
+
+		duration := defaultDuration
+		if e.Duration != "" {
+			duration, err = time.ParseDuration(e.Duration)
+			if err != nil {
+				entryErr(fmt.Errorf("invalid duration: %s", e.Duration))
+				continue
+			}
+		}
+
+		t, err := newSignTBS(caCert, e.Name, e.Ips, strings.Join(e.Groups, ","), strings.Join(e.Subnets, ","), duration)
+		if err != nil {
+			entryErr(err)
+			continue
+		}
+
+		r := signed{
+			crtPath: filepath.Join(outDir, e.Name+".crt"),
+			keyPath: filepath.Join(outDir, e.Name+".key"),
+		}
+		if _, err := os.Stat(r.crtPath); err == nil {
+			entryErr(fmt.Errorf("refusing to overwrite existing cert: %s", r.crtPath))
+			continue
+		}
+		if _, err := os.Stat(r.keyPath); err == nil {
+			entryErr(fmt.Errorf("refusing to overwrite existing key: %s", r.keyPath))
+			continue
+		}
+
+		pub, rawPriv, err := cert.GenerateKeypair(curve, false)
+		if err != nil {
+			entryErr(err)
+			continue
+		}
+		t.PublicKey = pub
+		t.Curve = curve
+
+		c, err := t.Sign(caCert, curve, caKey)
+		if err != nil {
+			entryErr(fmt.Errorf("error while signing: %w", err))
+			continue
+		}
+
+		r.crt, err = c.MarshalPEM()
+		if err != nil {
+			entryErr(fmt.Errorf("error while marshalling certificate: %s", err))
+			continue
+		}
+		r.key = cert.MarshalPrivateKeyToPEM(curve, rawPriv)
+		results = append(results, r)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("refusing to sign, manifest has invalid entries:\n%w", errors.Join(errs...))
+	}
+
+	for _, r := range results {
+		err = os.WriteFile(r.keyPath, r.key, 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing key: %s", err)
+		}
+
+		err = os.WriteFile(r.crtPath, r.crt, 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing certificate: %s", err)
+		}
+	}
+
+	return nil
 }
 
 func signSummary() string {
@@ -5,9 +5,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,10 +46,14 @@ func Test_signHelp(t *testing.T) {
 			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
 			"  -ip string\n"+
 			"    \tRequired: ipv4 address and network in CIDR notation to assign the cert\n"+
+			"  -manifest string\n"+
+			"    \tOptional: path to a yaml or csv manifest of certificates to sign. Each entry has a name, ips, subnets, groups and duration. Replaces -name and -ip\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the cert, usually a hostname\n"+
 			"  -out-crt string\n"+
 			"    \tOptional: path to write the certificate to\n"+
+			"  -out-dir string\n"+
+			"    \tOptional: directory to write the certificates and keys signed from -manifest to (default \".\")\n"+
 			"  -out-key string\n"+
 			"    \tOptional (if in-pub not set): path to write the private key to\n"+
 			"  -out-qr string\n"+
@@ -142,6 +152,14 @@ func Test_signCert(t *testing.T) {
 	b, _ := ca.MarshalPEM()
 	caCrtF.Write(b)
 
+	// PKCS#11 signing requires a P256 ca
+	if p11Supported() {
+		args = []string{"-ca-crt", caCrtF.Name(), "-pkcs11", "pkcs11:object=nope", "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-duration", "100m"}
+		assert.EqualError(t, signCert(args, ob, eb, nopw), "refusing to sign with PKCS#11, root certificate curve is CURVE25519 but only P256 is supported")
+		assert.Empty(t, ob.String())
+		assert.Empty(t, eb.String())
+	}
+
 	// failed to read pub
 	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-in-pub", "./nope", "-duration", "100m"}
 	assert.EqualError(t, signCert(args, ob, eb, nopw), "error while reading in-pub: open ./nope: "+NoSuchFileError)
@@ -163,7 +181,7 @@ func Test_signCert(t *testing.T) {
 	// write a proper pub for later
 	ob.Reset()
 	eb.Reset()
-	inPub, _ := x25519Keypair()
+	inPub, _, _ := cert.GenerateKeypair(cert.Curve_CURVE25519, false)
 	inPubF.Write(cert.MarshalPublicKeyToPEM(cert.Curve_CURVE25519, inPub))
 
 	// bad ip cidr
@@ -295,6 +313,19 @@ func Test_signCert(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, lCrt.PublicKey(), inPub)
 
+	// test warning about a certificate too large for a handshake
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	manyGroups := make([]string, 100)
+	for i := range manyGroups {
+		manyGroups[i] = fmt.Sprintf("group-%d", i)
+	}
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-in-pub", inPubF.Name(), "-duration", "100m", "-groups", strings.Join(manyGroups, ",")}
+	assert.Nil(t, signCert(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Contains(t, eb.String(), "Warning: certificate is estimated to be")
+
 	// test refuse to sign cert with duration beyond root
 	ob.Reset()
 	eb.Reset()
@@ -396,3 +427,191 @@ func Test_signCert(t *testing.T) {
 	assert.Equal(t, "Enter passphrase: ", ob.String())
 	assert.Empty(t, eb.String())
 }
+
+// fakeP11Signer stands in for a PKCS#11 token holding a P256 key
+type fakeP11Signer struct {
+	key   *ecdsa.PrivateKey
+	calls int
+}
+
+func (s *fakeP11Signer) Public() []byte {
+	pub, _ := s.key.PublicKey.ECDH()
+	return pub.Bytes()
+}
+
+func (s *fakeP11Signer) Curve() cert.Curve {
+	return cert.Curve_P256
+}
+
+func (s *fakeP11Signer) SignRaw(digest []byte) ([]byte, error) {
+	s.calls++
+	return ecdsa.SignASN1(rand.Reader, s.key, digest)
+}
+
+func Test_signPkcs11(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	signer := &fakeP11Signer{key: key}
+
+	ca, err := (&cert.TBSCertificate{
+		Version:   cert.Version1,
+		Name:      "p256 ca",
+		IsCA:      true,
+		NotBefore: time.Now().Add(-time.Minute),
+		NotAfter:  time.Now().Add(time.Hour),
+		PublicKey: signer.Public(),
+		Curve:     cert.Curve_P256,
+	}).SignWith(nil, signer)
+	assert.NoError(t, err)
+
+	newTBS := func(ca cert.Certificate) *cert.TBSCertificate {
+		tbs, err := newSignTBS(ca, "test", []string{"10.1.0.1/16"}, "", "", time.Minute)
+		assert.NoError(t, err)
+		priv, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		tbs.PublicKey = priv.PublicKey().Bytes()
+		tbs.Curve = cert.Curve_P256
+		return tbs
+	}
+
+	// A P256 ca signs through the token
+	calls := signer.calls
+	c, err := signPkcs11(newTBS(ca), ca, signer)
+	assert.NoError(t, err)
+	assert.Equal(t, calls+1, signer.calls)
+	pool := cert.NewCAPool()
+	assert.NoError(t, pool.AddCA(ca))
+	_, err = pool.Verify(c)
+	assert.NoError(t, err)
+
+	// Any other curve is refused before the token is used
+	edCA, _ := NewTestCaCert("ca", nil, nil, time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil, nil, nil)
+	calls = signer.calls
+	_, err = signPkcs11(newTBS(ca), edCA, signer)
+	assert.EqualError(t, err, "refusing to sign with PKCS#11, root certificate curve is CURVE25519 but only P256 is supported")
+	assert.Equal(t, calls, signer.calls)
+}
+
+func Test_signCertManifest(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{password: []byte(""), err: nil}
+
+	dir := t.TempDir()
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	caKeyPath := filepath.Join(dir, "ca.key")
+	assert.NoError(t, os.WriteFile(caKeyPath, cert.MarshalSigningPrivateKeyToPEM(cert.Curve_CURVE25519, caPriv), 0600))
+
+	ca, _ := NewTestCaCert("ca", caPub, caPriv, time.Now(), time.Now().Add(time.Minute*200), nil, nil, nil)
+	b, _ := ca.MarshalPEM()
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caCrtPath, b, 0600))
+
+	outDir := filepath.Join(dir, "out")
+	assert.NoError(t, os.Mkdir(outDir, 0700))
+
+	// manifest can not be combined with single cert flags
+	assertHelpError(t, signCert(
+		[]string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-manifest", "nope", "-name", "test"}, ob, eb, nopw,
+	), "cannot set both -manifest and -name")
+
+	// an invalid entry fails the whole manifest and reports every problem
+	manifestPath := filepath.Join(dir, "hosts.yaml")
+	assert.NoError(t, os.WriteFile(manifestPath, []byte(`
+- name: web1
+  ips: [10.1.0.1/16]
+  groups: [web, prod]
+  subnets: [192.168.1.0/24]
+  duration: 100m
+- name: db1
+  ips: [100::100/100]
+  duration: nope
+- name: db2
+`), 0600))
+
+	args := []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-manifest", manifestPath, "-out-dir", outDir}
+	assert.EqualError(t, signCert(args, ob, eb, nopw), "refusing to sign, manifest has invalid entries:\n"+
+		"entry 2 (db1): invalid duration: nope\n"+
+		"entry 3 (db2): no ip definition was provided")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	entries, err := os.ReadDir(outDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// fix the bad entries, the default duration comes from the flag
+	assert.NoError(t, os.WriteFile(manifestPath, []byte(`
+- name: web1
+  ips: [10.1.0.1/16]
+  groups: [web, prod]
+  subnets: [192.168.1.0/24]
+  duration: 100m
+- name: db1
+  ips: [10.1.0.2/16]
+`), 0600))
+
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-manifest", manifestPath, "-out-dir", outDir, "-duration", "50m"}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, err := os.ReadFile(filepath.Join(outDir, "web1.crt"))
+	assert.NoError(t, err)
+	web1, _, err := cert.UnmarshalCertificateFromPEM(rb)
+	assert.NoError(t, err)
+	assert.Equal(t, "web1", web1.Name())
+	assert.Equal(t, "10.1.0.1/16", web1.Networks()[0].String())
+	assert.Equal(t, []string{"web", "prod"}, web1.Groups())
+	assert.Equal(t, "192.168.1.0/24", web1.UnsafeNetworks()[0].String())
+	assert.Equal(t, time.Minute*100, web1.NotAfter().Sub(web1.NotBefore()))
+	assert.True(t, web1.CheckSignature(caPub))
+
+	rb, err = os.ReadFile(filepath.Join(outDir, "web1.key"))
+	assert.NoError(t, err)
+	key, _, curve, err := cert.UnmarshalPrivateKeyFromPEM(rb)
+	assert.NoError(t, err)
+	assert.NoError(t, web1.VerifyPrivateKey(curve, key))
+
+	rb, err = os.ReadFile(filepath.Join(outDir, "db1.crt"))
+	assert.NoError(t, err)
+	db1, _, err := cert.UnmarshalCertificateFromPEM(rb)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute*50, db1.NotAfter().Sub(db1.NotBefore()))
+
+	// existing files are not overwritten
+	assert.EqualError(t, signCert(args, ob, eb, nopw), "refusing to sign, manifest has invalid entries:\n"+
+		"entry 1 (web1): refusing to overwrite existing cert: "+filepath.Join(outDir, "web1.crt")+"\n"+
+		"entry 2 (db1): refusing to overwrite existing cert: "+filepath.Join(outDir, "db1.crt"))
+
+	// names can not write outside of -out-dir
+	assert.NoError(t, os.WriteFile(manifestPath, []byte(`
+- name: ../escape
+  ips: [10.1.0.4/16]
+- name: /tmp/escape
+  ips: [10.1.0.5/16]
+- name: sub\escape
+  ips: [10.1.0.6/16]
+- name: ".."
+  ips: [10.1.0.7/16]
+`), 0600))
+	assert.EqualError(t, signCert(args, ob, eb, nopw), "refusing to sign, manifest has invalid entries:\n"+
+		"entry 1 (../escape): name can not contain a path\n"+
+		"entry 2 (/tmp/escape): name can not contain a path\n"+
+		"entry 3 (sub\\escape): name can not contain a path\n"+
+		"entry 4 (..): name can not contain a path")
+	_, err = os.Stat(filepath.Join(dir, "escape.crt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// csv manifests use a header row and comma separated lists
+	csvPath := filepath.Join(dir, "hosts.csv")
+	assert.NoError(t, os.WriteFile(csvPath, []byte("name,ips,groups\nlb1,10.1.0.3/16,\"lb, prod\"\n"), 0600))
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-manifest", csvPath, "-out-dir", outDir, "-duration", "50m"}
+	assert.NoError(t, signCert(args, ob, eb, nopw))
+
+	rb, err = os.ReadFile(filepath.Join(outDir, "lb1.crt"))
+	assert.NoError(t, err)
+	lb1, _, err := cert.UnmarshalCertificateFromPEM(rb)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lb", "prod"}, lb1.Groups())
+}
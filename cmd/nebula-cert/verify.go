@@ -6,7 +6,6 @@ import (
 	"io"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/slackhq/nebula/cert"
 )
@@ -66,7 +65,7 @@ func verify(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("error while parsing crt: %s", err)
 	}
 
-	_, err = caPool.VerifyCertificate(time.Now(), c)
+	_, err = caPool.Verify(c)
 	if err != nil {
 		return err
 	}
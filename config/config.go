@@ -1,17 +1,23 @@
 package config
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,14 +26,66 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+var (
+	// ErrKeyNotFound is returned when the requested key is not present in the config
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrWrongType is returned when the requested key is present but does not hold the expected type
+	ErrWrongType = errors.New("wrong type")
+	// ErrOutOfRange is returned when the requested key holds a value outside the allowed bounds
+	ErrOutOfRange = errors.New("out of range")
+	// ErrRequiredKeyMissing is returned by the GetRequired functions when the requested key is not present
+	ErrRequiredKeyMissing = errors.New("required key is missing")
+)
+
 type C struct {
 	path        string
+	glob        bool
+	profile     *string
 	files       []string
 	Settings    map[interface{}]interface{}
 	oldSettings map[interface{}]interface{}
-	callbacks   []func(*C)
+	callbacks   []reloadCallback
 	l           *logrus.Logger
 	reloadLock  sync.Mutex
+
+	// overrides shadow the loaded settings by key and survive reloads until cleared
+	overrides       map[string]interface{}
+	loadedOverrides map[string]interface{}
+	overrideLock    sync.RWMutex
+
+	// rollbackOnError restores the previous settings if a reload callback fails
+	rollbackOnError bool
+
+	// trackAccess records every key that Get, Lookup, or IsSet finds in the current settings, see UnusedKeys
+	trackAccess atomic.Bool
+	accessed    map[string]struct{}
+	accessLock  sync.Mutex
+
+	// origins maps every dotted key to the file that provided its value, see Origin
+	origins map[string]string
+
+	// requiredDurations are keys that must hold a valid duration for a load to succeed, see RequireDurations
+	requiredDurations []string
+
+	// validators must all accept a candidate config before it replaces the settings, see RegisterValidator
+	validators []func(*C) error
+
+	// strict rejects yaml with duplicate keys instead of letting the last one win, see SetStrict
+	strict bool
+
+	// nullDeletes makes an explicit null in a later file remove the key from the merged settings, see SetNullDeletes
+	nullDeletes bool
+
+	// references resolves ${dotted.key} within string values to the value of another key, see SetReferences
+	references bool
+
+	// ignoredKeys are dotted keys that HasChanged does not compare, see IgnoreKeys
+	ignoredKeys []string
+}
+
+type reloadCallback struct {
+	key string
+	f   func(*C) error
 }
 
 func NewC(l *logrus.Logger) *C {
@@ -37,23 +95,22 @@ func NewC(l *logrus.Logger) *C {
 	}
 }
 
-// Load will find all yaml files within path and load them in lexical order
+// Load will find all yaml and json files within path and load them in lexical order
 func (c *C) Load(path string) error {
-	c.path = path
-	c.files = make([]string, 0)
+	src := &C{path: path, files: make([]string, 0)}
 
-	err := c.resolve(path, true)
+	err := src.resolve(path, true)
 	if err != nil {
 		return err
 	}
 
-	if len(c.files) == 0 {
+	if len(src.files) == 0 {
 		return fmt.Errorf("no config files found at %s", path)
 	}
 
-	sort.Strings(c.files)
+	sort.Strings(src.files)
 
-	err = c.parse()
+	err = c.parse(src)
 	if err != nil {
 		return err
 	}
@@ -61,6 +118,70 @@ func (c *C) Load(path string) error {
 	return nil
 }
 
+// LoadGlob will load all files matching the filepath.Glob pattern in lexical order, merging them the same way as Load.
+// Unlike Load the file extension is not considered, only the pattern decides which files are used. Directories that
+// match the pattern are ignored. A reload will evaluate the pattern again.
+func (c *C) LoadGlob(pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	src := &C{path: pattern, glob: true, files: make([]string, 0)}
+
+	for _, m := range matches {
+		i, err := os.Stat(m)
+		if err != nil || i.IsDir() {
+			continue
+		}
+
+		err = src.addFile(m, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(src.files) == 0 {
+		return fmt.Errorf("no config files found matching %s", pattern)
+	}
+
+	sort.Strings(src.files)
+
+	return c.parse(src)
+}
+
+// LoadProfile will load base.yaml from baseDir and then merge <profile>.yaml from baseDir over it, if that file exists,
+// the same way Load merges files. An empty profile only loads base.yaml. A reload will load the same profile again.
+func (c *C) LoadProfile(baseDir, profile string) error {
+	src := &C{path: baseDir, profile: &profile, files: make([]string, 0)}
+
+	base := filepath.Join(baseDir, "base.yaml")
+	if _, err := os.Stat(base); err != nil {
+		return fmt.Errorf("could not load base config: %w", err)
+	}
+
+	err := src.addFile(base, true)
+	if err != nil {
+		return err
+	}
+
+	if profile != "" {
+		if strings.ContainsAny(profile, `/\`) {
+			return fmt.Errorf("invalid config profile: %s", profile)
+		}
+
+		overlay := filepath.Join(baseDir, profile+".yaml")
+		if _, err := os.Stat(overlay); err == nil {
+			err = src.addFile(overlay, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.parse(src)
+}
+
 func (c *C) LoadString(raw string) error {
 	if raw == "" {
 		return errors.New("Empty configuration")
@@ -68,12 +189,231 @@ func (c *C) LoadString(raw string) error {
 	return c.parseRaw([]byte(raw))
 }
 
+// LoadJSONString is the same as LoadString for a config written as JSON
+func (c *C) LoadJSONString(raw string) error {
+	if raw == "" {
+		return errors.New("Empty configuration")
+	}
+
+	m, err := unmarshalJSON([]byte(raw))
+	if err != nil {
+		return err
+	}
+
+	return c.setRaw(m)
+}
+
 // RegisterReloadCallback stores a function to be called when a config reload is triggered. The functions registered
 // here should decide if they need to make a change to the current process before making the change. HasChanged can be
 // used to help decide if a change is necessary.
 // These functions should return quickly or spawn their own go routine if they will take a while
 func (c *C) RegisterReloadCallback(f func(*C)) {
-	c.callbacks = append(c.callbacks, f)
+	c.RegisterReloadCallbackWithError("", func(c *C) error {
+		f(c)
+		return nil
+	})
+}
+
+// RegisterReloadCallbackWithError is the same as RegisterReloadCallback except f can report a failure to apply the
+// new config. Errors are logged along with key, which should name the config section f is responsible for.
+// See SetRollbackOnError to restore the previous config when a callback fails.
+func (c *C) RegisterReloadCallbackWithError(key string, f func(*C) error) {
+	c.callbacks = append(c.callbacks, reloadCallback{key: key, f: f})
+}
+
+// OnKeyChange registers f to be called during a reload only when the value of k has changed, as decided by
+// HasChanged. f is given the values of k from before and after the reload, either is nil if k was not set.
+func (c *C) OnKeyChange(k string, f func(oldValue, newValue interface{})) {
+	c.RegisterReloadCallbackWithError(k, func(c *C) error {
+		if c.HasChanged(k) {
+			f(c.get(k, c.oldSettings), c.get(k, c.settings()))
+		}
+		return nil
+	})
+}
+
+// RegisterValidator stores a function that must accept every config before it is loaded. f is given a temporary C
+// holding the candidate settings, if any validator returns an error the load or reload fails, the current settings are
+// kept, and no reload callbacks are called. Validators should only read from the C they are given.
+func (c *C) RegisterValidator(f func(*C) error) {
+	c.validators = append(c.validators, f)
+}
+
+// validate runs every validator against a temporary C holding m and the source of src, returning all errors encountered
+func (c *C) validate(src *C, m map[interface{}]interface{}) error {
+	if len(c.validators) == 0 {
+		return nil
+	}
+
+	c.overrideLock.RLock()
+	candidate := &C{
+		path:     src.path,
+		glob:     src.glob,
+		profile:  src.profile,
+		files:    src.files,
+		Settings: applyOverrides(m, c.overrides),
+		l:        c.l,
+	}
+	c.overrideLock.RUnlock()
+
+	var errs []error
+	for _, f := range c.validators {
+		err := f(candidate)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetRollbackOnError controls what happens when a reload callback returns an error. When enabled the settings from
+// before the reload are restored and every callback is called again so they can revert any changes already made.
+func (c *C) SetRollbackOnError(enabled bool) {
+	c.rollbackOnError = enabled
+}
+
+// SetStrict controls how yaml is decoded. When enabled a mapping that repeats a key fails to load instead of the last
+// value silently winning. This takes effect on the next load or reload.
+func (c *C) SetStrict(enabled bool) {
+	c.strict = enabled
+}
+
+// SetNullDeletes controls how an explicit null is merged. When enabled a key set to null in a later file removes that
+// key, and anything below it, from the settings provided by earlier files instead of leaving the earlier value in place.
+// This takes effect on the next load or reload.
+func (c *C) SetNullDeletes(enabled bool) {
+	c.nullDeletes = enabled
+}
+
+// SetReferences controls whether ${dotted.key} within a string value is replaced with the value of that key. When
+// enabled a reference to a key that is not set fails the load and $${...} can be used to keep a literal ${...}. When
+// disabled only ${file:} and ${env:} placeholders are replaced. This takes effect on the next load or reload.
+func (c *C) SetReferences(enabled bool) {
+	c.references = enabled
+}
+
+// IgnoreKeys makes HasChanged skip the provided dotted keys, along with everything below them. This allows metadata
+// such as a generation timestamp to change with every deploy without the config reporting a change.
+func (c *C) IgnoreKeys(keys ...string) {
+	c.ignoredKeys = append(c.ignoredKeys, keys...)
+}
+
+// SetTrackAccess enables recording of every key read from the config, see UnusedKeys.
+func (c *C) SetTrackAccess(enabled bool) {
+	c.accessLock.Lock()
+	defer c.accessLock.Unlock()
+	c.trackAccess.Store(enabled)
+	if enabled && c.accessed == nil {
+		c.accessed = make(map[string]struct{})
+	}
+}
+
+// UnusedKeys returns the sorted dotted keys of every leaf value in Settings that has not been read since
+// SetTrackAccess was enabled. Reading a map marks everything below it as used.
+func (c *C) UnusedKeys() []string {
+	c.accessLock.Lock()
+	defer c.accessLock.Unlock()
+
+	var unused []string
+	for _, k := range flattenKeys("", c.Settings) {
+		if !c.accessedUnlocked(k) {
+			unused = append(unused, k)
+		}
+	}
+
+	sort.Strings(unused)
+	return unused
+}
+
+// accessedUnlocked returns true if k or any of its parents were read, c.accessLock must be held
+func (c *C) accessedUnlocked(k string) bool {
+	for {
+		if _, ok := c.accessed[k]; ok {
+			return true
+		}
+
+		i := strings.LastIndex(k, ".")
+		if i < 0 {
+			return false
+		}
+		k = k[:i]
+	}
+}
+
+// flattenKeys returns the dotted key for every non map value in m, an empty map is treated as a value
+func flattenKeys(prefix string, m map[interface{}]interface{}) []string {
+	var keys []string
+	for k, v := range m {
+		key := fmt.Sprintf("%v", k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if sub, ok := v.(map[interface{}]interface{}); ok && len(sub) > 0 {
+			keys = append(keys, flattenKeys(key, sub)...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// LoadedFiles returns the files that make up the current config, in the order they were merged. Files pulled in with
+// include are not listed.
+func (c *C) LoadedFiles() []string {
+	return slices.Clone(c.files)
+}
+
+// Origin returns the file that provided the value for k after merging every loaded file, includes are reported as the
+// included file. Lists that were appended together report the last file that contributed to them. k must refer to a
+// value rather than a map. ok is false if k is not set, is set by an override, or the config was not loaded from files.
+func (c *C) Origin(k string) (file string, ok bool) {
+	c.overrideLock.RLock()
+	defer c.overrideLock.RUnlock()
+
+	for p := k; ; p = p[:strings.LastIndex(p, ".")] {
+		if _, set := c.overrides[p]; set {
+			return "", false
+		}
+
+		if !strings.Contains(p, ".") {
+			break
+		}
+	}
+
+	file, ok = c.origins[k]
+	return file, ok
+}
+
+// RequireDurations makes loading fail if any of keys is set to something that is not a valid duration, such as a number
+// without a unit. Unset keys are allowed. This should be called before the first load and applies to every reload.
+func (c *C) RequireDurations(keys ...string) {
+	c.requiredDurations = append(c.requiredDurations, keys...)
+}
+
+// checkDurations returns an error for every key in requiredDurations that does not parse as a duration in m
+func (c *C) checkDurations(m map[interface{}]interface{}) error {
+	var errs []error
+	for _, k := range c.requiredDurations {
+		var v interface{} = m
+		for _, p := range strings.Split(k, ".") {
+			vm, _ := v.(map[interface{}]interface{})
+			v, _ = mapValue(vm, p)
+		}
+
+		if v == nil {
+			continue
+		}
+
+		_, err := time.ParseDuration(fmt.Sprintf("%v", v))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v is not a valid duration, a unit such as s or ms is required", k, v))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // InitialLoad returns true if this is the first load of the config, and ReloadConfig has not been called yet.
@@ -91,18 +431,24 @@ func (c *C) HasChanged(k string) bool {
 		return false
 	}
 
+	for _, ik := range c.ignoredKeys {
+		if k == ik || strings.HasPrefix(k, ik+".") {
+			return false
+		}
+	}
+
 	var (
 		nv interface{}
 		ov interface{}
 	)
 
 	if k == "" {
-		nv = c.Settings
-		ov = c.oldSettings
+		nv = c.withoutIgnoredKeys(k, c.settings())
+		ov = c.withoutIgnoredKeys(k, c.oldSettings)
 		k = "all settings"
 	} else {
-		nv = c.get(k, c.Settings)
-		ov = c.get(k, c.oldSettings)
+		nv = c.withoutIgnoredKeys(k, c.get(k, c.settings()))
+		ov = c.withoutIgnoredKeys(k, c.get(k, c.oldSettings))
 	}
 
 	newVals, err := yaml.Marshal(nv)
@@ -118,8 +464,41 @@ func (c *C) HasChanged(k string) bool {
 	return string(newVals) != string(oldVals)
 }
 
+// withoutIgnoredKeys returns v, the value at k, with any ignored keys below k removed. v is copied before anything
+// is removed.
+func (c *C) withoutIgnoredKeys(k string, v interface{}) interface{} {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return v
+	}
+
+	copied := false
+	for _, ik := range c.ignoredKeys {
+		if k != "" {
+			if !strings.HasPrefix(ik, k+".") {
+				continue
+			}
+			ik = strings.TrimPrefix(ik, k+".")
+		}
+
+		if !copied {
+			m = deepCopy(m).(map[interface{}]interface{})
+			copied = true
+		}
+
+		parts := strings.Split(ik, ".")
+		keys := make([]interface{}, len(parts))
+		for i, p := range parts {
+			keys[i] = p
+		}
+		deleteKey(m, keys)
+	}
+
+	return m
+}
+
 // CatchHUP will listen for the HUP signal in a go routine and reload all configs found in the
-// original path provided to Load. The old settings are shallow copied for change detection after the reload.
+// original path provided to Load. The old settings are deep copied for change detection after the reload.
 func (c *C) CatchHUP(ctx context.Context) {
 	if c.path == "" {
 		return
@@ -143,45 +522,169 @@ func (c *C) CatchHUP(ctx context.Context) {
 	}()
 }
 
-func (c *C) ReloadConfig() {
-	c.reloadLock.Lock()
-	defer c.reloadLock.Unlock()
+// snapshotSettings stores the current settings, including any overrides that were active as of the last reload, so
+// HasChanged can detect both file and override changes after a reload.
+func (c *C) snapshotSettings() {
+	c.overrideLock.Lock()
+	defer c.overrideLock.Unlock()
 
-	c.oldSettings = make(map[interface{}]interface{})
-	for k, v := range c.Settings {
-		c.oldSettings[k] = v
+	c.oldSettings = applyOverrides(deepCopy(c.Settings).(map[interface{}]interface{}), c.loadedOverrides)
+
+	c.loadedOverrides = make(map[string]interface{}, len(c.overrides))
+	for k, v := range c.overrides {
+		c.loadedOverrides[k] = v
 	}
+}
 
-	err := c.Load(c.path)
-	if err != nil {
-		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
-		return
+// SetOverride sets k to v regardless of what the loaded config contains. Overrides are consulted before the loaded
+// settings by all getters and are kept across reloads until removed with ClearOverride. Reload callbacks are not
+// called, HasChanged will report the override on the next reload.
+func (c *C) SetOverride(k string, v interface{}) {
+	c.overrideLock.Lock()
+	defer c.overrideLock.Unlock()
+
+	if c.overrides == nil {
+		c.overrides = make(map[string]interface{})
+	}
+	c.overrides[k] = v
+}
+
+// ClearOverride removes an override set with SetOverride, the loaded value for k is visible again
+func (c *C) ClearOverride(k string) {
+	c.overrideLock.Lock()
+	defer c.overrideLock.Unlock()
+
+	delete(c.overrides, k)
+}
+
+// settings returns the loaded settings with any overrides applied
+func (c *C) settings() map[interface{}]interface{} {
+	c.overrideLock.RLock()
+	defer c.overrideLock.RUnlock()
+
+	return applyOverrides(c.Settings, c.overrides)
+}
+
+// applyOverrides returns settings with each override set at its key. Maps along the path of an override are copied so
+// settings is never modified.
+func applyOverrides(settings map[interface{}]interface{}, overrides map[string]interface{}) map[interface{}]interface{} {
+	if len(overrides) == 0 {
+		return settings
+	}
+
+	out := copyMap(settings)
+	for k, v := range overrides {
+		parts := strings.Split(k, ".")
+		m := out
+		for _, p := range parts[:len(parts)-1] {
+			next, _ := m[p].(map[interface{}]interface{})
+			next = copyMap(next)
+			m[p] = next
+			m = next
+		}
+		m[parts[len(parts)-1]] = v
+	}
+
+	return out
+}
+
+// deepCopy returns a copy of v where all nested maps and slices are copied as well
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			out[k] = deepCopy(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, v := range t {
+			out[i] = deepCopy(v)
+		}
+		return out
+	default:
+		return v
 	}
+}
 
-	for _, v := range c.callbacks {
-		v(c)
+func copyMap(m map[interface{}]interface{}) map[interface{}]interface{} {
+	out := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
 	}
+	return out
+}
+
+func (c *C) ReloadConfig() {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	_ = c.reload(func() error {
+		var err error
+		switch {
+		case c.profile != nil:
+			err = c.LoadProfile(c.path, *c.profile)
+		case c.glob:
+			err = c.LoadGlob(c.path)
+		default:
+			err = c.Load(c.path)
+		}
+		if err != nil {
+			c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
+		}
+		return err
+	})
 }
 
 func (c *C) ReloadConfigString(raw string) error {
 	c.reloadLock.Lock()
 	defer c.reloadLock.Unlock()
 
-	c.oldSettings = make(map[interface{}]interface{})
-	for k, v := range c.Settings {
-		c.oldSettings[k] = v
+	return c.reload(func() error {
+		return c.LoadString(raw)
+	})
+}
+
+// reload replaces the settings using load and then calls the reload callbacks. An error is returned if load fails or
+// if any callbacks fail, the settings will be rolled back in the latter case if rollbackOnError is set.
+func (c *C) reload(load func() error) error {
+	var prev map[interface{}]interface{}
+	if c.rollbackOnError {
+		prev, _ = deepCopy(c.Settings).(map[interface{}]interface{})
 	}
 
-	err := c.LoadString(raw)
+	c.snapshotSettings()
+
+	err := load()
 	if err != nil {
 		return err
 	}
 
-	for _, v := range c.callbacks {
-		v(c)
+	err = c.runCallbacks()
+	if err != nil && c.rollbackOnError {
+		c.l.WithError(err).Warn("Rolling back config after a failed reload")
+		c.snapshotSettings()
+		c.Settings = prev
+		// Any failures here have already been logged, there is nothing more we can do about them
+		_ = c.runCallbacks()
 	}
 
-	return nil
+	return err
+}
+
+// runCallbacks calls every reload callback even if one fails, returning all errors encountered
+func (c *C) runCallbacks() error {
+	var errs []error
+	for _, cb := range c.callbacks {
+		err := cb.f(c)
+		if err != nil {
+			c.l.WithField("callback", cb.key).WithError(err).Error("Reload callback failed")
+			errs = append(errs, fmt.Errorf("%s: %w", cb.key, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // GetString will get the string for k or return the default d if not found or invalid
@@ -194,45 +697,127 @@ func (c *C) GetString(k, d string) string {
 	return fmt.Sprintf("%v", r)
 }
 
-// GetStringSlice will get the slice of strings for k or return the default d if not found or invalid
+// GetPath will get the path for k or return the default d if not found or invalid. See LookupPath for how relative
+// paths are resolved, d is returned as is.
+func (c *C) GetPath(k, d string) string {
+	v, err := c.LookupPath(k)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
+// LookupPath will get the absolute path for k. A relative path is resolved against the directory holding the loaded
+// config rather than the working directory, a config loaded from a string resolves against the working directory.
+// ErrKeyNotFound is returned if k is not set.
+func (c *C) LookupPath(k string) (string, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return "", err
+	}
+
+	v := fmt.Sprintf("%v", r)
+	if filepath.IsAbs(v) {
+		return v, nil
+	}
+
+	return filepath.Abs(filepath.Join(c.dir(), v))
+}
+
+// dir returns the directory holding the loaded config, or an empty string if it was not loaded from disk
+func (c *C) dir() string {
+	if c.path == "" {
+		return ""
+	}
+
+	if !c.glob {
+		if i, err := os.Stat(c.path); err == nil && i.IsDir() {
+			return c.path
+		}
+	}
+
+	return filepath.Dir(c.path)
+}
+
+// GetStringSlice will get the slice of strings for k or return the default d if not found or invalid.
+// A string value is treated as a comma separated list. Entries are trimmed of whitespace and empty entries are dropped.
 func (c *C) GetStringSlice(k string, d []string) []string {
-	r := c.Get(k)
-	if r == nil {
+	v, err := c.LookupStringSlice(k)
+	if errors.Is(err, ErrWrongType) {
+		if s, ok := c.Get(k).(string); ok {
+			v, err = strings.Split(s, ","), nil
+		}
+	}
+
+	if err != nil {
 		return d
 	}
 
+	out := make([]string, 0, len(v))
+	for _, rv := range v {
+		rv = strings.TrimSpace(rv)
+		if rv != "" {
+			out = append(out, rv)
+		}
+	}
+
+	return out
+}
+
+// LookupStringSlice will get the slice of strings for k. ErrKeyNotFound is returned if k is not set and
+// ErrWrongType is returned if k is not a list.
+func (c *C) LookupStringSlice(k string) ([]string, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return nil, err
+	}
+
 	rv, ok := r.([]interface{})
 	if !ok {
-		return d
+		return nil, fmt.Errorf("%s must be a list, got %T: %w", k, r, ErrWrongType)
 	}
 
 	v := make([]string, len(rv))
 	for i := 0; i < len(v); i++ {
-		v[i] = fmt.Sprintf("%v", rv[i])
+		// A blank yaml list entry is nil
+		if rv[i] != nil {
+			v[i] = fmt.Sprintf("%v", rv[i])
+		}
 	}
 
-	return v
+	return v, nil
 }
 
 // GetMap will get the map for k or return the default d if not found or invalid
 func (c *C) GetMap(k string, d map[interface{}]interface{}) map[interface{}]interface{} {
-	r := c.Get(k)
-	if r == nil {
+	v, err := c.LookupMap(k)
+	if err != nil {
 		return d
 	}
 
+	return v
+}
+
+// LookupMap will get the map for k. ErrKeyNotFound is returned if k is not set and ErrWrongType is returned
+// if k is not a map.
+func (c *C) LookupMap(k string) (map[interface{}]interface{}, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return nil, err
+	}
+
 	v, ok := r.(map[interface{}]interface{})
 	if !ok {
-		return d
+		return nil, fmt.Errorf("%s must be a map, got %T: %w", k, r, ErrWrongType)
 	}
 
-	return v
+	return v, nil
 }
 
-// GetInt will get the int for k or return the default d if not found or invalid
-func (c *C) GetInt(k string, d int) int {
-	r := c.GetString(k, strconv.Itoa(d))
-	v, err := strconv.Atoi(r)
+// GetStringMapStringSlice will get the map of string lists for k or return the default d if not found or invalid
+func (c *C) GetStringMapStringSlice(k string, d map[string][]string) map[string][]string {
+	v, err := c.LookupStringMapStringSlice(k)
 	if err != nil {
 		return d
 	}
@@ -240,32 +825,212 @@ func (c *C) GetInt(k string, d int) int {
 	return v
 }
 
-// GetUint32 will get the uint32 for k or return the default d if not found or invalid
-func (c *C) GetUint32(k string, d uint32) uint32 {
-	r := c.GetInt(k, int(d))
-	if uint64(r) > uint64(math.MaxUint32) {
-		return d
-	}
+// LookupStringMapStringSlice will get a map of string lists for k, such as groups: {admins: [alice, bob]}. Keys are
+// converted to strings. ErrKeyNotFound is returned if k is not set and ErrWrongType is returned if k is not a map or
+// any of its values is not a list.
+func (c *C) LookupStringMapStringSlice(k string) (map[string][]string, error) {
+	rm, err := c.LookupMap(k)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make(map[string][]string, len(rm))
+	for mk, mv := range rm {
+		rv, ok := mv.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s.%v must be a list, got %T: %w", k, mk, mv, ErrWrongType)
+		}
+
+		l := make([]string, len(rv))
+		for i := range rv {
+			// A blank yaml list entry is nil
+			if rv[i] != nil {
+				l[i] = fmt.Sprintf("%v", rv[i])
+			}
+		}
+		v[fmt.Sprintf("%v", mk)] = l
+	}
+
+	return v, nil
+}
+
+// GetInt will get the int for k or return the default d if not found or invalid
+func (c *C) GetInt(k string, d int) int {
+	v, err := c.LookupInt(k)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
+// LookupInt will get the int for k. ErrKeyNotFound is returned if k is not set and ErrWrongType is returned if k
+// is not an integer.
+func (c *C) LookupInt(k string) (int, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.Atoi(fmt.Sprintf("%v", r))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer, got %v: %w", k, r, ErrWrongType)
+	}
+
+	return v, nil
+}
+
+// LookupIntInRange will get the int for k and ensure it is within [min, max]. ErrKeyNotFound is returned if k is not
+// set, ErrWrongType is returned if k is not an integer and ErrOutOfRange is returned if k is outside the bounds.
+func (c *C) LookupIntInRange(k string, min, max int) (int, error) {
+	v, err := c.LookupInt(k)
+	if err != nil {
+		return 0, err
+	}
+
+	if v < min || v > max {
+		return 0, fmt.Errorf("%s must be between %d and %d, got %d: %w", k, min, max, v, ErrOutOfRange)
+	}
+
+	return v, nil
+}
+
+// GetListenAddr will get the listen address for prefix or return the default d if it is invalid, see LookupListenAddr
+func (c *C) GetListenAddr(prefix string, d netip.AddrPort) netip.AddrPort {
+	v, err := c.LookupListenAddr(prefix)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
+// LookupListenAddr will get the address made of <prefix>.host and <prefix>.port, such as listen.host and listen.port.
+// The host must be an ip address, IPv6 addresses may be bracketed as in [::], and defaults to 0.0.0.0. The port
+// defaults to 0 which lets the system choose one. ErrWrongType is returned if the host is not an ip address or the port
+// is not an integer and ErrOutOfRange is returned if the port is not a valid port number.
+func (c *C) LookupListenAddr(prefix string) (netip.AddrPort, error) {
+	host := "0.0.0.0"
+	if r, err := c.Lookup(prefix + ".host"); err == nil {
+		host = fmt.Sprintf("%v", r)
+	}
+
+	trimmed := host
+	if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+		trimmed = trimmed[1 : len(trimmed)-1]
+	}
+
+	addr, err := netip.ParseAddr(trimmed)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%s.host must be an ip address, got %s: %w", prefix, host, ErrWrongType)
+	}
+
+	port, err := c.LookupIntInRange(prefix+".port", 0, math.MaxUint16)
+	if errors.Is(err, ErrKeyNotFound) {
+		port, err = 0, nil
+	}
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// LookupEnum will get the string for k and ensure it is one of allowed, ignoring case. The matching entry from allowed is
+// returned so callers can compare against their own spelling. ErrKeyNotFound is returned if k is not set and
+// ErrOutOfRange is returned, listing the allowed values, if k is anything else.
+func (c *C) LookupEnum(k string, allowed []string) (string, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return "", err
+	}
+
+	v := fmt.Sprintf("%v", r)
+	for _, a := range allowed {
+		if strings.EqualFold(v, a) {
+			return a, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s must be one of %s, got %s: %w", k, strings.Join(allowed, ", "), v, ErrOutOfRange)
+}
+
+// GetSeconds will get the number of whole seconds for k or return the default d if not found or invalid.
+// See LookupSeconds for the accepted values.
+func (c *C) GetSeconds(k string, d int) int {
+	v, err := c.LookupSeconds(k)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
+// LookupSeconds will get the number of whole seconds for k. The value may be a bare integer of seconds or a duration
+// string such as 30s or 2m, durations are truncated to whole seconds. ErrKeyNotFound is returned if k is not set and
+// ErrWrongType is returned if k is neither.
+func (c *C) LookupSeconds(k string) (int, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return 0, err
+	}
+
+	s := fmt.Sprintf("%v", r)
+	if v, err := strconv.Atoi(s); err == nil {
+		return v, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number of seconds or a duration, got %v: %w", k, r, ErrWrongType)
+	}
+
+	return int(d / time.Second), nil
+}
+
+// GetUint32 will get the uint32 for k or return the default d if not found or invalid
+func (c *C) GetUint32(k string, d uint32) uint32 {
+	r := c.GetInt(k, int(d))
+	if uint64(r) > uint64(math.MaxUint32) {
+		return d
+	}
 	return uint32(r)
 }
 
 // GetBool will get the bool for k or return the default d if not found or invalid
 func (c *C) GetBool(k string, d bool) bool {
-	r := strings.ToLower(c.GetString(k, fmt.Sprintf("%v", d)))
-	v, err := strconv.ParseBool(r)
+	v, err := c.LookupBool(k)
 	if err != nil {
-		switch r {
-		case "y", "yes":
-			return true
-		case "n", "no":
-			return false
-		}
 		return d
 	}
 
 	return v
 }
 
+// LookupBool will get the bool for k. In addition to the values accepted by strconv.ParseBool, y/yes/on and
+// n/no/off are accepted in any case. ErrKeyNotFound is returned if k is not set, otherwise the parse error is returned
+// if the value is not a recognized bool.
+func (c *C) LookupBool(k string) (bool, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return false, err
+	}
+
+	s := strings.ToLower(fmt.Sprintf("%v", r))
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		switch s {
+		case "y", "yes", "on":
+			return true, nil
+		case "n", "no", "off":
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", k, err)
+	}
+
+	return v, nil
+}
+
 // GetDuration will get the duration for k or return the default d if not found or invalid
 func (c *C) GetDuration(k string, d time.Duration) time.Duration {
 	r := c.GetString(k, "")
@@ -276,12 +1041,171 @@ func (c *C) GetDuration(k string, d time.Duration) time.Duration {
 	return v
 }
 
+// GetBytes will get the size in bytes for k or return the default d if not found or invalid.
+// Bare integers are treated as bytes, decimal (KB, MB, GB, TB) and binary (KiB, MiB, GiB, TiB) unit suffixes are
+// supported. The trailing B is optional, 2G and 2GB are equivalent.
+func (c *C) GetBytes(k string, d int64) int64 {
+	r := c.GetString(k, "")
+	if r == "" {
+		return d
+	}
+
+	v, err := parseBytes(r)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1000 * 1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"ti":  1 << 40,
+	"tib": 1 << 40,
+}
+
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(s)
+	}
+
+	if i == 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %q: %w", s, err)
+	}
+
+	unit := strings.ToLower(strings.TrimSpace(s[i:]))
+	mul, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+
+	if n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("size is too large: %q", s)
+	}
+
+	return n * mul, nil
+}
+
+// GetRequiredString will get the string for k. ErrRequiredKeyMissing is returned if k is not set and ErrWrongType if
+// k holds a list or a map.
+func (c *C) GetRequiredString(k string) (string, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return "", required(k, err)
+	}
+
+	switch r.(type) {
+	case []interface{}, map[interface{}]interface{}:
+		return "", fmt.Errorf("%s must be a single value, got %T: %w", k, r, ErrWrongType)
+	}
+
+	return fmt.Sprintf("%v", r), nil
+}
+
+// GetRequiredPath will get the absolute path for k, see LookupPath. ErrRequiredKeyMissing is returned if k is not set.
+func (c *C) GetRequiredPath(k string) (string, error) {
+	v, err := c.LookupPath(k)
+	return v, required(k, err)
+}
+
+// GetRequiredStringSlice will get the slice of strings for k, see LookupStringSlice. ErrRequiredKeyMissing is
+// returned if k is not set.
+func (c *C) GetRequiredStringSlice(k string) ([]string, error) {
+	v, err := c.LookupStringSlice(k)
+	return v, required(k, err)
+}
+
+// GetRequiredMap will get the map for k, see LookupMap. ErrRequiredKeyMissing is returned if k is not set.
+func (c *C) GetRequiredMap(k string) (map[interface{}]interface{}, error) {
+	v, err := c.LookupMap(k)
+	return v, required(k, err)
+}
+
+// GetRequiredInt will get the int for k, see LookupInt. ErrRequiredKeyMissing is returned if k is not set.
+func (c *C) GetRequiredInt(k string) (int, error) {
+	v, err := c.LookupInt(k)
+	return v, required(k, err)
+}
+
+// GetRequiredBool will get the bool for k, see LookupBool. ErrRequiredKeyMissing is returned if k is not set.
+func (c *C) GetRequiredBool(k string) (bool, error) {
+	v, err := c.LookupBool(k)
+	return v, required(k, err)
+}
+
+// GetRequiredDuration will get the duration for k. ErrRequiredKeyMissing is returned if k is not set, otherwise the
+// parse error is returned if the value is not a duration.
+func (c *C) GetRequiredDuration(k string) (time.Duration, error) {
+	r, err := c.Lookup(k)
+	if err != nil {
+		return 0, required(k, err)
+	}
+
+	v, err := time.ParseDuration(fmt.Sprintf("%v", r))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", k, err)
+	}
+
+	return v, nil
+}
+
+// required replaces ErrKeyNotFound with ErrRequiredKeyMissing, any other error is returned as is
+func required(k string, err error) error {
+	if errors.Is(err, ErrKeyNotFound) {
+		return fmt.Errorf("%s: %w", k, ErrRequiredKeyMissing)
+	}
+
+	return err
+}
+
 func (c *C) Get(k string) interface{} {
-	return c.get(k, c.Settings)
+	return c.read(k)
+}
+
+// Lookup will get the raw value for k, returning ErrKeyNotFound if it is not set
+func (c *C) Lookup(k string) (interface{}, error) {
+	r := c.read(k)
+	if r == nil {
+		return nil, fmt.Errorf("%s: %w", k, ErrKeyNotFound)
+	}
+
+	return r, nil
 }
 
 func (c *C) IsSet(k string) bool {
-	return c.get(k, c.Settings) != nil
+	return c.read(k) != nil
+}
+
+// read returns the value of k in the current settings and records the access when it was found, see SetTrackAccess.
+// Comparisons against the previous settings use get directly so a reload does not mark keys as used.
+func (c *C) read(k string) interface{} {
+	v := c.get(k, c.settings())
+	if v != nil {
+		c.recordAccess(k)
+	}
+	return v
 }
 
 func (c *C) get(k string, v interface{}) interface{} {
@@ -292,7 +1216,7 @@ func (c *C) get(k string, v interface{}) interface{} {
 			return nil
 		}
 
-		v, ok = m[p]
+		v, ok = mapValue(m, p)
 		if !ok {
 			return nil
 		}
@@ -301,6 +1225,33 @@ func (c *C) get(k string, v interface{}) interface{} {
 	return v
 }
 
+// mapValue returns the value at key p in m. Keys are parts of a dotted path and so always strings, but yaml decodes
+// keys that look like integers, as in ports: {8080: ...}, as ints. Those are found by their string form as well.
+func mapValue(m map[interface{}]interface{}, p string) (interface{}, bool) {
+	v, ok := m[p]
+	if ok {
+		return v, true
+	}
+
+	i, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, false
+	}
+
+	v, ok = m[i]
+	return v, ok
+}
+
+func (c *C) recordAccess(k string) {
+	if !c.trackAccess.Load() {
+		return
+	}
+
+	c.accessLock.Lock()
+	defer c.accessLock.Unlock()
+	c.accessed[k] = struct{}{}
+}
+
 // direct signifies if this is the config path directly specified by the user,
 // versus a file/dir found by recursing into that path
 func (c *C) resolve(path string, direct bool) error {
@@ -332,7 +1283,7 @@ func (c *C) resolve(path string, direct bool) error {
 func (c *C) addFile(path string, direct bool) error {
 	ext := filepath.Ext(path)
 
-	if !direct && ext != ".yaml" && ext != ".yml" {
+	if !direct && ext != ".yaml" && ext != ".yml" && ext != ".json" {
 		return nil
 	}
 
@@ -348,43 +1299,365 @@ func (c *C) addFile(path string, direct bool) error {
 func (c *C) parseRaw(b []byte) error {
 	var m map[interface{}]interface{}
 
-	err := yaml.Unmarshal(b, &m)
+	err := c.unmarshalYAML(b, &m)
+	if err != nil {
+		return err
+	}
+
+	return c.setRaw(m)
+}
+
+// setRaw replaces the settings with m, which did not come from a file
+func (c *C) setRaw(m map[interface{}]interface{}) error {
+	err := resolvePlaceholders(m, c.references)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkDurations(m)
+	if err != nil {
+		return err
+	}
+
+	err = c.validate(c, m)
 	if err != nil {
 		return err
 	}
 
 	c.Settings = m
+	c.origins = nil
 	return nil
 }
 
-func (c *C) parse() error {
+// parse reads and merges the files found by src, a temporary C holding only the source of the config. Nothing in c,
+// including where the config was loaded from, is changed unless every file loads and the result is valid.
+func (c *C) parse(src *C) error {
 	var m map[interface{}]interface{}
+	origins := make(map[string]string)
 
-	for _, path := range c.files {
-		b, err := os.ReadFile(path)
+	for _, path := range src.files {
+		nm, err := c.readFile(path, nil, origins)
 		if err != nil {
 			return err
 		}
 
-		var nm map[interface{}]interface{}
-		err = yaml.Unmarshal(b, &nm)
-		if err != nil {
-			return err
+		// Find the nulls before merging since the merge fills them in from earlier files
+		var nulls [][]interface{}
+		if c.nullDeletes {
+			nulls = nullKeys(nil, nm)
 		}
 
-		// We need to use WithAppendSlice so that firewall rules in separate
-		// files are appended together
-		err = mergo.Merge(&nm, m, mergo.WithAppendSlice)
-		m = nm
+		m, err = mergeSettings(nm, m)
 		if err != nil {
 			return err
 		}
+
+		for _, keys := range nulls {
+			deleteKey(m, keys)
+			deleteOrigins(origins, keys)
+		}
 	}
 
+	err := resolvePlaceholders(m, c.references)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkDurations(m)
+	if err != nil {
+		return err
+	}
+
+	err = c.validate(src, m)
+	if err != nil {
+		return err
+	}
+
+	c.path = src.path
+	c.glob = src.glob
+	c.profile = src.profile
+	c.files = src.files
 	c.Settings = m
+	c.origins = origins
+	c.l.WithField("files", c.files).Info("Loaded config files")
 	return nil
 }
 
+var placeholderRegex = regexp.MustCompile(`\$\{(file|env):([^}]*)\}`)
+
+// referenceRegex is placeholderRegex extended with ${dotted.key} references and the $${...} escape, see SetReferences
+var referenceRegex = regexp.MustCompile(`\$?\$\{(?:(file|env):([^}]*)|([\w.-]+))\}`)
+
+// placeholderResolver holds the state of a single resolvePlaceholders call
+type placeholderResolver struct {
+	settings map[interface{}]interface{}
+	re       *regexp.Regexp
+
+	// resolved holds the final value of every string visited so far by its dotted key
+	resolved map[string]string
+
+	// resolving holds the chain of keys currently being resolved and is used to reject reference cycles
+	resolving []string
+}
+
+// resolvePlaceholders replaces ${file:/path} and ${env:NAME} within every string value of settings, in place. Files
+// have trailing newlines removed so secrets can be mounted as is. If references is true ${dotted.key} is replaced with
+// the value of that key in settings, which may itself contain placeholders, and any placeholder can be escaped as
+// $${...}, which becomes ${...}.
+func resolvePlaceholders(settings map[interface{}]interface{}, references bool) error {
+	r := placeholderResolver{settings: settings, re: placeholderRegex, resolved: map[string]string{}}
+	if references {
+		r.re = referenceRegex
+	}
+	return r.resolve("", settings)
+}
+
+// resolve replaces the placeholders within every string value below v, k is the dotted key of v
+func (r *placeholderResolver) resolve(k string, v interface{}) error {
+	key := func(sub interface{}) string {
+		if k == "" {
+			return fmt.Sprintf("%v", sub)
+		}
+		return fmt.Sprintf("%s.%v", k, sub)
+	}
+
+	switch tv := v.(type) {
+	case map[interface{}]interface{}:
+		for mk, mv := range tv {
+			if sv, ok := mv.(string); ok {
+				rv, err := r.resolveString(key(mk), sv)
+				if err != nil {
+					return err
+				}
+				tv[mk] = rv
+				continue
+			}
+
+			err := r.resolve(key(mk), mv)
+			if err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		for i, sv := range tv {
+			if sv, ok := sv.(string); ok {
+				rv, err := r.resolveString(key(i), sv)
+				if err != nil {
+					return err
+				}
+				tv[i] = rv
+				continue
+			}
+
+			err := r.resolve(key(i), sv)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *placeholderResolver) resolveString(k string, v string) (string, error) {
+	if rv, ok := r.resolved[k]; ok {
+		return rv, nil
+	}
+
+	if slices.Contains(r.resolving, k) {
+		return "", fmt.Errorf("config reference cycle detected: %s", strings.Join(append(r.resolving, k), " -> "))
+	}
+	r.resolving = append(r.resolving, k)
+	defer func() { r.resolving = r.resolving[:len(r.resolving)-1] }()
+
+	var rErr error
+	rv := r.re.ReplaceAllStringFunc(v, func(p string) string {
+		if rErr != nil {
+			return p
+		}
+
+		if strings.HasPrefix(p, "$$") {
+			return p[1:]
+		}
+
+		parts := r.re.FindStringSubmatch(p)
+		switch parts[1] {
+		case "file":
+			b, err := os.ReadFile(parts[2])
+			if err != nil {
+				rErr = fmt.Errorf("%s: failed to read %s: %w", k, p, err)
+				return p
+			}
+			return strings.TrimRight(string(b), "\r\n")
+
+		case "env":
+			ev, ok := os.LookupEnv(parts[2])
+			if !ok {
+				rErr = fmt.Errorf("%s: environment variable %s referenced by %s is not set", k, parts[2], p)
+				return p
+			}
+			return ev
+
+		default:
+			kv, err := r.reference(k, parts[3], p)
+			if err != nil {
+				rErr = err
+				return p
+			}
+			return kv
+		}
+	})
+
+	if rErr != nil {
+		return "", rErr
+	}
+
+	r.resolved[k] = rv
+	return rv, nil
+}
+
+// reference returns the resolved value of ref, which was found in the value of k as p
+func (r *placeholderResolver) reference(k, ref, p string) (string, error) {
+	var v interface{} = r.settings
+	for _, part := range strings.Split(ref, ".") {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+
+		v, _ = mapValue(m, part)
+	}
+
+	switch tv := v.(type) {
+	case nil:
+		return "", fmt.Errorf("%s: unknown config key %s referenced by %s", k, ref, p)
+	case string:
+		return r.resolveString(ref, tv)
+	case map[interface{}]interface{}, []interface{}:
+		return "", fmt.Errorf("%s: config key %s referenced by %s is not a single value", k, ref, p)
+	default:
+		return fmt.Sprintf("%v", tv), nil
+	}
+}
+
+// readFile parses the yaml file at path along with any files listed in its top level include key. Paths in include
+// are relative to the including file. Included files are merged in order before the including file, so later includes
+// override earlier ones and the including file overrides them all. parents holds the chain of files currently being
+// read and is used to reject include cycles.
+func (c *C) readFile(path string, parents []string, origins map[string]string) (map[interface{}]interface{}, error) {
+	if slices.Contains(parents, path) {
+		return nil, fmt.Errorf("config include cycle detected: %s", strings.Join(append(parents, path), " -> "))
+	}
+	parents = append(parents, path)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var nm map[interface{}]interface{}
+	if filepath.Ext(path) == ".json" {
+		nm, err = unmarshalJSON(b)
+	} else {
+		err = c.unmarshalYAML(b, &nm)
+	}
+	if err != nil {
+		return nil, parseError(path, b, err)
+	}
+
+	rawIncludes, ok := nm["include"]
+	if !ok {
+		recordOrigins(origins, path, nm)
+		return nm, nil
+	}
+	delete(nm, "include")
+
+	includes, ok := rawIncludes.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("include in %s must be a list of paths, got %T", path, rawIncludes)
+	}
+
+	var m map[interface{}]interface{}
+	for _, inc := range includes {
+		incPath := fmt.Sprintf("%v", inc)
+		if !filepath.IsAbs(incPath) {
+			incPath = filepath.Join(filepath.Dir(path), incPath)
+		}
+
+		im, err := c.readFile(filepath.Clean(incPath), parents, origins)
+		if err != nil {
+			return nil, fmt.Errorf("problem while including %s from %s: %w", incPath, path, err)
+		}
+
+		m, err = mergeSettings(im, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recordOrigins(origins, path, nm)
+	return mergeSettings(nm, m)
+}
+
+// recordOrigins marks path as the origin of every key in m, replacing the origin from any earlier file
+func recordOrigins(origins map[string]string, path string, m map[interface{}]interface{}) {
+	for _, k := range flattenKeys("", m) {
+		origins[k] = path
+	}
+}
+
+// mergeSettings merges prev into next, values in next take precedence
+func mergeSettings(next, prev map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	// We need to use WithAppendSlice so that firewall rules in separate
+	// files are appended together
+	err := mergo.Merge(&next, prev, mergo.WithAppendSlice)
+	return next, err
+}
+
+// nullKeys returns the key path of every explicit null within m, prefix is the path to m
+func nullKeys(prefix []interface{}, m map[interface{}]interface{}) [][]interface{} {
+	var out [][]interface{}
+	for k, v := range m {
+		keys := append(slices.Clip(prefix), k)
+		switch vv := v.(type) {
+		case nil:
+			out = append(out, keys)
+		case map[interface{}]interface{}:
+			out = append(out, nullKeys(keys, vv)...)
+		}
+	}
+	return out
+}
+
+// deleteKey removes the value at the key path keys from m, if it is present
+func deleteKey(m map[interface{}]interface{}, keys []interface{}) {
+	for _, k := range keys[:len(keys)-1] {
+		var ok bool
+		m, ok = m[k].(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+	}
+	delete(m, keys[len(keys)-1])
+}
+
+// deleteOrigins removes the origin of the key path keys and of every key below it
+func deleteOrigins(origins map[string]string, keys []interface{}) {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%v", k)
+	}
+	key := strings.Join(parts, ".")
+
+	for k := range origins {
+		if k == key || strings.HasPrefix(k, key+".") {
+			delete(origins, k)
+		}
+	}
+}
+
 func readDirNames(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -400,3 +1673,76 @@ func readDirNames(path string) ([]string, error) {
 	sort.Strings(paths)
 	return paths, nil
 }
+
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// parseError names the file that failed to parse along with the line of the problem, when it can be found. yaml only
+// reports lines within the error text while json reports a byte offset into b.
+func parseError(path string, b []byte, err error) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return fmt.Errorf("error in %s line %d: %w", path, bytes.Count(b[:se.Offset], []byte("\n"))+1, err)
+	}
+
+	if m := yamlLineRegex.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("error in %s line %s: %w", path, m[1], err)
+	}
+
+	return fmt.Errorf("error in %s: %w", path, err)
+}
+
+// unmarshalYAML decodes b into out, honoring SetStrict
+func (c *C) unmarshalYAML(b []byte, out interface{}) error {
+	if c.strict {
+		return yaml.UnmarshalStrict(b, out)
+	}
+	return yaml.Unmarshal(b, out)
+}
+
+// unmarshalJSON decodes a JSON object into the same shape yaml produces, maps keyed by interface{} and whole numbers
+// as int, so JSON and YAML configs can be merged and read the same way.
+func unmarshalJSON(b []byte) (map[interface{}]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		return nil, nil
+	}
+
+	m, ok := normalizeJSON(v).(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("json config must be an object, got %T", v)
+	}
+
+	return m, nil
+}
+
+func normalizeJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			out[k] = normalizeJSON(v)
+		}
+		return out
+	case []interface{}:
+		for i, v := range t {
+			t[i] = normalizeJSON(v)
+		}
+		return t
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := t.Float64()
+		return f
+	default:
+		return v
+	}
+}
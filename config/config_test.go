@@ -1,8 +1,12 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
@@ -19,7 +23,7 @@ func TestConfig_Load(t *testing.T) {
 	// invalid yaml
 	c := NewC(l)
 	os.WriteFile(filepath.Join(dir, "01.yaml"), []byte(" invalid yaml"), 0644)
-	assert.EqualError(t, c.Load(dir), "yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into map[interface {}]interface {}")
+	assert.EqualError(t, c.Load(dir), "error in "+filepath.Join(dir, "01.yaml")+" line 1: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into map[interface {}]interface {}")
 
 	// simple multi config merge
 	c = NewC(l)
@@ -43,6 +47,444 @@ func TestConfig_Load(t *testing.T) {
 	//TODO: test symlinked directory
 }
 
+func TestConfig_LoadedFiles(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.yml"), []byte("b: 2\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yaml"), []byte("a: 1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not config\n"), 0644))
+
+	c := NewC(l)
+	assert.Empty(t, c.LoadedFiles())
+	require.NoError(t, c.Load(dir))
+	files := c.LoadedFiles()
+	assert.Equal(t, []string{filepath.Join(dir, "01.yaml"), filepath.Join(dir, "02.yml")}, files)
+
+	// The result is a copy
+	files[0] = "nope"
+	assert.Equal(t, filepath.Join(dir, "01.yaml"), c.LoadedFiles()[0])
+}
+
+func TestConfig_LoadParseError(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yaml"), []byte("listen:\n  port: 4242\n"), 0644))
+	bad := filepath.Join(dir, "02.yaml")
+	require.NoError(t, os.WriteFile(bad, []byte("firewall:\n  inbound:\n    - port: any\n   proto: any\n"), 0644))
+
+	c := NewC(l)
+	err = c.Load(dir)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "error in "+bad+" line 3: yaml: line 3:")
+
+	bad = filepath.Join(dir, "02.json")
+	require.NoError(t, os.Remove(filepath.Join(dir, "02.yaml")))
+	require.NoError(t, os.WriteFile(bad, []byte("{\n  \"listen\": {\n    \"port\": 4242,\n  }\n}\n"), 0644))
+
+	c = NewC(l)
+	err = c.Load(dir)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "error in "+bad+" line 4: invalid character")
+}
+
+func TestConfig_Origin(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "01.yml")
+	second := filepath.Join(dir, "02.yml")
+	included := filepath.Join(dir, "inc.yaml.part")
+	require.NoError(t, os.WriteFile(first, []byte("outer:\n  inner: hi\n  kept: yes\nlist: [a]\n"), 0644))
+	require.NoError(t, os.WriteFile(second, []byte("include: [inc.yaml.part]\nouter:\n  inner: override\nlist: [b]\n"), 0644))
+	require.NoError(t, os.WriteFile(included, []byte("from_include: true\n"), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.Load(dir))
+
+	origin, ok := c.Origin("outer.inner")
+	assert.True(t, ok)
+	assert.Equal(t, second, origin)
+
+	origin, ok = c.Origin("outer.kept")
+	assert.True(t, ok)
+	assert.Equal(t, first, origin)
+
+	origin, ok = c.Origin("list")
+	assert.True(t, ok)
+	assert.Equal(t, second, origin)
+
+	origin, ok = c.Origin("from_include")
+	assert.True(t, ok)
+	assert.Equal(t, included, origin)
+
+	_, ok = c.Origin("missing")
+	assert.False(t, ok)
+
+	// Overrides do not come from a file
+	c.SetOverride("outer", map[interface{}]interface{}{"inner": "set"})
+	_, ok = c.Origin("outer.inner")
+	assert.False(t, ok)
+
+	// Strings have no origin
+	c.ClearOverride("outer")
+	require.NoError(t, c.LoadString("outer:\n  inner: hi\n"))
+	_, ok = c.Origin("outer.inner")
+	assert.False(t, ok)
+}
+
+func TestConfig_LoadJSON(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yml"), []byte("outer:\n  inner: hi\n  kept: 1\nlist: [a]\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.json"), []byte("{\n\t\"outer\": {\"inner\": \"override\", \"ratio\": 0.5},\n\t\"list\": [\"b\"],\n\t\"port\": 4242\n}"), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.Load(dir))
+	expected := map[interface{}]interface{}{
+		"outer": map[interface{}]interface{}{
+			"inner": "override",
+			"kept":  1,
+			"ratio": 0.5,
+		},
+		"list": []interface{}{"b", "a"},
+		"port": 4242,
+	}
+	assert.Equal(t, expected, c.Settings)
+	assert.Equal(t, 4242, c.GetInt("port", 0))
+
+	require.NoError(t, c.LoadJSONString(`{"tun": {"mtu": 1300}}`))
+	assert.Equal(t, 1300, c.GetInt("tun.mtu", 0))
+
+	assert.EqualError(t, c.LoadJSONString(`["not", "an", "object"]`), "json config must be an object, got []interface {}")
+	assert.Error(t, c.LoadJSONString(`{"broken":`))
+}
+
+func TestConfig_LoadGlob(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+
+	c := NewC(l)
+	assert.EqualError(t, c.LoadGlob(filepath.Join(dir, "*.yaml")), "no config files found matching "+filepath.Join(dir, "*.yaml"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yaml"), []byte("outer:\n  inner: hi\nlist: [a]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.yaml"), []byte("outer:\n  inner: override\nlist: [b]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.yaml.bak"), []byte("outer:\n  inner: stale"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "03.yaml"), 0755))
+
+	require.NoError(t, c.LoadGlob(filepath.Join(dir, "*.yaml")))
+	assert.Equal(t, map[interface{}]interface{}{
+		"outer": map[interface{}]interface{}{
+			"inner": "override",
+		},
+		"list": []interface{}{"b", "a"},
+	}, c.Settings)
+
+	// A reload evaluates the glob again
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "04.yaml"), []byte("new: hi"), 0644))
+	c.ReloadConfig()
+	assert.Equal(t, "hi", c.GetString("new", ""))
+	assert.Equal(t, "override", c.GetString("outer.inner", ""))
+
+	assert.Error(t, c.LoadGlob("[bad"))
+}
+
+func TestConfig_LoadInclude(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "main"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "inc"), 0755))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "inc", "a.yml"), []byte("outer:\n  a: a\n  both: a\nlist: [a]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "inc", "b.yml"), []byte("outer:\n  b: b\n  both: b\nlist: [b]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main", "main.yml"), []byte("include: [../inc/a.yml, ../inc/b.yml]\nouter:\n  main: main\nlist: [main]"), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.Load(filepath.Join(dir, "main")))
+	assert.Equal(t, map[interface{}]interface{}{
+		"outer": map[interface{}]interface{}{
+			"a":    "a",
+			"b":    "b",
+			"both": "b",
+			"main": "main",
+		},
+		"list": []interface{}{"main", "b", "a"},
+	}, c.Settings)
+
+	// Including yourself is a cycle
+	self := filepath.Join(dir, "self.yml")
+	require.NoError(t, os.WriteFile(self, []byte("include: [self.yml]\nhi: there"), 0644))
+	c = NewC(l)
+	err := c.Load(self)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "config include cycle detected")
+
+	// As is a longer chain back to the start
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "inc", "a.yml"), []byte("include: [../main/main.yml]"), 0644))
+	c = NewC(l)
+	err = c.Load(filepath.Join(dir, "main"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "config include cycle detected")
+
+	// include must be a list
+	require.NoError(t, os.WriteFile(self, []byte("include: nope"), 0644))
+	c = NewC(l)
+	assert.EqualError(t, c.Load(self), "include in "+self+" must be a list of paths, got string")
+}
+
+func TestConfig_RequireDurations(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.RequireDurations("timeout", "nested.interval", "unset")
+
+	assert.EqualError(t, c.LoadString("timeout: 30\nnested:\n  interval: 5s\n"), "timeout: 30 is not a valid duration, a unit such as s or ms is required")
+	assert.EqualError(t, c.LoadString("timeout: 30s\nnested:\n  interval: soon\n"), "nested.interval: soon is not a valid duration, a unit such as s or ms is required")
+
+	require.NoError(t, c.LoadString("timeout: 30s\nnested:\n  interval: 5s\n"))
+	assert.Equal(t, 30*time.Second, c.GetDuration("timeout", 0))
+
+	// A reload that introduces a bad value is rejected and the previous settings are kept
+	require.Error(t, c.ReloadConfigString("timeout: 30\n"))
+	assert.Equal(t, 30*time.Second, c.GetDuration("timeout", 0))
+}
+
+func TestConfig_Strict(t *testing.T) {
+	l := test.NewLogger()
+	raw := "outer:\n  inner: first\n  inner: second\n"
+
+	// Lenient by default, the last value wins
+	c := NewC(l)
+	require.NoError(t, c.LoadString(raw))
+	assert.Equal(t, "second", c.GetString("outer.inner", ""))
+
+	c = NewC(l)
+	c.SetStrict(true)
+	err := c.LoadString(raw)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `key "inner" already set in map`)
+
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yml"), []byte(raw), 0644))
+	assert.Error(t, c.Load(dir))
+}
+
+func TestConfig_LoadProfile(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base.yaml"), []byte("listen:\n  host: 0.0.0.0\n  port: 4242\nlogging:\n  level: info\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prod.yaml"), []byte("listen:\n  port: 4243\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "staging.yaml"), []byte("logging:\n  level: debug\n"), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.LoadProfile(dir, "prod"))
+	assert.Equal(t, 4243, c.GetInt("listen.port", 0))
+	assert.Equal(t, "0.0.0.0", c.GetString("listen.host", ""))
+	assert.Equal(t, "info", c.GetString("logging.level", ""))
+
+	// A missing profile only loads the base
+	require.NoError(t, c.LoadProfile(dir, "dev"))
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+
+	// A reload keeps the profile
+	require.NoError(t, c.LoadProfile(dir, "staging"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "staging.yaml"), []byte("logging:\n  level: warning\n"), 0644))
+	c.ReloadConfig()
+	assert.Equal(t, "warning", c.GetString("logging.level", ""))
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+
+	assert.Error(t, c.LoadProfile(dir, "../prod"))
+	assert.Error(t, c.LoadProfile(filepath.Join(dir, "missing"), "prod"))
+}
+
+func TestConfig_NullDeletes(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yml"), []byte("outer:\n  inner: hi\n  kept: ok\nremoved:\n  deep: 1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.yml"), []byte("outer:\n  inner: null\nremoved: ~\n"), 0644))
+
+	// By default a null leaves the earlier value in place
+	c := NewC(l)
+	require.NoError(t, c.Load(dir))
+	assert.Equal(t, "hi", c.GetString("outer.inner", ""))
+	assert.Equal(t, 1, c.GetInt("removed.deep", 0))
+
+	c = NewC(l)
+	c.SetNullDeletes(true)
+	require.NoError(t, c.Load(dir))
+	assert.False(t, c.IsSet("outer.inner"))
+	assert.False(t, c.IsSet("removed"))
+	assert.Equal(t, "ok", c.GetString("outer.kept", ""))
+
+	_, ok := c.Origin("removed.deep")
+	assert.False(t, ok)
+}
+
+func TestConfig_RegisterValidator(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.RegisterValidator(func(c *C) error {
+		if c.GetInt("listen.port", 0) <= 0 {
+			return errors.New("listen.port must be set")
+		}
+		return nil
+	})
+
+	called := false
+	c.RegisterReloadCallback(func(c *C) {
+		called = true
+	})
+
+	assert.EqualError(t, c.LoadString("listen:\n  host: 0.0.0.0\n"), "listen.port must be set")
+	require.NoError(t, c.LoadString("listen:\n  port: 4242\n"))
+
+	// An invalid reload leaves the running config intact and does not reach the callbacks
+	assert.EqualError(t, c.ReloadConfigString("listen:\n  port: 0\n"), "listen.port must be set")
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+	assert.False(t, called)
+
+	require.NoError(t, c.ReloadConfigString("listen:\n  port: 4243\n"))
+	assert.Equal(t, 4243, c.GetInt("listen.port", 0))
+	assert.True(t, called)
+
+	// A rejected reload from disk keeps the files the running config came from
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yml"), []byte("listen:\n  port: 4242\n"), 0644))
+	c = NewC(l)
+	c.RegisterValidator(func(c *C) error {
+		if c.GetInt("listen.port", 0) <= 0 {
+			return errors.New("listen.port must be set")
+		}
+		return nil
+	})
+	require.NoError(t, c.Load(dir))
+	files := c.LoadedFiles()
+	origin, ok := c.Origin("listen.port")
+	require.True(t, ok)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.yml"), []byte("listen:\n  port: -1\n"), 0644))
+	c.ReloadConfig()
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+	assert.Equal(t, files, c.LoadedFiles())
+	newOrigin, ok := c.Origin("listen.port")
+	assert.True(t, ok)
+	assert.Equal(t, origin, newOrigin)
+
+	// A rejected load of a different path leaves the path alone as well
+	other := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(other, "01.yml"), []byte("listen:\n  port: 0\n"), 0644))
+	assert.EqualError(t, c.Load(other), "listen.port must be set")
+	assert.Equal(t, files, c.LoadedFiles())
+	assert.Equal(t, dir, c.dir())
+}
+
+func TestConfig_LoadPlaceholders(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "psk")
+	require.NoError(t, os.WriteFile(secret, []byte("hunter2\n"), 0600))
+	t.Setenv("NEBULA_CONFIG_TEST_SECRET", "sekrit")
+
+	c := NewC(l)
+	require.NoError(t, c.LoadString("psk: ${file:"+secret+"}\nnested:\n  list:\n    - ${env:NEBULA_CONFIG_TEST_SECRET}\n    - a-${env:NEBULA_CONFIG_TEST_SECRET}-b\nplain: ${nope}\n"))
+	assert.Equal(t, "hunter2", c.GetString("psk", ""))
+	assert.Equal(t, []string{"sekrit", "a-sekrit-b"}, c.GetStringSlice("nested.list", nil))
+	assert.Equal(t, "${nope}", c.GetString("plain", ""))
+
+	// The same applies to files loaded from disk
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yml"), []byte("psk: ${file:"+secret+"}\n"), 0644))
+	c = NewC(l)
+	require.NoError(t, c.Load(filepath.Join(dir, "01.yml")))
+	assert.Equal(t, "hunter2", c.GetString("psk", ""))
+
+	missing := filepath.Join(dir, "missing")
+	c = NewC(l)
+	err = c.LoadString("outer:\n  psk: ${file:" + missing + "}\n")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorContains(t, err, "outer.psk: failed to read ${file:"+missing+"}")
+
+	c = NewC(l)
+	err = c.LoadString("psk: ${env:NEBULA_CONFIG_TEST_UNSET}\n")
+	assert.EqualError(t, err, "psk: environment variable NEBULA_CONFIG_TEST_UNSET referenced by ${env:NEBULA_CONFIG_TEST_UNSET} is not set")
+}
+
+func TestConfig_LoadReferences(t *testing.T) {
+	l := test.NewLogger()
+	t.Setenv("NEBULA_CONFIG_TEST_DIR", "/etc/nebula")
+
+	// References are left alone unless enabled
+	c := NewC(l)
+	require.NoError(t, c.LoadString("base_dir: /etc/nebula\ncert: ${base_dir}/host.crt\nscript: $${x}\n"))
+	assert.Equal(t, "${base_dir}/host.crt", c.GetString("cert", ""))
+	assert.Equal(t, "$${x}", c.GetString("script", ""))
+
+	newC := func() *C {
+		c := NewC(l)
+		c.SetReferences(true)
+		return c
+	}
+
+	c = newC()
+	require.NoError(t, c.LoadString(`
+base_dir: ${env:NEBULA_CONFIG_TEST_DIR}
+pki:
+  ca: ${base_dir}/ca.crt
+  cert: ${pki.dir}/host.crt
+  dir: ${base_dir}/pki
+listen:
+  port: 4242
+lighthouse:
+  hosts:
+    - 192.168.100.1:${listen.port}
+`))
+	assert.Equal(t, "/etc/nebula/ca.crt", c.GetString("pki.ca", ""))
+	assert.Equal(t, "/etc/nebula/pki/host.crt", c.GetString("pki.cert", ""))
+	assert.Equal(t, []string{"192.168.100.1:4242"}, c.GetStringSlice("lighthouse.hosts", nil))
+
+	// $${...} escapes any placeholder
+	c = newC()
+	require.NoError(t, c.LoadString("listen:\n  port: 4242\nscript: echo $${listen.port} $${env:HOME} ${listen.port}\nplain: $$x $5\n"))
+	assert.Equal(t, "echo ${listen.port} ${env:HOME} 4242", c.GetString("script", ""))
+	assert.Equal(t, "$$x $5", c.GetString("plain", ""))
+
+	c = newC()
+	err := c.LoadString("pki:\n  cert: ${pki}/host.crt\n")
+	assert.EqualError(t, err, "pki.cert: config key pki referenced by ${pki} is not a single value")
+
+	c = newC()
+	err = c.LoadString("cert: ${base_dirr}/host.crt\nbase_dir: /etc/nebula\n")
+	assert.EqualError(t, err, "cert: unknown config key base_dirr referenced by ${base_dirr}")
+
+	c = newC()
+	err = c.LoadString("a: ${a}\n")
+	assert.EqualError(t, err, "config reference cycle detected: a -> a")
+
+	c = newC()
+	err = c.LoadString("a: ${b}\nb: x-${a}\n")
+	require.Error(t, err)
+	assert.Regexp(t, `^config reference cycle detected: (a -> b -> a|b -> a -> b)$`, err.Error())
+}
+
 func TestConfig_Get(t *testing.T) {
 	l := test.NewLogger()
 	// test simple type
@@ -64,6 +506,322 @@ func TestConfig_GetStringSlice(t *testing.T) {
 	c := NewC(l)
 	c.Settings["slice"] = []interface{}{"one", "two"}
 	assert.Equal(t, []string{"one", "two"}, c.GetStringSlice("slice", []string{}))
+
+	// Blank entries are dropped and whitespace is trimmed
+	require.NoError(t, c.LoadString("slice:\n  - ' one'\n  -\n  - ''\n  - 'two  '\n"))
+	assert.Equal(t, []string{"one", "two"}, c.GetStringSlice("slice", []string{}))
+
+	// A string is split on commas
+	c.Settings["slice"] = "a, b ,c,"
+	assert.Equal(t, []string{"a", "b", "c"}, c.GetStringSlice("slice", []string{}))
+
+	c.Settings["slice"] = 1
+	assert.Equal(t, []string{"default"}, c.GetStringSlice("slice", []string{"default"}))
+}
+
+func TestConfig_Lookup(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["slice"] = []interface{}{"one", "two"}
+	c.Settings["map"] = map[interface{}]interface{}{"one": "two"}
+	c.Settings["string"] = "hi"
+
+	v, err := c.LookupStringSlice("slice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one", "two"}, v)
+
+	_, err = c.LookupStringSlice("nope")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	_, err = c.LookupStringSlice("string")
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	m, err := c.LookupMap("map")
+	require.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"one": "two"}, m)
+
+	_, err = c.LookupMap("map.nope")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	_, err = c.LookupMap("slice")
+	assert.ErrorIs(t, err, ErrWrongType)
+}
+
+func TestConfig_GetRequired(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["pki"] = map[interface{}]interface{}{"ca": "/etc/nebula/ca.crt", "disconnect_invalid": "yes"}
+	c.Settings["listen"] = map[interface{}]interface{}{"port": 4242, "host": []interface{}{"0.0.0.0"}}
+	c.Settings["timers"] = map[interface{}]interface{}{"wait": "5s"}
+
+	s, err := c.GetRequiredString("pki.ca")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/nebula/ca.crt", s)
+
+	i, err := c.GetRequiredInt("listen.port")
+	require.NoError(t, err)
+	assert.Equal(t, 4242, i)
+
+	b, err := c.GetRequiredBool("pki.disconnect_invalid")
+	require.NoError(t, err)
+	assert.True(t, b)
+
+	d, err := c.GetRequiredDuration("timers.wait")
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, d)
+
+	ss, err := c.GetRequiredStringSlice("listen.host")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0"}, ss)
+
+	m, err := c.GetRequiredMap("pki")
+	require.NoError(t, err)
+	assert.Len(t, m, 2)
+
+	// A missing key is named in the error
+	_, err = c.GetRequiredString("pki.cert")
+	assert.ErrorIs(t, err, ErrRequiredKeyMissing)
+	assert.NotErrorIs(t, err, ErrKeyNotFound)
+	assert.EqualError(t, err, "pki.cert: required key is missing")
+
+	_, err = c.GetRequiredInt("listen.batch")
+	assert.ErrorIs(t, err, ErrRequiredKeyMissing)
+
+	_, err = c.GetRequiredPath("pki.key")
+	assert.ErrorIs(t, err, ErrRequiredKeyMissing)
+
+	_, err = c.GetRequiredDuration("timers.nope")
+	assert.EqualError(t, err, "timers.nope: required key is missing")
+
+	// A key that is present but holds the wrong type is not reported as missing
+	_, err = c.GetRequiredString("listen.host")
+	assert.ErrorIs(t, err, ErrWrongType)
+	assert.NotErrorIs(t, err, ErrRequiredKeyMissing)
+
+	_, err = c.GetRequiredInt("pki.ca")
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	_, err = c.GetRequiredMap("listen.port")
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	_, err = c.GetRequiredDuration("listen.port")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRequiredKeyMissing)
+}
+
+func TestConfig_LookupIntInRange(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["port"] = 4242
+	c.Settings["mtu"] = "9001"
+	c.Settings["retries"] = -1
+	c.Settings["name"] = "hi"
+
+	v, err := c.LookupIntInRange("port", 0, 65535)
+	require.NoError(t, err)
+	assert.Equal(t, 4242, v)
+
+	_, err = c.LookupIntInRange("mtu", 576, 9000)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	assert.EqualError(t, err, "mtu must be between 576 and 9000, got 9001: out of range")
+
+	_, err = c.LookupIntInRange("retries", 0, 20)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	assert.EqualError(t, err, "retries must be between 0 and 20, got -1: out of range")
+
+	// The bounds are inclusive
+	v, err = c.LookupIntInRange("port", 4242, 4242)
+	require.NoError(t, err)
+	assert.Equal(t, 4242, v)
+
+	_, err = c.LookupIntInRange("name", 0, 1)
+	assert.ErrorIs(t, err, ErrWrongType)
+
+	_, err = c.LookupIntInRange("nope", 0, 1)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestConfig_LookupPath(t *testing.T) {
+	l := test.NewLogger()
+	dir, err := os.MkdirTemp("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.Abs(dir)
+	require.NoError(t, err)
+
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, os.WriteFile(configFile, []byte("cert: host.crt\nnested: ../ca.crt\nabs: /etc/nebula/key\n"), 0644))
+
+	// Both a directory and a single file resolve against the same directory
+	for _, path := range []string{dir, configFile} {
+		c := NewC(l)
+		require.NoError(t, c.Load(path))
+
+		v, err := c.LookupPath("cert")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "host.crt"), v)
+
+		v, err = c.LookupPath("nested")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(filepath.Dir(dir), "ca.crt"), v)
+
+		// Absolute paths are unchanged
+		v, err = c.LookupPath("abs")
+		require.NoError(t, err)
+		assert.Equal(t, "/etc/nebula/key", v)
+
+		_, err = c.LookupPath("nope")
+		assert.ErrorIs(t, err, ErrKeyNotFound)
+		assert.Equal(t, "default", c.GetPath("nope", "default"))
+	}
+
+	// A glob resolves against the directory of the pattern
+	c := NewC(l)
+	require.NoError(t, c.LoadGlob(filepath.Join(dir, "*.yml")))
+	assert.Equal(t, filepath.Join(dir, "host.crt"), c.GetPath("cert", ""))
+
+	// A string resolves against the working directory
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	c = NewC(l)
+	require.NoError(t, c.LoadString("cert: host.crt"))
+	assert.Equal(t, filepath.Join(wd, "host.crt"), c.GetPath("cert", ""))
+}
+
+func TestConfig_NumericKeys(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("ports:\n  8080:\n    proto: tcp\n  \"9090\": udp\n"))
+
+	assert.Equal(t, "tcp", c.GetString("ports.8080.proto", ""))
+	assert.True(t, c.IsSet("ports.8080"))
+	assert.Equal(t, "udp", c.GetString("ports.9090", ""))
+	assert.False(t, c.IsSet("ports.80"))
+}
+
+func TestConfig_LookupListenAddr(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString(`
+v4:
+  host: 10.1.1.1
+  port: 4242
+v6:
+  host: "[::]"
+  port: 4243
+v6bare:
+  host: "fd00::1"
+noport:
+  host: 0.0.0.0
+badhost:
+  host: nebula.example
+badport:
+  port: 70000
+`))
+
+	v, err := c.LookupListenAddr("v4")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("10.1.1.1:4242"), v)
+
+	v, err = c.LookupListenAddr("v6")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[::]:4243"), v)
+
+	v, err = c.LookupListenAddr("v6bare")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("[fd00::1]:0"), v)
+
+	// A missing port lets the system choose
+	v, err = c.LookupListenAddr("noport")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("0.0.0.0:0"), v)
+
+	// Nothing set at all listens everywhere
+	v, err = c.LookupListenAddr("missing")
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("0.0.0.0:0"), v)
+
+	_, err = c.LookupListenAddr("badhost")
+	assert.ErrorIs(t, err, ErrWrongType)
+	assert.EqualError(t, err, "badhost.host must be an ip address, got nebula.example: wrong type")
+
+	_, err = c.LookupListenAddr("badport")
+	assert.ErrorIs(t, err, ErrOutOfRange)
+
+	d := netip.MustParseAddrPort("127.0.0.1:1")
+	assert.Equal(t, d, c.GetListenAddr("badport", d))
+}
+
+func TestConfig_LookupEnum(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["format"] = "json"
+	c.Settings["shouty"] = "JSON"
+	c.Settings["bad"] = "xml"
+
+	allowed := []string{"text", "json"}
+	v, err := c.LookupEnum("format", allowed)
+	require.NoError(t, err)
+	assert.Equal(t, "json", v)
+
+	// Case is ignored and the allowed spelling is returned
+	v, err = c.LookupEnum("shouty", allowed)
+	require.NoError(t, err)
+	assert.Equal(t, "json", v)
+
+	_, err = c.LookupEnum("bad", allowed)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	assert.EqualError(t, err, "bad must be one of text, json, got xml: out of range")
+
+	_, err = c.LookupEnum("nope", allowed)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestConfig_LookupStringMapStringSlice(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("groups:\n  admins: [alice, bob]\n  1: [2]\n  empty: []\nbad:\n  admins: alice\n"))
+
+	v, err := c.LookupStringMapStringSlice("groups")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"admins": {"alice", "bob"}, "1": {"2"}, "empty": {}}, v)
+
+	_, err = c.LookupStringMapStringSlice("bad")
+	assert.ErrorIs(t, err, ErrWrongType)
+	assert.EqualError(t, err, "bad.admins must be a list, got string: wrong type")
+
+	_, err = c.LookupStringMapStringSlice("nope")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	d := map[string][]string{"default": {"x"}}
+	assert.Equal(t, d, c.GetStringMapStringSlice("bad", d))
+	assert.Equal(t, v, c.GetStringMapStringSlice("groups", d))
+}
+
+func TestConfig_LookupSeconds(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["int"] = 30
+	c.Settings["string"] = "30"
+	c.Settings["seconds"] = "30s"
+	c.Settings["minutes"] = "2m"
+	c.Settings["fraction"] = "1500ms"
+	c.Settings["bad"] = "30 seconds"
+
+	for k, expected := range map[string]int{"int": 30, "string": 30, "seconds": 30, "minutes": 120, "fraction": 1} {
+		v, err := c.LookupSeconds(k)
+		require.NoError(t, err, k)
+		assert.Equal(t, expected, v, k)
+	}
+
+	_, err := c.LookupSeconds("bad")
+	assert.ErrorIs(t, err, ErrWrongType)
+	assert.Equal(t, 5, c.GetSeconds("bad", 5))
+
+	_, err = c.LookupSeconds("nope")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Equal(t, 5, c.GetSeconds("nope", 5))
+	assert.Equal(t, 120, c.GetSeconds("minutes", 5))
 }
 
 func TestConfig_GetBool(t *testing.T) {
@@ -92,6 +850,67 @@ func TestConfig_GetBool(t *testing.T) {
 
 	c.Settings["bool"] = "nO"
 	assert.Equal(t, false, c.GetBool("bool", true))
+
+	c.Settings["bool"] = "on"
+	assert.Equal(t, true, c.GetBool("bool", false))
+
+	c.Settings["bool"] = "OFF"
+	assert.Equal(t, false, c.GetBool("bool", true))
+
+	c.Settings["bool"] = "yes"
+	assert.Equal(t, true, c.GetBool("bool", false))
+
+	c.Settings["bool"] = 0
+	assert.Equal(t, false, c.GetBool("bool", true))
+
+	c.Settings["bool"] = "1"
+	assert.Equal(t, true, c.GetBool("bool", false))
+
+	c.Settings["bool"] = "maybe"
+	assert.Equal(t, true, c.GetBool("bool", true))
+	_, err := c.LookupBool("bool")
+	var numErr *strconv.NumError
+	assert.ErrorAs(t, err, &numErr)
+
+	_, err = c.LookupBool("nope")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestConfig_GetBytes(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.Settings["size"] = 1024
+	assert.Equal(t, int64(1024), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "1024"
+	assert.Equal(t, int64(1024), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "1KiB"
+	assert.Equal(t, int64(1024), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "1KB"
+	assert.Equal(t, int64(1000), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "4MiB"
+	assert.Equal(t, int64(4*1024*1024), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "2G"
+	assert.Equal(t, int64(2*1000*1000*1000), c.GetBytes("size", 0))
+
+	c.Settings["size"] = "2 gib"
+	assert.Equal(t, int64(2*1024*1024*1024), c.GetBytes("size", 0))
+
+	// Invalid values return the default
+	c.Settings["size"] = "1XB"
+	assert.Equal(t, int64(5), c.GetBytes("size", 5))
+
+	c.Settings["size"] = "KB"
+	assert.Equal(t, int64(5), c.GetBytes("size", 5))
+
+	c.Settings["size"] = "99999999999TB"
+	assert.Equal(t, int64(5), c.GetBytes("size", 5))
+
+	assert.Equal(t, int64(5), c.GetBytes("nope", 5))
 }
 
 func TestConfig_HasChanged(t *testing.T) {
@@ -116,6 +935,32 @@ func TestConfig_HasChanged(t *testing.T) {
 	assert.False(t, c.HasChanged(""))
 }
 
+func TestConfig_IgnoreKeys(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	c.IgnoreKeys("_generated_at", "meta.build")
+	require.NoError(t, c.LoadString("_generated_at: 2024-01-01T00:00:00Z\nmeta:\n  build: 1\n  owner: ops\nlisten:\n  port: 4242\n"))
+	require.NoError(t, c.ReloadConfigString("_generated_at: 2024-01-02T00:00:00Z\nmeta:\n  build: 2\n  owner: ops\nlisten:\n  port: 4242\n"))
+
+	// A change limited to ignored keys is not reported
+	assert.False(t, c.HasChanged(""))
+	assert.False(t, c.HasChanged("_generated_at"))
+	assert.False(t, c.HasChanged("meta"))
+	assert.False(t, c.HasChanged("meta.build"))
+	assert.False(t, c.HasChanged("listen"))
+
+	// The ignored keys are still readable and the settings are untouched
+	assert.Equal(t, "2024-01-02T00:00:00Z", c.GetString("_generated_at", ""))
+	assert.Equal(t, 2, c.GetInt("meta.build", 0))
+
+	// Anything else is reported as usual
+	require.NoError(t, c.ReloadConfigString("_generated_at: 2024-01-03T00:00:00Z\nmeta:\n  build: 3\n  owner: dev\nlisten:\n  port: 4242\n"))
+	assert.True(t, c.HasChanged(""))
+	assert.True(t, c.HasChanged("meta"))
+	assert.True(t, c.HasChanged("meta.owner"))
+	assert.False(t, c.HasChanged("listen"))
+}
+
 func TestConfig_ReloadConfig(t *testing.T) {
 	l := test.NewLogger()
 	done := make(chan bool, 1)
@@ -150,6 +995,211 @@ func TestConfig_ReloadConfig(t *testing.T) {
 
 }
 
+func TestConfig_ReloadConfigNested(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("firewall:\n  outbound:\n    - port: any\n      proto: any\n      host: any\n"))
+
+	// Simulate a reload that writes into the existing nested maps instead of replacing them
+	c.snapshotSettings()
+	fw := c.GetMap("firewall", nil)
+	fw["outbound"].([]interface{})[0].(map[interface{}]interface{})["port"] = 443
+	fw["inbound"] = []interface{}{}
+
+	assert.True(t, c.HasChanged("firewall"))
+	assert.True(t, c.HasChanged("firewall.outbound"))
+	assert.True(t, c.HasChanged(""))
+	assert.Equal(t, "any", c.get("firewall.outbound", c.oldSettings).([]interface{})[0].(map[interface{}]interface{})["port"])
+}
+
+func TestConfig_Override(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("logging:\n  level: info\n  format: text\n"))
+
+	// An override shadows the loaded value without touching the rest of the section
+	c.SetOverride("logging.level", "debug")
+	assert.Equal(t, "debug", c.GetString("logging.level", ""))
+	assert.Equal(t, "text", c.GetString("logging.format", ""))
+	assert.Equal(t, "info", c.Settings["logging"].(map[interface{}]interface{})["level"])
+
+	// Overrides can create keys that are not in the loaded config
+	c.SetOverride("stats.type", "prometheus")
+	assert.True(t, c.IsSet("stats.type"))
+	assert.Equal(t, "prometheus", c.GetString("stats.type", ""))
+
+	// Overrides survive a reload and are reported as a change
+	require.NoError(t, c.ReloadConfigString("logging:\n  level: info\n  format: text\n"))
+	assert.Equal(t, "debug", c.GetString("logging.level", ""))
+	assert.True(t, c.HasChanged("logging.level"))
+	assert.False(t, c.HasChanged("logging.format"))
+
+	// Nothing changed since the last reload
+	require.NoError(t, c.ReloadConfigString("logging:\n  level: info\n  format: text\n"))
+	assert.False(t, c.HasChanged("logging.level"))
+	assert.False(t, c.HasChanged(""))
+
+	// Clearing reveals the loaded value again
+	c.ClearOverride("logging.level")
+	c.ClearOverride("stats.type")
+	assert.Equal(t, "info", c.GetString("logging.level", ""))
+	assert.False(t, c.IsSet("stats.type"))
+
+	require.NoError(t, c.ReloadConfigString("logging:\n  level: info\n  format: text\n"))
+	assert.True(t, c.HasChanged("logging.level"))
+	assert.True(t, c.HasChanged("stats"))
+}
+
+func TestConfig_ReloadCallbackError(t *testing.T) {
+	l := test.NewLogger()
+
+	run := func(rollback bool) (*C, []string, error) {
+		c := NewC(l)
+		c.SetRollbackOnError(rollback)
+		require.NoError(t, c.LoadString("listen:\n  port: 1\n"))
+
+		var seen []string
+		c.RegisterReloadCallback(func(c *C) {
+			seen = append(seen, "plain:"+c.GetString("listen.port", ""))
+		})
+		c.RegisterReloadCallbackWithError("listen", func(c *C) error {
+			port := c.GetString("listen.port", "")
+			seen = append(seen, "listen:"+port)
+			if port == "bad" {
+				return errors.New("invalid port")
+			}
+			return nil
+		})
+
+		err := c.ReloadConfigString("listen:\n  port: bad\n")
+		return c, seen, err
+	}
+
+	// Without rollback the error is returned and the new config stays in place
+	c, seen, err := run(false)
+	assert.EqualError(t, err, "listen: invalid port")
+	assert.Equal(t, "bad", c.GetString("listen.port", ""))
+	assert.Equal(t, []string{"plain:bad", "listen:bad"}, seen)
+
+	// With rollback the old config is restored and every callback sees it again
+	c, seen, err = run(true)
+	assert.EqualError(t, err, "listen: invalid port")
+	assert.Equal(t, "1", c.GetString("listen.port", ""))
+	assert.True(t, c.HasChanged("listen.port"))
+	assert.Equal(t, []string{"plain:bad", "listen:bad", "plain:1", "listen:1"}, seen)
+
+	// A successful reload is unaffected
+	require.NoError(t, c.ReloadConfigString("listen:\n  port: 2\n"))
+	assert.Equal(t, "2", c.GetString("listen.port", ""))
+}
+
+func TestConfig_UnusedKeys(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("listen:\n  port: 4242\n  host: 0.0.0.0\nstats:\n  type: prometheus\n  interval: 10s\npunchy: {}\n"))
+
+	// Nothing is recorded until tracking is enabled
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+	c.SetTrackAccess(true)
+	assert.Equal(t, []string{"listen.host", "listen.port", "punchy", "stats.interval", "stats.type"}, c.UnusedKeys())
+
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+	assert.Equal(t, []string{"listen.host", "punchy", "stats.interval", "stats.type"}, c.UnusedKeys())
+
+	// Reading a map uses everything below it, missing keys are not recorded
+	c.Get("stats")
+	c.Get("listen.nope")
+	assert.Equal(t, []string{"listen.host", "punchy"}, c.UnusedKeys())
+
+	// Comparing the old and new settings during a reload is not a read
+	c.RegisterReloadCallback(func(c *C) {
+		c.HasChanged("listen.host")
+	})
+	c.OnKeyChange("punchy", func(_, _ interface{}) {})
+	require.NoError(t, c.ReloadConfigString("listen:\n  port: 4242\n  host: 127.0.0.1\npunchy:\n  punch: true\n"))
+	assert.Equal(t, []string{"listen.host", "punchy.punch"}, c.UnusedKeys())
+}
+
+func TestConfig_LookupFirewallRules(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	c := NewC(l)
+	require.NoError(t, c.LoadString(`
+firewall:
+  inbound:
+    - port: 443
+      proto: tcp
+      group: web
+      cidr: 10.0.0.0/8
+    - port: any
+      proto: any
+      groups:
+        - ops
+        - admin
+      local_cidr: 192.168.0.0/16
+`))
+
+	rules, err := c.LookupFirewallRules("firewall.inbound")
+	require.NoError(t, err)
+	assert.Equal(t, []FirewallRuleConfig{
+		{Port: "443", Proto: "tcp", Groups: []string{"web"}, Cidr: netip.MustParsePrefix("10.0.0.0/8")},
+		{Port: "any", Proto: "any", Groups: []string{"ops", "admin"}, LocalCidr: netip.MustParsePrefix("192.168.0.0/16")},
+	}, rules)
+
+	// Unset is not an error
+	rules, err = c.LookupFirewallRules("firewall.outbound")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	// A group array of 1 is converted and a warning is printed
+	c.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"group": []interface{}{"group1"}}}}
+	rules, err = c.LookupFirewallRules("firewall.inbound")
+	require.NoError(t, err)
+	assert.Contains(t, ob.String(), "firewall.inbound rule #0; group was an array with a single value, converting to simple value")
+	assert.Equal(t, []string{"group1"}, rules[0].Groups)
+
+	// A group array of more than 1 is an error
+	ob.Reset()
+	c.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"group": []interface{}{"group1", "group2"}}}}
+	_, err = c.LookupFirewallRules("firewall.inbound")
+	assert.Equal(t, "", ob.String())
+	assert.EqualError(t, err, "firewall.inbound rule #0; group should contain a single value, an array with more than one entry was provided")
+
+	c.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{"nope"}}
+	_, err = c.LookupFirewallRules("firewall.inbound")
+	assert.EqualError(t, err, "firewall.inbound rule #0; could not parse rule")
+}
+
+func TestConfig_OnKeyChange(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("logging:\n  level: info\nlisten:\n  port: 4242\n"))
+
+	var calls int
+	var gotOld, gotNew interface{}
+	c.OnKeyChange("logging.level", func(oldValue, newValue interface{}) {
+		calls++
+		gotOld, gotNew = oldValue, newValue
+	})
+
+	require.NoError(t, c.ReloadConfigString("logging:\n  level: debug\nlisten:\n  port: 4242\n"))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "info", gotOld)
+	assert.Equal(t, "debug", gotNew)
+
+	// Unrelated changes are ignored
+	require.NoError(t, c.ReloadConfigString("logging:\n  level: debug\nlisten:\n  port: 4243\n"))
+	assert.Equal(t, 1, calls)
+
+	// Removing the key is a change
+	require.NoError(t, c.ReloadConfigString("listen:\n  port: 4243\n"))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "debug", gotOld)
+	assert.Nil(t, gotNew)
+}
+
 // Ensure mergo merges are done the way we expect.
 // This is needed to test for potential regressions, like:
 // - https://github.com/imdario/mergo/issues/187
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// FirewallRuleConfig is a single firewall rule as written in the config. Port, Code, and Proto are left as written
+// since their meaning belongs to the firewall.
+type FirewallRuleConfig struct {
+	Port      string
+	Code      string
+	Proto     string
+	Host      string
+	Groups    []string
+	Cidr      netip.Prefix
+	LocalCidr netip.Prefix
+	CAName    string
+	CASha     string
+}
+
+// LookupFirewallRules will get the list of firewall rules at k, such as firewall.inbound. Rules from multiple config
+// files have already been appended together. group and groups are combined into Groups and the shape of every rule is
+// validated. A nil slice is returned if k is not set.
+func (c *C) LookupFirewallRules(k string) ([]FirewallRuleConfig, error) {
+	r := c.Get(k)
+	if r == nil {
+		return nil, nil
+	}
+
+	rs, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s failed to parse, should be an array of rules", k)
+	}
+
+	rules := make([]FirewallRuleConfig, len(rs))
+	for i, t := range rs {
+		rule, err := c.convertFirewallRule(t, k, i)
+		if err != nil {
+			return nil, fmt.Errorf("%s rule #%v; %s", k, i, err)
+		}
+		rules[i] = rule
+	}
+
+	return rules, nil
+}
+
+func (c *C) convertFirewallRule(p interface{}, table string, i int) (FirewallRuleConfig, error) {
+	r := FirewallRuleConfig{}
+
+	m, ok := p.(map[interface{}]interface{})
+	if !ok {
+		return r, errors.New("could not parse rule")
+	}
+
+	toString := func(k string) string {
+		v, ok := m[k]
+		if !ok || v == nil {
+			return ""
+		}
+		return fmt.Sprintf("%v", v)
+	}
+
+	r.Port = toString("port")
+	r.Code = toString("code")
+	r.Proto = toString("proto")
+	r.Host = toString("host")
+	r.CAName = toString("ca_name")
+	r.CASha = toString("ca_sha")
+
+	if r.Code != "" && r.Port != "" {
+		return r, errors.New("only one of port or code should be provided")
+	}
+
+	// Make sure group isn't an array
+	var group string
+	if v, ok := m["group"].([]interface{}); ok {
+		if len(v) > 1 {
+			return r, errors.New("group should contain a single value, an array with more than one entry was provided")
+		}
+
+		c.l.Warnf("%s rule #%v; group was an array with a single value, converting to simple value", table, i)
+		if len(v) == 1 {
+			group = fmt.Sprintf("%v", v[0])
+		}
+	} else {
+		group = toString("group")
+	}
+
+	switch rg := m["groups"].(type) {
+	case nil:
+	case []interface{}:
+		r.Groups = make([]string, len(rg))
+		for gi, g := range rg {
+			r.Groups[gi] = fmt.Sprintf("%v", g)
+		}
+	case []string:
+		r.Groups = rg
+	default:
+		r.Groups = []string{fmt.Sprintf("%v", rg)}
+	}
+
+	cidr := toString("cidr")
+	localCidr := toString("local_cidr")
+	if r.Host == "" && len(r.Groups) == 0 && group == "" && cidr == "" && localCidr == "" && r.CAName == "" && r.CASha == "" {
+		return r, errors.New("at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided")
+	}
+
+	if group != "" {
+		// Check if we have both groups and group provided in the rule config
+		if len(r.Groups) > 0 {
+			return r, errors.New("only one of group or groups should be defined, both provided")
+		}
+
+		r.Groups = []string{group}
+	}
+
+	var err error
+	if cidr != "" {
+		r.Cidr, err = netip.ParsePrefix(cidr)
+		if err != nil {
+			return r, fmt.Errorf("cidr did not parse; %s", err)
+		}
+	}
+
+	if localCidr != "" {
+		r.LocalCidr, err = netip.ParsePrefix(localCidr)
+		if err != nil {
+			return r, fmt.Errorf("local_cidr did not parse; %s", err)
+		}
+	}
+
+	return r, nil
+}
@@ -310,6 +310,8 @@ type dummyCert struct {
 	publicKey      []byte
 	signature      []byte
 	unsafeNetworks []netip.Prefix
+
+	allowExtraGroups bool
 }
 
 func (d *dummyCert) Version() cert.Version {
@@ -328,6 +330,10 @@ func (d *dummyCert) IsCA() bool {
 	return d.isCa
 }
 
+func (d *dummyCert) AllowExtraGroups() bool {
+	return d.allowExtraGroups
+}
+
 func (d *dummyCert) Issuer() string {
 	return d.issuer
 }
@@ -372,6 +378,34 @@ func (d *dummyCert) CheckSignature(key []byte) bool {
 	return true
 }
 
+func (d *dummyCert) CrossSignatures() [][]byte {
+	return nil
+}
+
+func (d *dummyCert) CheckAnySignature(keys [][]byte) bool {
+	return true
+}
+
+func (d *dummyCert) NameConstraints() []string {
+	return nil
+}
+
+func (d *dummyCert) Comment() string {
+	return ""
+}
+
+func (d *dummyCert) MarshalInto(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (d *dummyCert) SerialNumber() []byte {
+	return nil
+}
+
+func (d *dummyCert) TBSBytes() ([]byte, error) {
+	return nil, nil
+}
+
 func (d *dummyCert) Expired(t time.Time) bool {
 	return false
 }
@@ -396,6 +430,10 @@ func (d *dummyCert) MarshalPEM() ([]byte, error) {
 	return nil, nil
 }
 
+func (d *dummyCert) MarshalPublicKeyToPEM() []byte {
+	return nil
+}
+
 func (d *dummyCert) Fingerprint() (string, error) {
 	return "", nil
 }
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"hash/fnv"
 	"net/netip"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -227,12 +226,12 @@ func NewFirewallFromConfig(l *logrus.Logger, nc cert.Certificate, c *config.C) (
 		fw.OutSendReject = false
 	}
 
-	err := AddFirewallRulesFromConfig(l, false, c, fw)
+	err := AddFirewallRulesFromConfig(false, c, fw)
 	if err != nil {
 		return nil, err
 	}
 
-	err = AddFirewallRulesFromConfig(l, true, c, fw)
+	err = AddFirewallRulesFromConfig(true, c, fw)
 	if err != nil {
 		return nil, err
 	}
@@ -312,7 +311,10 @@ func (f *Firewall) GetRuleHashes() string {
 	return "SHA:" + f.GetRuleHash() + ",FNV:" + strconv.FormatUint(uint64(f.GetRuleHashFNV()), 10)
 }
 
-func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw FirewallInterface) error {
+// AddFirewallRulesFromConfig adds the firewall.inbound or firewall.outbound rules to fw. The shape of every rule,
+// including cidr and local_cidr, is validated by config.C.LookupFirewallRules before any port or proto is looked at,
+// so a bad cidr anywhere in the table is reported ahead of a bad port or proto.
+func AddFirewallRulesFromConfig(inbound bool, c *config.C, fw FirewallInterface) error {
 	var table string
 	if inbound {
 		table = "firewall.inbound"
@@ -320,44 +322,12 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 		table = "firewall.outbound"
 	}
 
-	r := c.Get(table)
-	if r == nil {
-		return nil
-	}
-
-	rs, ok := r.([]interface{})
-	if !ok {
-		return fmt.Errorf("%s failed to parse, should be an array of rules", table)
+	rules, err := c.LookupFirewallRules(table)
+	if err != nil {
+		return err
 	}
 
-	for i, t := range rs {
-		var groups []string
-		r, err := convertRule(l, t, table, i)
-		if err != nil {
-			return fmt.Errorf("%s rule #%v; %s", table, i, err)
-		}
-
-		if r.Code != "" && r.Port != "" {
-			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
-		}
-
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.LocalCidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, local_cidr, ca_name, or ca_sha must be provided", table, i)
-		}
-
-		if len(r.Groups) > 0 {
-			groups = r.Groups
-		}
-
-		if r.Group != "" {
-			// Check if we have both groups and group provided in the rule config
-			if len(groups) > 0 {
-				return fmt.Errorf("%s rule #%v; only one of group or groups should be defined, both provided", table, i)
-			}
-
-			groups = []string{r.Group}
-		}
-
+	for i, r := range rules {
 		var sPort, errPort string
 		if r.Code != "" {
 			errPort = "code"
@@ -386,23 +356,7 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
 		}
 
-		var cidr netip.Prefix
-		if r.Cidr != "" {
-			cidr, err = netip.ParsePrefix(r.Cidr)
-			if err != nil {
-				return fmt.Errorf("%s rule #%v; cidr did not parse; %s", table, i, err)
-			}
-		}
-
-		var localCidr netip.Prefix
-		if r.LocalCidr != "" {
-			localCidr, err = netip.ParsePrefix(r.LocalCidr)
-			if err != nil {
-				return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
-			}
-		}
-
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, localCidr, r.CAName, r.CASha)
+		err = fw.AddRule(inbound, proto, startPort, endPort, r.Groups, r.Host, r.Cidr, r.LocalCidr, r.CAName, r.CASha)
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
 		}
@@ -899,73 +853,6 @@ func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.CachedCertificate
 	return ok
 }
 
-type rule struct {
-	Port      string
-	Code      string
-	Proto     string
-	Host      string
-	Group     string
-	Groups    []string
-	Cidr      string
-	LocalCidr string
-	CAName    string
-	CASha     string
-}
-
-func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
-	r := rule{}
-
-	m, ok := p.(map[interface{}]interface{})
-	if !ok {
-		return r, errors.New("could not parse rule")
-	}
-
-	toString := func(k string, m map[interface{}]interface{}) string {
-		v, ok := m[k]
-		if !ok {
-			return ""
-		}
-		return fmt.Sprintf("%v", v)
-	}
-
-	r.Port = toString("port", m)
-	r.Code = toString("code", m)
-	r.Proto = toString("proto", m)
-	r.Host = toString("host", m)
-	r.Cidr = toString("cidr", m)
-	r.LocalCidr = toString("local_cidr", m)
-	r.CAName = toString("ca_name", m)
-	r.CASha = toString("ca_sha", m)
-
-	// Make sure group isn't an array
-	if v, ok := m["group"].([]interface{}); ok {
-		if len(v) > 1 {
-			return r, errors.New("group should contain a single value, an array with more than one entry was provided")
-		}
-
-		l.Warnf("%s rule #%v; group was an array with a single value, converting to simple value", table, i)
-		m["group"] = v[0]
-	}
-	r.Group = toString("group", m)
-
-	if rg, ok := m["groups"]; ok {
-		switch reflect.TypeOf(rg).Kind() {
-		case reflect.Slice:
-			v := reflect.ValueOf(rg)
-			r.Groups = make([]string, v.Len())
-			for i := 0; i < v.Len(); i++ {
-				r.Groups[i] = v.Index(i).Interface().(string)
-			}
-		case reflect.String:
-			r.Groups = []string{rg.(string)}
-		default:
-			r.Groups = []string{fmt.Sprintf("%v", rg)}
-		}
-	}
-
-	return r, nil
-}
-
 func parsePort(s string) (startPort, endPort int32, err error) {
 	if s == "any" {
 		startPort = firewall.PortAny
@@ -440,8 +440,9 @@ func ixHandshakeStage2(f *Interface, addr netip.AddrPort, via *ViaSender, hh *Ha
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Incorrect host responded to handshake")
 
-		// Release our old handshake from pending, it should not continue
-		f.handshakeManager.DeleteHostInfo(hostinfo)
+		// Release our old handshake from pending, it should not continue. Anyone waiting on it is told why before
+		// hostinfo is pointed at the host that responded.
+		f.handshakeManager.deleteHostInfo(hostinfo, ErrHandshakeWrongHost)
 
 		// Create a new hostinfo/handshake for the intended vpn ip
 		f.handshakeManager.StartHandshake(hostinfo.vpnIp, func(newHH *HandshakeHostInfo) {
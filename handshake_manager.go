@@ -5,12 +5,16 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/netip"
 	"slices"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/gaissmai/bart"
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/header"
@@ -18,30 +22,94 @@ import (
 )
 
 const (
-	DefaultHandshakeTryInterval   = time.Millisecond * 100
-	DefaultHandshakeRetries       = 10
-	DefaultHandshakeTriggerBuffer = 64
-	DefaultUseRelays              = true
+	DefaultHandshakeTryInterval     = time.Millisecond * 100
+	DefaultHandshakeRetries         = 10
+	DefaultHandshakeTriggerBuffer   = 64
+	DefaultHandshakeRequeryInterval = 5
+	DefaultUseRelays                = true
+
+	// RelayOrderStored tries relays in the order they were learned from the lighthouse
+	RelayOrderStored = "stored"
+	// RelayOrderPreferredRanges tries relays that are reached over a preferred range before any others
+	RelayOrderPreferredRanges = "preferred_ranges"
+
+	// handshakeSendCoalesceWindow is how long after sending a handshake a lighthouse trigger for the same host is
+	// ignored. The following attempt will send to any new remotes.
+	handshakeSendCoalesceWindow = 10 * time.Millisecond
+
+	// handshakeUnreachableAttempts is how many attempts in a row must fail with the network reporting the host as
+	// unreachable, with no relays to fall back on, before the handshake is abandoned ahead of its retry budget.
+	// These handshakes are counted as timed out as well as unreachable.
+	handshakeUnreachableAttempts = 3
+
+	// handshakeAttemptHistory is how many of the most recent attempts are kept for AttemptHistory
+	handshakeAttemptHistory = 32
+
+	// handshakeMaxPendingSends is how many handshake sends may be in flight at once when a send timeout is configured,
+	// including ones that timed out and are still blocked
+	handshakeMaxPendingSends = 16
 )
 
 var (
 	defaultHandshakeConfig = HandshakeConfig{
 		tryInterval:   DefaultHandshakeTryInterval,
+		initialDelay:  DefaultHandshakeTryInterval,
 		retries:       DefaultHandshakeRetries,
+		relayRetries:  DefaultHandshakeRetries,
 		triggerBuffer: DefaultHandshakeTriggerBuffer,
 		useRelays:     DefaultUseRelays,
+
+		requeryInterval: DefaultHandshakeRequeryInterval,
 	}
 )
 
 type HandshakeConfig struct {
 	tryInterval   time.Duration
+	initialDelay  time.Duration
 	retries       int64
+	relayRetries  int64
 	triggerBuffer int
 	useRelays     bool
+	relayDenylist *bart.Table[struct{}]
+
+	// maxRemotesPerAttempt limits how many remotes each attempt is sent to, 0 sends to all of them
+	maxRemotesPerAttempt int
+
+	// requeryInterval is how many attempts after the initial lighthouse query a host with at most 1 known remote is
+	// queried for again. The gap doubles after every query, 0 never queries again.
+	requeryInterval int64
+
+	// relayOrder decides which relays are tried first, one of the RelayOrder constants. Empty is RelayOrderStored.
+	relayOrder string
+
+	// onSend, if set, is called with every handshake packet right before it is sent directly to addr. It is intended for
+	// tracing and must not modify or hold on to pkt.
+	onSend func(pkt []byte, addr netip.AddrPort)
+
+	// statsInterval is how long EmitStats reuses its last snapshot of the host map counts, 0 takes a new one every call
+	statsInterval time.Duration
+
+	// sendTimeout is how long a single handshake send may block before it is given up on and the next remote is
+	// tried, 0 waits for every send to finish
+	sendTimeout time.Duration
 
 	messageMetrics *MessageMetrics
 }
 
+// maxRetries returns the number of attempts a handshake lives for, the larger of the direct and relay budgets
+func (hc *HandshakeConfig) maxRetries() int64 {
+	return max(hc.retries, hc.relayRetries)
+}
+
+// relayDenied returns true if vpnIp must not be used as a relay or be reached through one
+func (hc *HandshakeConfig) relayDenied(vpnIp netip.Addr) bool {
+	if hc.relayDenylist == nil {
+		return false
+	}
+	_, ok := hc.relayDenylist.Lookup(vpnIp)
+	return ok
+}
+
 type HandshakeManager struct {
 	// Mutex for interacting with the vpnIps and indexes maps
 	sync.RWMutex
@@ -55,23 +123,107 @@ type HandshakeManager struct {
 	config                 HandshakeConfig
 	OutboundHandshakeTimer *LockingTimerWheel[netip.Addr]
 	messageMetrics         *MessageMetrics
-	metricInitiated        metrics.Counter
-	metricTimedOut         metrics.Counter
+	metricsByStyle         map[header.MessageSubType]*handshakeStyleMetrics
+	metricsByStyleLock     sync.Mutex
+	metricOutOfRange       metrics.Counter
+	metricRelayOnly        metrics.Counter
+	metricUnreachable      metrics.Counter
+	metricSendTimeout      metrics.Counter
+	metricPending          metrics.Gauge
 	f                      *Interface
 	l                      *logrus.Logger
 
 	// can be used to trigger outbound handshake for the given vpnIp
 	trigger chan netip.Addr
+
+	// waiters are signaled with the outcome of the handshake for a vpnIp, see TriggerAndWait
+	waiters map[netip.Addr][]chan error
+
+	// pendingSends are the addrs with a write in flight when HandshakeConfig.sendTimeout is set, see writeTo
+	pendingSends     map[netip.AddrPort]struct{}
+	pendingSendsLock sync.Mutex
+
+	// clock drives Run and timestamps handshakes, tests can replace it to control time
+	clock handshakeClock
+
+	// stats is the last snapshot taken by EmitStats, see HandshakeConfig.statsInterval
+	stats     handshakeStats
+	statsLock sync.Mutex
+}
+
+// handshakeStyleMetrics are the counters kept separately for every handshake style
+type handshakeStyleMetrics struct {
+	initiated metrics.Counter
+	timedOut  metrics.Counter
+}
+
+// newHandshakeStyleMetrics registers the counters for style. ix_psk0 was the only style when these counters were
+// added so it keeps the original names, other styles have their name added as in handshake_manager.xx_psk0.initiated.
+func newHandshakeStyleMetrics(style header.MessageSubType) *handshakeStyleMetrics {
+	prefix := "handshake_manager."
+	if style != header.HandshakeIXPSK0 {
+		name := header.SubTypeName(header.Handshake, style)
+		if name == "unknown" {
+			name = fmt.Sprintf("unknown_%d", style)
+		}
+		prefix += name + "."
+	}
+
+	return &handshakeStyleMetrics{
+		initiated: metrics.GetOrRegisterCounter(prefix+"initiated", nil),
+		timedOut:  metrics.GetOrRegisterCounter(prefix+"timed_out", nil),
+	}
+}
+
+// styleMetrics returns the counters for style, registering them the first time the style is seen
+func (hm *HandshakeManager) styleMetrics(style header.MessageSubType) *handshakeStyleMetrics {
+	hm.metricsByStyleLock.Lock()
+	defer hm.metricsByStyleLock.Unlock()
+
+	sm, ok := hm.metricsByStyle[style]
+	if !ok {
+		sm = newHandshakeStyleMetrics(style)
+		hm.metricsByStyle[style] = sm
+	}
+
+	return sm
+}
+
+// handshakeClock is the source of time for the HandshakeManager
+type handshakeClock interface {
+	Now() time.Time
+	// NewTicker returns a channel that receives the time every d and a function to stop it
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+type realHandshakeClock struct{}
+
+func (realHandshakeClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realHandshakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
 }
 
 type HandshakeHostInfo struct {
 	sync.Mutex
 
-	startTime   time.Time        // Time that we first started trying with this handshake
-	ready       bool             // Is the handshake ready
-	counter     int64            // How many attempts have we made so far
-	lastRemotes []netip.AddrPort // Remotes that we sent to during the previous attempt
-	packetStore []*cachedPacket  // A set of packets to be transmitted once the handshake completes
+	startTime   time.Time             // Time that we first started trying with this handshake
+	ready       bool                  // Is the handshake ready
+	counter     int64                 // How many attempts have we made so far
+	relayCount  int64                 // How many attempts have gone through relays so far
+	lastQuery   int64                 // The attempt counter when we last queried the lighthouse for this host
+	requeryGap  int64                 // How many attempts after lastQuery the lighthouse is queried again
+	lastRemotes []netip.AddrPort      // Remotes that we sent to during the previous attempt
+	nextRemote  int                   // Where in the remotes the next attempt starts when maxRemotesPerAttempt is set
+	lastSend    time.Time             // When handshake packets were last sent, used to coalesce lighthouse triggers
+	lastError   error                 // The most recent error from sending a handshake packet, kept for PendingSnapshot
+	unreachable int64                 // How many attempts in a row every send failed because the host was unreachable
+	style       header.MessageSubType // The handshake style in use, the zero value is ix_psk0
+	attempts    []AttemptRecord       // The most recent attempts, oldest first, kept for AttemptHistory
+	packetStore []*cachedPacket       // A set of packets to be transmitted once the handshake completes
 
 	hostinfo *HostInfo
 }
@@ -110,17 +262,24 @@ func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *Lig
 		outside:                outside,
 		config:                 config,
 		trigger:                make(chan netip.Addr, config.triggerBuffer),
-		OutboundHandshakeTimer: NewLockingTimerWheel[netip.Addr](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
+		waiters:                map[netip.Addr][]chan error{},
+		pendingSends:           map[netip.AddrPort]struct{}{},
+		OutboundHandshakeTimer: NewLockingTimerWheel[netip.Addr](config.tryInterval, hsTimeout(config.maxRetries(), config.tryInterval)),
 		messageMetrics:         config.messageMetrics,
-		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
-		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricsByStyle:         map[header.MessageSubType]*handshakeStyleMetrics{header.HandshakeIXPSK0: newHandshakeStyleMetrics(header.HandshakeIXPSK0)},
+		metricOutOfRange:       metrics.GetOrRegisterCounter("handshake_manager.out_of_range", nil),
+		metricRelayOnly:        metrics.GetOrRegisterCounter("handshake_manager.relay_only_completed", nil),
+		metricUnreachable:      metrics.GetOrRegisterCounter("handshake_manager.unreachable", nil),
+		metricSendTimeout:      metrics.GetOrRegisterCounter("handshake_manager.send_timeout", nil),
+		metricPending:          metrics.GetOrRegisterGauge("handshake_manager.pending_count", nil),
 		l:                      l,
+		clock:                  realHandshakeClock{},
 	}
 }
 
 func (c *HandshakeManager) Run(ctx context.Context) {
-	clockSource := time.NewTicker(c.config.tryInterval)
-	defer clockSource.Stop()
+	ticks, stop := c.clock.NewTicker(c.config.tryInterval)
+	defer stop()
 
 	for {
 		select {
@@ -128,7 +287,7 @@ func (c *HandshakeManager) Run(ctx context.Context) {
 			return
 		case vpnIP := <-c.trigger:
 			c.handleOutbound(vpnIP, true)
-		case now := <-clockSource.C:
+		case now := <-ticks:
 			c.NextOutboundHandshakeTimerTick(now)
 		}
 	}
@@ -153,7 +312,7 @@ func (hm *HandshakeManager) HandleIncoming(addr netip.AddrPort, via *ViaSender,
 			newHostinfo := hm.queryIndex(h.RemoteIndex)
 			tearDown := ixHandshakeStage2(hm.f, addr, via, newHostinfo, packet, h)
 			if tearDown && newHostinfo != nil {
-				hm.DeleteHostInfo(newHostinfo.hostinfo)
+				hm.abandonPending(newHostinfo)
 			}
 		}
 	}
@@ -178,17 +337,22 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	hh.Lock()
 	defer hh.Unlock()
 
+	// A lighthouse trigger that lands right after an attempt would only send the same packet again
+	if lighthouseTriggered && hm.clock.Now().Sub(hh.lastSend) < handshakeSendCoalesceWindow {
+		return
+	}
+
 	hostinfo := hh.hostinfo
-	// If we are out of time, clean up
-	if hh.counter >= hm.config.retries {
+	// If we are out of time, clean up. Direct and relayed attempts have separate budgets, we give up once both are spent.
+	if hh.counter >= hm.config.maxRetries() {
 		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())).
 			WithField("initiatorIndex", hh.hostinfo.localIndexId).
 			WithField("remoteIndex", hh.hostinfo.remoteIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
-			WithField("durationNs", time.Since(hh.startTime).Nanoseconds()).
+			WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+			WithField("durationNs", hm.clock.Now().Sub(hh.startTime).Nanoseconds()).
 			Info("Handshake timed out")
-		hm.metricTimedOut.Inc(1)
-		hm.DeleteHostInfo(hostinfo)
+		hm.styleMetrics(hh.style).timedOut.Inc(1)
+		hm.deleteHostInfo(hostinfo, ErrHandshakeTimedOut)
 		return
 	}
 
@@ -223,54 +387,101 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 
 	hh.lastRemotes = remotes
 
-	// TODO: this will generate a load of queries for hosts with only 1 ip
+	// Querying every attempt would generate a load of queries for hosts with only 1 ip
 	// (such as ones registered to the lighthouse with only a private IP)
-	// So we only do it one time after attempting 5 handshakes already.
-	if len(remotes) <= 1 && hh.counter == 5 {
+	// So we back off, waiting twice as many attempts before each query as the one before.
+	if len(remotes) <= 1 && hh.requeryGap > 0 && hh.counter-hh.lastQuery >= hh.requeryGap {
 		// If we only have 1 remote it is highly likely our query raced with the other host registered within the lighthouse
 		// Our vpnIp here has a tunnel with a lighthouse but has yet to send a host update packet there so we only know about
 		// the learned public ip for them. Query again to short circuit the promotion counter
+		hh.lastQuery = hh.counter
+		hh.requeryGap *= 2
 		hm.lightHouse.QueryServer(vpnIp)
 	}
 
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
-	var sentTo []netip.AddrPort
-	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr netip.AddrPort, _ bool) {
-		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
-		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
-		if err != nil {
-			hostinfo.logger(hm.l).WithField("udpAddr", addr).
+	var sentTo, failed []netip.AddrPort
+	if hh.counter <= hm.config.retries {
+		hh.lastSend = hm.clock.Now()
+		attempt := hm.remotesForAttempt(hh, remotes)
+		unreachable := 0
+		for _, addr := range attempt {
+			hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
+			if hm.config.onSend != nil {
+				hm.config.onSend(hostinfo.HandshakePacket[0], addr)
+			}
+			err := hm.writeTo(hostinfo.HandshakePacket[0], addr)
+			if err != nil {
+				if errors.Is(err, ErrHandshakeSendTimeout) {
+					hm.metricSendTimeout.Inc(1)
+				} else if isUnreachable(err) {
+					unreachable++
+				}
+				hh.lastError = fmt.Errorf("%v: %w", addr, err)
+				failed = append(failed, addr)
+				hostinfo.logger(hm.l).WithField("udpAddr", addr).
+					WithField("initiatorIndex", hostinfo.localIndexId).
+					WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+					WithError(err).Error("Failed to send handshake message")
+
+			} else {
+				sentTo = append(sentTo, addr)
+			}
+		}
+
+		// Don't be too noisy or confusing if we fail to send a handshake - if we don't get through we'll eventually log a timeout,
+		// so only log when the list of remotes has changed
+		if remotesHaveChanged {
+			hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
 				WithField("initiatorIndex", hostinfo.localIndexId).
-				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
-				WithError(err).Error("Failed to send handshake message")
+				WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+				Info("Handshake message sent")
+		} else if hm.l.IsLevelEnabled(logrus.DebugLevel) {
+			hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
+				WithField("initiatorIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+				Debug("Handshake message sent")
+		}
 
+		if len(attempt) > 0 && unreachable == len(attempt) {
+			hh.unreachable++
 		} else {
-			sentTo = append(sentTo, addr)
+			hh.unreachable = 0
 		}
-	})
+	}
 
-	// Don't be too noisy or confusing if we fail to send a handshake - if we don't get through we'll eventually log a timeout,
-	// so only log when the list of remotes has changed
-	if remotesHaveChanged {
-		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
-			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
-			Info("Handshake message sent")
-	} else if hm.l.IsLevelEnabled(logrus.DebugLevel) {
-		hostinfo.logger(hm.l).WithField("udpAddrs", sentTo).
+	record := hh.addAttempt(AttemptRecord{Time: hm.clock.Now(), Attempt: hh.counter, Sent: sentTo, Failed: failed})
+
+	useRelays := hm.config.useRelays && len(hostinfo.remotes.relays) > 0 && hh.relayCount < hm.config.relayRetries && !hm.config.relayDenied(vpnIp)
+
+	// There is no point in waiting out the retry budget if the network keeps telling us the host can not be reached
+	if !useRelays && hh.unreachable >= handshakeUnreachableAttempts {
+		hostinfo.logger(hm.l).WithField("udpAddrs", remotes).
 			WithField("initiatorIndex", hostinfo.localIndexId).
-			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
-			Debug("Handshake message sent")
+			WithField("handshake", m{"stage": 1, "style": header.SubTypeName(header.Handshake, hh.style)}).
+			WithField("durationNs", hm.clock.Now().Sub(hh.startTime).Nanoseconds()).
+			WithError(hh.lastError).
+			Info("Handshake abandoned, host is unreachable")
+		hm.metricUnreachable.Inc(1)
+		hm.styleMetrics(hh.style).timedOut.Inc(1)
+		hm.DeleteHostInfo(hostinfo)
+		return
 	}
 
-	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
+	if useRelays {
+		hh.relayCount++
+		record.Relayed = true
 		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
 		// Send a RelayRequest to all known Relay IP's
-		for _, relay := range hostinfo.remotes.relays {
+		for _, relay := range hm.orderRelays(hostinfo.remotes.relays) {
 			// Don't relay to myself, and don't relay through the host I'm trying to connect to
 			if relay == vpnIp || relay == hm.lightHouse.myVpnNet.Addr() {
 				continue
 			}
+			if hm.config.relayDenied(relay) {
+				hostinfo.logger(hm.l).WithField("relay", relay.String()).Debug("Skipping relay in relay.denylist")
+				continue
+			}
 			relayHostInfo := hm.mainHostMap.QueryVpnIp(relay)
 			if relayHostInfo == nil || !relayHostInfo.remote.IsValid() {
 				hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Establish tunnel to relay target")
@@ -362,6 +573,97 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	}
 }
 
+// writeTo sends a handshake packet to addr, giving up with ErrHandshakeSendTimeout if the write blocks for longer
+// than HandshakeConfig.sendTimeout. A write that timed out is left to finish in the background, b must not be
+// modified afterward. Only one write per addr and at most handshakeMaxPendingSends writes overall are in flight at
+// once, anything beyond that fails right away so a stuck socket can not pile up goroutines.
+func (hm *HandshakeManager) writeTo(b []byte, addr netip.AddrPort) error {
+	if hm.config.sendTimeout <= 0 {
+		return hm.outside.WriteTo(b, addr)
+	}
+
+	hm.pendingSendsLock.Lock()
+	if _, ok := hm.pendingSends[addr]; ok || len(hm.pendingSends) >= handshakeMaxPendingSends {
+		// An earlier write is still stuck, don't start another behind it
+		hm.pendingSendsLock.Unlock()
+		return ErrHandshakeSendTimeout
+	}
+	hm.pendingSends[addr] = struct{}{}
+	hm.pendingSendsLock.Unlock()
+
+	// Buffered so the goroutine can exit once the write returns, even if nobody is waiting anymore
+	done := make(chan error, 1)
+	go func() {
+		err := hm.outside.WriteTo(b, addr)
+		hm.pendingSendsLock.Lock()
+		delete(hm.pendingSends, addr)
+		hm.pendingSendsLock.Unlock()
+		done <- err
+	}()
+
+	timer := time.NewTimer(hm.config.sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrHandshakeSendTimeout
+	}
+}
+
+// orderRelays returns relays in the order they should be tried according to the relayOrder config. The given slice is
+// not modified.
+func (hm *HandshakeManager) orderRelays(relays []netip.Addr) []netip.Addr {
+	if hm.config.relayOrder != RelayOrderPreferredRanges || len(relays) < 2 {
+		return relays
+	}
+
+	preferredRanges := hm.mainHostMap.GetPreferredRanges()
+	preferred := func(relay netip.Addr) bool {
+		hi := hm.mainHostMap.QueryVpnIp(relay)
+		if hi == nil || !hi.remote.IsValid() {
+			return false
+		}
+
+		for _, r := range preferredRanges {
+			if r.Contains(hi.remote.Addr()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ordered := make([]netip.Addr, 0, len(relays))
+	var rest []netip.Addr
+	for _, relay := range relays {
+		if preferred(relay) {
+			ordered = append(ordered, relay)
+		} else {
+			rest = append(rest, relay)
+		}
+	}
+
+	return append(ordered, rest...)
+}
+
+// remotesForAttempt returns the remotes the current attempt should be sent to. When maxRemotesPerAttempt is set only
+// that many are returned, starting where the previous attempt left off so every remote is eventually tried.
+// hh must be locked.
+func (hm *HandshakeManager) remotesForAttempt(hh *HandshakeHostInfo, remotes []netip.AddrPort) []netip.AddrPort {
+	limit := hm.config.maxRemotesPerAttempt
+	if limit <= 0 || len(remotes) <= limit {
+		return remotes
+	}
+
+	out := make([]netip.AddrPort, limit)
+	for i := range out {
+		out[i] = remotes[(hh.nextRemote+i)%len(remotes)]
+	}
+	hh.nextRemote = (hh.nextRemote + limit) % len(remotes)
+	return out
+}
+
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
 // The 2nd argument will be true if the hostinfo is ready to transmit traffic
 func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
@@ -380,8 +682,53 @@ func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 	return hm.StartHandshake(vpnIp, cacheCb), false
 }
 
+// HandshakeStatus describes the state of the tunnel returned by StartHandshakeWithStatus
+type HandshakeStatus int
+
+const (
+	// HandshakeCreated means a new handshake was started
+	HandshakeCreated HandshakeStatus = iota
+	// HandshakeAlreadyPending means a handshake was already in progress and has been left as is
+	HandshakeAlreadyPending
+	// HandshakeAlreadyComplete means a tunnel is already established and no handshake was started
+	HandshakeAlreadyComplete
+	// HandshakeOutOfRange means the vpn ip is not within our vpn network, no handshake was started and the hostinfo is nil
+	HandshakeOutOfRange
+)
+
 // StartHandshake will ensure a handshake is currently being attempted for the provided vpn ip
+// A new handshake is started even if a tunnel is already established, which is used to replace existing tunnels.
+// nil is returned if the vpn ip is not within our vpn network.
 func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) *HostInfo {
+	hostinfo, _ := hm.startHandshake(vpnIp, cacheCb)
+	return hostinfo
+}
+
+// StartHandshakeWithStatus is the same as StartHandshake except that nothing is done if a tunnel is already
+// established. The returned status tells the caller which hostinfo it got without having to inspect it.
+// cacheCb is not called when the tunnel is already established.
+func (hm *HandshakeManager) StartHandshakeWithStatus(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) (*HostInfo, HandshakeStatus) {
+	hm.mainHostMap.RLock()
+	h, ok := hm.mainHostMap.Hosts[vpnIp]
+	hm.mainHostMap.RUnlock()
+
+	if ok {
+		return h, HandshakeAlreadyComplete
+	}
+
+	return hm.startHandshake(vpnIp, cacheCb)
+}
+
+func (hm *HandshakeManager) startHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) (*HostInfo, HandshakeStatus) {
+	if !hm.mainHostMap.vpnCIDR.Contains(vpnIp) {
+		hm.metricOutOfRange.Inc(1)
+		if hm.l.Level >= logrus.DebugLevel {
+			hm.l.WithField("vpnIp", vpnIp).WithField("network", hm.mainHostMap.vpnCIDR).
+				Debug("Refusing to handshake with a vpn ip outside of our network")
+		}
+		return nil, HandshakeOutOfRange
+	}
+
 	hm.Lock()
 
 	if hh, ok := hm.vpnIps[vpnIp]; ok {
@@ -390,7 +737,7 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 			cacheCb(hh)
 		}
 		hm.Unlock()
-		return hh.hostinfo
+		return hh.hostinfo, HandshakeAlreadyPending
 	}
 
 	hostinfo := &HostInfo{
@@ -404,12 +751,14 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 	}
 
 	hh := &HandshakeHostInfo{
-		hostinfo:  hostinfo,
-		startTime: time.Now(),
+		hostinfo:   hostinfo,
+		startTime:  hm.clock.Now(),
+		requeryGap: hm.config.requeryInterval,
 	}
 	hm.vpnIps[vpnIp] = hh
-	hm.metricInitiated.Inc(1)
-	hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval)
+	hm.styleMetrics(hh.style).initiated.Inc(1)
+	hm.metricPending.Update(int64(len(hm.vpnIps)))
+	hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.initialDelay)
 
 	if cacheCb != nil {
 		cacheCb(hh)
@@ -432,13 +781,75 @@ func (hm *HandshakeManager) StartHandshake(vpnIp netip.Addr, cacheCb func(*Hands
 
 	hm.Unlock()
 	hm.lightHouse.QueryServer(vpnIp)
-	return hostinfo
+	return hostinfo, HandshakeCreated
+}
+
+// TriggerAndWait starts a handshake with vpnIp if there is no tunnel already and blocks until the tunnel is
+// established, the handshake fails, or ctx is done. A handshake that is already pending is waited on instead of being
+// restarted. If ctx is done first then ctx.Err() is returned and the handshake carries on without us.
+func (hm *HandshakeManager) TriggerAndWait(ctx context.Context, vpnIp netip.Addr) error {
+	// The waiter has to be in place before the handshake starts or a quick completion would be missed
+	ch := make(chan error, 1)
+	hm.Lock()
+	hm.waiters[vpnIp] = append(hm.waiters[vpnIp], ch)
+	hm.Unlock()
+
+	_, status := hm.StartHandshakeWithStatus(vpnIp, nil)
+	switch status {
+	case HandshakeAlreadyComplete:
+		hm.removeWaiter(vpnIp, ch)
+		return nil
+	case HandshakeOutOfRange:
+		hm.removeWaiter(vpnIp, ch)
+		return ErrHandshakeOutOfRange
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		hm.removeWaiter(vpnIp, ch)
+		// The handshake may have finished while we were giving up
+		select {
+		case err := <-ch:
+			return err
+		default:
+			return ctx.Err()
+		}
+	}
+}
+
+func (hm *HandshakeManager) removeWaiter(vpnIp netip.Addr, ch chan error) {
+	hm.Lock()
+	defer hm.Unlock()
+
+	waiters := slices.DeleteFunc(hm.waiters[vpnIp], func(w chan error) bool { return w == ch })
+	if len(waiters) == 0 {
+		delete(hm.waiters, vpnIp)
+	} else {
+		hm.waiters[vpnIp] = waiters
+	}
+}
+
+// unlockedNotifyWaiters hands err to everything waiting on the handshake for vpnIp, nil means the tunnel is up
+func (hm *HandshakeManager) unlockedNotifyWaiters(vpnIp netip.Addr, err error) {
+	for _, ch := range hm.waiters[vpnIp] {
+		ch <- err
+	}
+	delete(hm.waiters, vpnIp)
 }
 
 var (
 	ErrExistingHostInfo    = errors.New("existing hostinfo")
 	ErrAlreadySeen         = errors.New("already seen")
 	ErrLocalIndexCollision = errors.New("local index collision")
+
+	ErrHandshakeTimedOut   = errors.New("handshake timed out")
+	ErrHandshakeAbandoned  = errors.New("handshake abandoned")
+	ErrHandshakeOutOfRange = errors.New("vpn ip is not within our vpn network")
+	ErrHandshakeWrongHost  = errors.New("incorrect host responded to handshake")
+
+	ErrHandshakeSendTimeout = errors.New("handshake send timed out")
 )
 
 // CheckAndComplete checks for any conflicts in the main and pending hostmap
@@ -500,10 +911,21 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 			Info("New host shadows existing host remoteIndex")
 	}
 
+	c.unlockedCheckRelayOnly(hostinfo)
 	c.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	c.unlockedNotifyWaiters(hostinfo.vpnIp, nil)
 	return existingHostInfo, nil
 }
 
+// unlockedCheckRelayOnly flags a hostinfo that is about to complete as relay only. Without a remote the handshake, as
+// either the initiator or the responder, could only have arrived through a relay.
+func (hm *HandshakeManager) unlockedCheckRelayOnly(hostinfo *HostInfo) {
+	if !hostinfo.remote.IsValid() {
+		hostinfo.relayOnly = true
+		hm.metricRelayOnly.Inc(1)
+	}
+}
+
 // Complete is a simpler version of CheckAndComplete when we already know we
 // won't have a localIndexId collision because we already have an entry in the
 // pendingHostMap. An existing hostinfo is returned if there was one.
@@ -522,9 +944,12 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 			Info("New host shadows existing host remoteIndex")
 	}
 
+	hm.unlockedCheckRelayOnly(hostinfo)
+
 	// We need to remove from the pending hostmap first to avoid undoing work when after to the main hostmap.
 	hm.unlockedDeleteHostInfo(hostinfo)
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
+	hm.unlockedNotifyWaiters(hostinfo.vpnIp, nil)
 }
 
 // allocateIndex generates a unique localIndexId for this HostInfo
@@ -555,10 +980,30 @@ func (hm *HandshakeManager) allocateIndex(hh *HandshakeHostInfo) error {
 	return errors.New("failed to generate unique localIndexId")
 }
 
+// DeleteHostInfo removes a pending handshake that will not complete, anything waiting on it gets ErrHandshakeAbandoned
 func (c *HandshakeManager) DeleteHostInfo(hostinfo *HostInfo) {
+	c.deleteHostInfo(hostinfo, ErrHandshakeAbandoned)
+}
+
+// deleteHostInfo is the same as DeleteHostInfo except waiters are given err
+func (c *HandshakeManager) deleteHostInfo(hostinfo *HostInfo, err error) {
 	c.Lock()
 	defer c.Unlock()
 	c.unlockedDeleteHostInfo(hostinfo)
+	c.unlockedNotifyWaiters(hostinfo.vpnIp, err)
+}
+
+// abandonPending removes hh after stage 2 asked for it to be torn down. It is skipped if hh is no longer pending, the
+// incorrect host path in ixHandshakeStage2 releases hh itself before pointing it at the host that responded and
+// deleting it again would abandon any handshake to that host.
+func (c *HandshakeManager) abandonPending(hh *HandshakeHostInfo) {
+	c.Lock()
+	defer c.Unlock()
+	if c.vpnIps[hh.hostinfo.vpnIp] != hh {
+		return
+	}
+	c.unlockedDeleteHostInfo(hh.hostinfo)
+	c.unlockedNotifyWaiters(hh.hostinfo.vpnIp, ErrHandshakeAbandoned)
 }
 
 func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
@@ -571,6 +1016,7 @@ func (c *HandshakeManager) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	if len(c.vpnIps) == 0 {
 		c.indexes = map[uint32]*HandshakeHostInfo{}
 	}
+	c.metricPending.Update(int64(len(c.vpnIps)))
 
 	if c.l.Level >= logrus.DebugLevel {
 		c.l.WithField("hostMap", m{"mapTotalSize": len(c.vpnIps),
@@ -630,19 +1076,225 @@ func (c *HandshakeManager) ForEachIndex(f controlEach) {
 	}
 }
 
+// AttemptRecord describes a single attempt at sending a handshake
+type AttemptRecord struct {
+	Time    time.Time `json:"time"`
+	Attempt int64     `json:"attempt"`
+	// Sent and Failed are the remotes the handshake was sent to directly, either list may be empty
+	Sent    []netip.AddrPort `json:"sent"`
+	Failed  []netip.AddrPort `json:"failed"`
+	Relayed bool             `json:"relayed"`
+}
+
+// addAttempt records an attempt, dropping the oldest once handshakeAttemptHistory are held. The returned record can be
+// updated until the next call.
+func (hh *HandshakeHostInfo) addAttempt(r AttemptRecord) *AttemptRecord {
+	if len(hh.attempts) >= handshakeAttemptHistory {
+		copy(hh.attempts, hh.attempts[1:])
+		hh.attempts = hh.attempts[:len(hh.attempts)-1]
+	}
+	hh.attempts = append(hh.attempts, r)
+	return &hh.attempts[len(hh.attempts)-1]
+}
+
+// AttemptHistory returns the most recent attempts of the pending handshake for vpnIp, oldest first. The history is
+// discarded along with the pending handshake, nil is returned once it has completed or timed out.
+func (hm *HandshakeManager) AttemptHistory(vpnIp netip.Addr) []AttemptRecord {
+	hh := hm.queryVpnIp(vpnIp)
+	if hh == nil {
+		return nil
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+	return slices.Clone(hh.attempts)
+}
+
+// PendingHandshakeInfo is a point in time view of a handshake that has not yet completed
+type PendingHandshakeInfo struct {
+	VpnIp   netip.Addr    `json:"vpnIp"`
+	Counter int64         `json:"counter"`
+	Elapsed time.Duration `json:"elapsed"`
+	Remotes int           `json:"remotes"`
+	// LastError is the most recent failure to send a handshake packet, it is not cleared by later successful sends
+	LastError string `json:"lastError,omitempty"`
+}
+
+// PendingSnapshot returns a copy of the state of every pending handshake. Nothing is modified.
+func (hm *HandshakeManager) PendingSnapshot() []PendingHandshakeInfo {
+	hm.RLock()
+	hhs := make([]*HandshakeHostInfo, 0, len(hm.vpnIps))
+	for _, hh := range hm.vpnIps {
+		hhs = append(hhs, hh)
+	}
+	hm.RUnlock()
+
+	// The HandshakeHostInfo lock must not be taken while holding the HandshakeManager lock,
+	// handleOutbound takes them in the opposite order
+	now := hm.clock.Now()
+	snapshot := make([]PendingHandshakeInfo, 0, len(hhs))
+	for _, hh := range hhs {
+		hh.Lock()
+		p := PendingHandshakeInfo{
+			VpnIp:   hh.hostinfo.vpnIp,
+			Counter: hh.counter,
+			Elapsed: now.Sub(hh.startTime),
+		}
+		if remotes := hh.hostinfo.remotes; remotes != nil {
+			// Use the addresses as last built, rebuilding them here would modify the remote list
+			remotes.RLock()
+			p.Remotes = len(remotes.addrs)
+			remotes.RUnlock()
+		}
+		if hh.lastError != nil {
+			p.LastError = hh.lastError.Error()
+		}
+		snapshot = append(snapshot, p)
+		hh.Unlock()
+	}
+
+	return snapshot
+}
+
+// exportedHandshake is the serialized form of a pending handshake used by ExportPending and ImportPending
+type exportedHandshake struct {
+	VpnIp     netip.Addr       `json:"vpnIp"`
+	Counter   int64            `json:"counter"`
+	StartTime time.Time        `json:"startTime"`
+	Remotes   []netip.AddrPort `json:"remotes"`
+}
+
+// ExportPending serializes the pending handshakes so they can be resumed by ImportPending in a new process, for example
+// across a restart.
+func (hm *HandshakeManager) ExportPending() ([]byte, error) {
+	hm.RLock()
+	hhs := make([]*HandshakeHostInfo, 0, len(hm.vpnIps))
+	for _, hh := range hm.vpnIps {
+		hhs = append(hhs, hh)
+	}
+	hm.RUnlock()
+
+	// The HandshakeHostInfo lock must not be taken while holding the HandshakeManager lock,
+	// handleOutbound takes them in the opposite order
+	exported := make([]exportedHandshake, 0, len(hhs))
+	for _, hh := range hhs {
+		hh.Lock()
+		e := exportedHandshake{
+			VpnIp:     hh.hostinfo.vpnIp,
+			Counter:   hh.counter,
+			StartTime: hh.startTime,
+		}
+		if hh.hostinfo.remotes != nil {
+			e.Remotes = hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())
+		}
+		hh.Unlock()
+		exported = append(exported, e)
+	}
+
+	return json.Marshal(exported)
+}
+
+// ImportPending resumes handshakes exported by ExportPending. The attempt counter and known remotes are restored so the
+// handshake continues where it left off. Entries that would have timed out by now and vpn ips that already have a
+// tunnel or a pending handshake are skipped.
+func (hm *HandshakeManager) ImportPending(b []byte) error {
+	var exported []exportedHandshake
+	err := json.Unmarshal(b, &exported)
+	if err != nil {
+		return err
+	}
+
+	maxAge := hsTimeout(hm.config.maxRetries(), hm.config.tryInterval)
+	for _, e := range exported {
+		if !hm.mainHostMap.vpnCIDR.Contains(e.VpnIp) || e.Counter >= hm.config.maxRetries() || hm.clock.Now().Sub(e.StartTime) > maxAge {
+			continue
+		}
+
+		if len(e.Remotes) > 0 {
+			hm.restoreRemotes(e.VpnIp, e.Remotes)
+		}
+
+		var hh *HandshakeHostInfo
+		_, status := hm.StartHandshakeWithStatus(e.VpnIp, func(h *HandshakeHostInfo) {
+			hh = h
+		})
+
+		// Only resume handshakes we created, one that was already started by this process is more accurate
+		if status != HandshakeCreated {
+			continue
+		}
+
+		hh.Lock()
+		hh.counter = e.Counter
+		hh.startTime = e.StartTime
+		hh.Unlock()
+
+		hm.l.WithField("vpnIp", e.VpnIp).WithField("counter", e.Counter).Debug("Imported pending handshake")
+	}
+
+	return nil
+}
+
+// restoreRemotes adds remotes to the lighthouse cache for vpnIp as if vpnIp had reported them, subject to the
+// remote allow list.
+func (hm *HandshakeManager) restoreRemotes(vpnIp netip.Addr, remotes []netip.AddrPort) {
+	var v4 []*Ip4AndPort
+	var v6 []*Ip6AndPort
+	for _, r := range remotes {
+		if r.Addr().Is4() {
+			v4 = append(v4, NewIp4AndPortFromNetIP(r.Addr(), r.Port()))
+		} else {
+			v6 = append(v6, NewIp6AndPortFromNetIP(r.Addr(), r.Port()))
+		}
+	}
+
+	lh := hm.lightHouse
+	lh.Lock()
+	am := lh.unlockedGetRemoteList(vpnIp)
+	am.Lock()
+	defer am.Unlock()
+	lh.Unlock()
+
+	am.unlockedSetV4(vpnIp, vpnIp, v4, lh.unlockedShouldAddV4)
+	am.unlockedSetV6(vpnIp, vpnIp, v6, lh.unlockedShouldAddV6)
+}
+
+// handshakeStats are the counts EmitStats reports for the pending and main host maps
+type handshakeStats struct {
+	takenAt        time.Time
+	pendingHosts   int
+	pendingIndexes int
+	main           hostMapStats
+}
+
 func (c *HandshakeManager) EmitStats() {
-	c.RLock()
-	hostLen := len(c.vpnIps)
-	indexLen := len(c.indexes)
-	c.RUnlock()
+	c.statsLock.Lock()
+	now := c.clock.Now()
+	if c.stats.takenAt.IsZero() || now.Sub(c.stats.takenAt) >= c.config.statsInterval {
+		c.RLock()
+		c.stats.pendingHosts = len(c.vpnIps)
+		c.stats.pendingIndexes = len(c.indexes)
+		c.RUnlock()
+
+		c.stats.main = c.mainHostMap.stats()
+		c.stats.takenAt = now
+	}
+	stats := c.stats
+	c.statsLock.Unlock()
 
-	metrics.GetOrRegisterGauge("hostmap.pending.hosts", nil).Update(int64(hostLen))
-	metrics.GetOrRegisterGauge("hostmap.pending.indexes", nil).Update(int64(indexLen))
-	c.mainHostMap.EmitStats()
+	metrics.GetOrRegisterGauge("hostmap.pending.hosts", nil).Update(int64(stats.pendingHosts))
+	metrics.GetOrRegisterGauge("hostmap.pending.indexes", nil).Update(int64(stats.pendingIndexes))
+	stats.main.emit()
 }
 
 // Utility functions below
 
+// isUnreachable returns true if err means the network has no route to the destination, as opposed to a transient
+// failure such as a full send buffer
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH)
+}
+
 func generateIndex(l *logrus.Logger) (uint32, error) {
 	b := make([]byte, 4)
 
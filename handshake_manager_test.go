@@ -1,14 +1,24 @@
 package nebula
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/netip"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_NewHandshakeManagerVpnIp(t *testing.T) {
@@ -65,6 +75,554 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	assert.NotContains(t, blah.vpnIps, ip)
 }
 
+func Test_NewHandshakeManagerInitialDelay(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	// ticksUntilFirstAttempt counts how many ticks it takes for the first handshake attempt to be scheduled
+	ticksUntilFirstAttempt := func(initialDelay time.Duration) int {
+		config := defaultHandshakeConfig
+		config.initialDelay = initialDelay
+		hm := NewHandshakeManager(l, newHostMap(l, vpncidr), newTestLighthouse(), &udp.NoopConn{}, config)
+
+		now := time.Now()
+		hm.OutboundHandshakeTimer.Advance(now)
+		hm.StartHandshake(ip, nil)
+
+		for i := 1; i <= DefaultHandshakeRetries; i++ {
+			now = now.Add(config.tryInterval)
+			hm.OutboundHandshakeTimer.Advance(now)
+			if vpnIp, has := hm.OutboundHandshakeTimer.Purge(); has {
+				assert.Equal(t, ip, vpnIp)
+				return i
+			}
+		}
+		return -1
+	}
+
+	// The default keeps the existing behavior
+	assert.Equal(t, ticksUntilFirstAttempt(DefaultHandshakeTryInterval), ticksUntilFirstAttempt(defaultHandshakeConfig.initialDelay))
+
+	// Zero fires on the next tick, same as the minimum resolution of the timer
+	assert.Equal(t, ticksUntilFirstAttempt(DefaultHandshakeTryInterval), ticksUntilFirstAttempt(0))
+
+	// Longer delays are honored
+	assert.Equal(t, ticksUntilFirstAttempt(DefaultHandshakeTryInterval)+2, ticksUntilFirstAttempt(DefaultHandshakeTryInterval*3))
+}
+
+func Test_HandshakeManagerStartHandshakeWithStatus(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	established := netip.MustParseAddr("172.1.1.3")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+	mainHM.unlockedAddHostInfo(&HostInfo{
+		vpnIp:           established,
+		ConnectionState: &ConnectionState{},
+		relayState: RelayState{
+			relays:        map[netip.Addr]struct{}{},
+			relayForByIp:  map[netip.Addr]*Relay{},
+			relayForByIdx: map[uint32]*Relay{},
+		},
+	}, &Interface{})
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+
+	var cbCalls int
+	cb := func(*HandshakeHostInfo) { cbCalls++ }
+
+	hi, status := hm.StartHandshakeWithStatus(ip, cb)
+	assert.Equal(t, HandshakeCreated, status)
+	assert.Same(t, hi, hm.vpnIps[ip].hostinfo)
+	assert.Equal(t, 1, cbCalls)
+
+	hi2, status := hm.StartHandshakeWithStatus(ip, cb)
+	assert.Equal(t, HandshakeAlreadyPending, status)
+	assert.Same(t, hi, hi2)
+	assert.Equal(t, 2, cbCalls)
+
+	hi3, status := hm.StartHandshakeWithStatus(established, cb)
+	assert.Equal(t, HandshakeAlreadyComplete, status)
+	assert.Same(t, mainHM.Hosts[established], hi3)
+	assert.NotContains(t, hm.vpnIps, established)
+	assert.Equal(t, 2, cbCalls)
+
+	// StartHandshake still replaces established tunnels
+	hm.StartHandshake(established, nil)
+	assert.Contains(t, hm.vpnIps, established)
+}
+
+func Test_HandshakeManagerPendingCount(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip1 := netip.MustParseAddr("172.1.1.2")
+	ip2 := netip.MustParseAddr("172.1.1.3")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+
+	h1 := hm.StartHandshake(ip1, nil)
+	assert.Equal(t, int64(1), hm.metricPending.Value())
+
+	// A duplicate does not add to the count
+	hm.StartHandshake(ip1, nil)
+	h2 := hm.StartHandshake(ip2, nil)
+	assert.Equal(t, int64(2), hm.metricPending.Value())
+
+	hm.DeleteHostInfo(h1)
+	assert.Equal(t, int64(1), hm.metricPending.Value())
+
+	h2.ConnectionState = &ConnectionState{}
+	hm.Complete(h2, &Interface{})
+	assert.Equal(t, int64(0), hm.metricPending.Value())
+}
+
+func Test_HandshakeManagerOutOfRange(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.2.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	before := hm.metricOutOfRange.Count()
+
+	var cbCalls int
+	hi, status := hm.StartHandshakeWithStatus(ip, func(*HandshakeHostInfo) { cbCalls++ })
+	assert.Equal(t, HandshakeOutOfRange, status)
+	assert.Nil(t, hi)
+	assert.Nil(t, hm.StartHandshake(ip, nil))
+	assert.Empty(t, hm.vpnIps)
+	assert.Empty(t, hm.indexes)
+	assert.Equal(t, 0, cbCalls)
+	assert.Equal(t, before+2, hm.metricOutOfRange.Count())
+}
+
+func Test_HandshakeManagerPendingSnapshot(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip1 := netip.MustParseAddr("172.1.1.2")
+	ip2 := netip.MustParseAddr("172.1.1.3")
+
+	preferredRanges := []netip.Prefix{netip.MustParsePrefix("10.1.1.1/24")}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	assert.Empty(t, hm.PendingSnapshot())
+
+	start := time.Now()
+	hm.StartHandshake(ip1, nil)
+	h2 := hm.StartHandshake(ip2, nil)
+	h2.remotes = NewRemoteList(nil)
+	h2.remotes.unlockedPrependV4(ip2, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+	h2.remotes.Rebuild(preferredRanges)
+	h2.remotes.unlockedPrependV4(ip2, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.2"), 4242))
+	hm.vpnIps[ip2].counter = 3
+
+	snapshot := hm.PendingSnapshot()
+	assert.Len(t, snapshot, 2)
+
+	byIp := map[netip.Addr]PendingHandshakeInfo{}
+	for _, p := range snapshot {
+		assert.GreaterOrEqual(t, p.Elapsed, time.Duration(0))
+		assert.LessOrEqual(t, p.Elapsed, time.Since(start))
+		byIp[p.VpnIp] = p
+	}
+
+	assert.Equal(t, int64(0), byIp[ip1].Counter)
+	assert.Equal(t, 0, byIp[ip1].Remotes)
+	assert.Equal(t, int64(3), byIp[ip2].Counter)
+	assert.Equal(t, 1, byIp[ip2].Remotes)
+
+	// Nothing should have been modified
+	assert.Len(t, hm.vpnIps, 2)
+	assert.Equal(t, int64(3), hm.vpnIps[ip2].counter)
+	assert.True(t, h2.remotes.shouldRebuild)
+	assert.Len(t, h2.remotes.addrs, 1)
+}
+
+func Test_HandshakeManagerPendingSnapshotLastError(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &countingConn{}
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+
+	// A successful send records nothing
+	hm.handleOutbound(ip, false)
+	snapshot := hm.PendingSnapshot()
+	require.Len(t, snapshot, 1)
+	assert.Empty(t, snapshot[0].LastError)
+
+	// A failed send is kept, along with the address it was sent to
+	conn.err = errors.New("no route to host")
+	hm.handleOutbound(ip, false)
+	snapshot = hm.PendingSnapshot()
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "10.1.1.1:4242: no route to host", snapshot[0].LastError)
+}
+
+func Test_HandshakeManagerRelayOnlyCompleted(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	directIp := netip.MustParseAddr("172.1.1.2")
+	relayedIp := netip.MustParseAddr("172.1.1.3")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	before := hm.metricRelayOnly.Count()
+
+	direct := hm.StartHandshake(directIp, nil)
+	direct.remotes = NewRemoteList(nil)
+	direct.SetRemote(netip.MustParseAddrPort("10.1.1.1:4242"))
+	hm.Complete(direct, hm.f)
+	assert.False(t, direct.relayOnly)
+	assert.Equal(t, before, hm.metricRelayOnly.Count())
+
+	// A handshake answered through a relay never learns a remote
+	relayed := hm.StartHandshake(relayedIp, nil)
+	hm.Complete(relayed, hm.f)
+	assert.True(t, relayed.relayOnly)
+	assert.Equal(t, before+1, hm.metricRelayOnly.Count())
+	assert.True(t, copyHostInfo(relayed, preferredRanges).RelayOnly)
+
+	// The same applies when we are the responder
+	newResponder := func(vpnIp netip.Addr, localIndex uint32) *HostInfo {
+		return &HostInfo{
+			vpnIp:           vpnIp,
+			localIndexId:    localIndex,
+			remoteIndexId:   localIndex,
+			HandshakePacket: map[uint8][]byte{0: {byte(localIndex)}},
+			ConnectionState: &ConnectionState{},
+			remotes:         NewRemoteList(nil),
+			relayState: RelayState{
+				relays:        map[netip.Addr]struct{}{},
+				relayForByIp:  map[netip.Addr]*Relay{},
+				relayForByIdx: map[uint32]*Relay{},
+			},
+		}
+	}
+
+	directResponder := newResponder(netip.MustParseAddr("172.1.1.4"), 1001)
+	directResponder.SetRemote(netip.MustParseAddrPort("10.1.1.2:4242"))
+	_, err := hm.CheckAndComplete(directResponder, 0, hm.f)
+	require.NoError(t, err)
+	assert.False(t, directResponder.relayOnly)
+	assert.Equal(t, before+1, hm.metricRelayOnly.Count())
+
+	relayedResponder := newResponder(netip.MustParseAddr("172.1.1.5"), 1002)
+	_, err = hm.CheckAndComplete(relayedResponder, 0, hm.f)
+	require.NoError(t, err)
+	assert.True(t, relayedResponder.relayOnly)
+	assert.Equal(t, before+2, hm.metricRelayOnly.Count())
+	assert.True(t, copyHostInfo(relayedResponder, preferredRanges).RelayOnly)
+}
+
+func Test_HandshakeManagerEmitStatsInterval(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	config := defaultHandshakeConfig
+	config.statsInterval = time.Second
+	clock := newFakeHandshakeClock()
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, config)
+	hm.clock = clock
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+
+	pending := metrics.GetOrRegisterGauge("hostmap.pending.hosts", nil)
+	hm.EmitStats()
+	assert.Equal(t, int64(0), pending.Value())
+
+	// Calls within the interval are served from the snapshot
+	hm.StartHandshake(netip.MustParseAddr("172.1.1.2"), nil)
+	clock.now = clock.now.Add(time.Second - time.Millisecond)
+	hm.EmitStats()
+	assert.Equal(t, int64(0), pending.Value())
+
+	clock.now = clock.now.Add(time.Millisecond)
+	hm.EmitStats()
+	assert.Equal(t, int64(1), pending.Value())
+}
+
+func Test_HandshakeManagerUnreachable(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &countingConn{err: &net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.ENETUNREACH)}}
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+	before := hm.metricUnreachable.Count()
+	timedOut := hm.styleMetrics(header.HandshakeIXPSK0).timedOut
+	beforeTimedOut := timedOut.Count()
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.2"), 4242))
+
+	// A single success resets the streak
+	for i := 0; i < handshakeUnreachableAttempts-1; i++ {
+		hm.handleOutbound(ip, false)
+	}
+	conn.err = nil
+	hm.handleOutbound(ip, false)
+	require.NotNil(t, hm.queryVpnIp(ip))
+
+	conn.err = syscall.EHOSTUNREACH
+	conn.writes = 0
+	for i := 0; i < DefaultHandshakeRetries; i++ {
+		hm.handleOutbound(ip, false)
+	}
+
+	// The handshake was abandoned well before its retry budget was spent
+	assert.Nil(t, hm.queryVpnIp(ip))
+	assert.Equal(t, 2*handshakeUnreachableAttempts, conn.writes)
+	assert.Equal(t, before+1, hm.metricUnreachable.Count())
+	assert.Equal(t, beforeTimedOut+1, timedOut.Count())
+}
+
+func Test_HandshakeManagerAttemptHistory(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	remote := netip.MustParseAddrPort("10.1.1.1:4242")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &countingConn{}
+	clock := newFakeHandshakeClock()
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, defaultHandshakeConfig)
+	hm.clock = clock
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(remote.Addr(), remote.Port()))
+
+	start := clock.Now()
+	hm.handleOutbound(ip, false)
+	clock.now = clock.now.Add(time.Second)
+	conn.err = errors.New("no route to host")
+	hm.handleOutbound(ip, false)
+	clock.now = clock.now.Add(time.Second)
+	conn.err = nil
+	hm.handleOutbound(ip, false)
+
+	history := hm.AttemptHistory(ip)
+	require.Len(t, history, 3)
+	for i, r := range history {
+		assert.Equal(t, int64(i+1), r.Attempt)
+		assert.Equal(t, start.Add(time.Duration(i)*time.Second), r.Time)
+		assert.False(t, r.Relayed)
+	}
+	assert.Equal(t, []netip.AddrPort{remote}, history[0].Sent)
+	assert.Empty(t, history[0].Failed)
+	assert.Empty(t, history[1].Sent)
+	assert.Equal(t, []netip.AddrPort{remote}, history[1].Failed)
+	assert.Equal(t, []netip.AddrPort{remote}, history[2].Sent)
+
+	// The history goes with the pending handshake
+	hm.DeleteHostInfo(hi)
+	assert.Nil(t, hm.AttemptHistory(ip))
+}
+
+func Test_HandshakeManagerOnSend(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	var seen []netip.AddrPort
+	var packets [][]byte
+	config := defaultHandshakeConfig
+	config.onSend = func(pkt []byte, addr netip.AddrPort) {
+		seen = append(seen, addr)
+		packets = append(packets, pkt)
+	}
+
+	conn := &countingConn{}
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, config)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.2"), 4242))
+
+	hm.handleOutbound(ip, false)
+	hm.handleOutbound(ip, false)
+
+	// The hook sees every send, in order, with the packet that was sent
+	assert.Equal(t, conn.addrs, seen)
+	assert.Len(t, seen, 4)
+	for _, pkt := range packets {
+		assert.Equal(t, hi.HandshakePacket[0], pkt)
+	}
+}
+
+// fakeHandshakeClock only moves forward when Tick is called
+type fakeHandshakeClock struct {
+	sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeHandshakeClock() *fakeHandshakeClock {
+	return &fakeHandshakeClock{now: time.Unix(1700000000, 0), ticks: make(chan time.Time)}
+}
+
+func (c *fakeHandshakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeHandshakeClock) NewTicker(_ time.Duration) (<-chan time.Time, func()) {
+	return c.ticks, func() {}
+}
+
+// Tick advances the clock by d and blocks until the ticker consumer has received it
+func (c *fakeHandshakeClock) Tick(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.Unlock()
+	c.ticks <- now
+}
+
+func Test_HandshakeManagerFakeClock(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &countingConn{}
+	clock := newFakeHandshakeClock()
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, defaultHandshakeConfig)
+	hm.clock = clock
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hm.Run(ctx)
+		close(done)
+	}()
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+
+	// Drive the clock well past the handshake timeout without sleeping
+	timeout := hsTimeout(defaultHandshakeConfig.maxRetries(), defaultHandshakeConfig.tryInterval)
+	for elapsed := time.Duration(0); elapsed <= 2*timeout; elapsed += defaultHandshakeConfig.tryInterval {
+		clock.Tick(defaultHandshakeConfig.tryInterval)
+	}
+
+	cancel()
+	<-done
+
+	// Every direct attempt was sent before the handshake timed out
+	assert.Equal(t, DefaultHandshakeRetries, conn.writes)
+	assert.Nil(t, hm.queryVpnIp(ip))
+}
+
 func testCountTimerWheelEntries(tw *LockingTimerWheel[netip.Addr]) (c int) {
 	for _, i := range tw.t.wheel {
 		n := i.Head
@@ -92,3 +650,574 @@ func (mw *mockEncWriter) SendMessageToHostInfo(t header.MessageType, st header.M
 }
 
 func (mw *mockEncWriter) Handshake(vpnIP netip.Addr) {}
+
+func Test_HandshakeManagerRelayDenylist(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	allowedRelay := netip.MustParseAddr("172.1.1.10")
+	deniedRelay := netip.MustParseAddr("172.1.1.20")
+
+	c := config.NewC(l)
+	c.Settings["relay"] = map[interface{}]interface{}{"denylist": []interface{}{"172.1.1.20", "172.1.1.128/25"}}
+	denylist, err := parseRelayDenylist(c)
+	require.NoError(t, err)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	newHM := func(dest netip.Addr) *HandshakeManager {
+		preferredRanges := []netip.Prefix{}
+		mainHM := newHostMap(l, vpncidr)
+		mainHM.preferredRanges.Store(&preferredRanges)
+
+		config := defaultHandshakeConfig
+		config.relayDenylist = denylist
+		hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, config)
+		hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+		hm.f.pki.cs.Store(cs)
+
+		hi := hm.StartHandshake(dest, func(hh *HandshakeHostInfo) {
+			hh.ready = true
+			hh.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+		})
+		hi.remotes = NewRemoteList(nil)
+		hi.remotes.relays = []netip.Addr{allowedRelay, deniedRelay}
+
+		hm.handleOutbound(dest, false)
+		return hm
+	}
+
+	// A denied relay is never used but others still are
+	hm := newHM(ip)
+	assert.Contains(t, hm.vpnIps, allowedRelay)
+	assert.NotContains(t, hm.vpnIps, deniedRelay)
+
+	// A denied destination is never reached through a relay
+	hm = newHM(netip.MustParseAddr("172.1.1.200"))
+	assert.NotContains(t, hm.vpnIps, allowedRelay)
+	assert.NotContains(t, hm.vpnIps, deniedRelay)
+
+	// Bad entries are rejected
+	c.Settings["relay"] = map[interface{}]interface{}{"denylist": []interface{}{"not an ip"}}
+	_, err = parseRelayDenylist(c)
+	require.Error(t, err)
+
+	// An empty list disables the check
+	c.Settings["relay"] = map[interface{}]interface{}{}
+	denylist, err = parseRelayDenylist(c)
+	require.NoError(t, err)
+	assert.Nil(t, denylist)
+	assert.False(t, (&HandshakeConfig{}).relayDenied(deniedRelay))
+}
+
+func Test_HandshakeManagerRelayOrder(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	far := netip.MustParseAddr("172.1.1.10")
+	unknown := netip.MustParseAddr("172.1.1.11")
+	near := netip.MustParseAddr("172.1.1.12")
+
+	preferredRanges := []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+	f := &Interface{}
+	mainHM.unlockedAddHostInfo(&HostInfo{vpnIp: far, localIndexId: 1, remote: netip.MustParseAddrPort("10.1.1.1:4242")}, f)
+	mainHM.unlockedAddHostInfo(&HostInfo{vpnIp: near, localIndexId: 2, remote: netip.MustParseAddrPort("192.168.1.1:4242")}, f)
+
+	relays := []netip.Addr{far, unknown, near}
+
+	// The stored order is kept by default
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	assert.Equal(t, relays, hm.orderRelays(relays))
+
+	// The relay reached over a preferred range is tried first, the rest keep their order
+	hm.config.relayOrder = RelayOrderPreferredRanges
+	assert.Equal(t, []netip.Addr{near, far, unknown}, hm.orderRelays(relays))
+	assert.Equal(t, []netip.Addr{far, unknown, near}, relays)
+}
+
+type countingConn struct {
+	udp.NoopConn
+	writes int
+	addrs  []netip.AddrPort
+	err    error
+}
+
+func (c *countingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	c.writes++
+	c.addrs = append(c.addrs, addr)
+	return c.err
+}
+
+// blockingConn blocks writes to block until release is closed, writes to anything else succeed immediately
+type blockingConn struct {
+	udp.NoopConn
+	block   netip.AddrPort
+	release chan struct{}
+
+	sync.Mutex
+	addrs   []netip.AddrPort
+	blocked int
+}
+
+func (c *blockingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	if addr == c.block {
+		c.Lock()
+		c.blocked++
+		c.Unlock()
+		<-c.release
+	}
+	c.Lock()
+	c.addrs = append(c.addrs, addr)
+	c.Unlock()
+	return nil
+}
+
+func Test_HandshakeManagerSendTimeout(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	stuck := netip.MustParseAddrPort("10.1.1.1:4242")
+	good := netip.MustParseAddrPort("10.1.1.2:4242")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &blockingConn{block: stuck, release: make(chan struct{})}
+	defer close(conn.release)
+
+	config := defaultHandshakeConfig
+	config.sendTimeout = 10 * time.Millisecond
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, config)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+	before := hm.metricSendTimeout.Count()
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(good.Addr(), good.Port()))
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(stuck.Addr(), stuck.Port()))
+
+	// The stuck remote is tried first and must not hold up the send to the other one
+	start := time.Now()
+	hm.handleOutbound(ip, false)
+	assert.Less(t, time.Since(start), time.Second)
+
+	conn.Lock()
+	assert.Equal(t, []netip.AddrPort{good}, conn.addrs)
+	conn.Unlock()
+	assert.Equal(t, before+1, hm.metricSendTimeout.Count())
+
+	snapshot := hm.PendingSnapshot()
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "10.1.1.1:4242: handshake send timed out", snapshot[0].LastError)
+
+	// Later attempts do not start another write behind the stuck one
+	for i := 0; i < 5; i++ {
+		hm.handleOutbound(ip, false)
+	}
+	conn.Lock()
+	assert.Equal(t, 1, conn.blocked)
+	assert.Len(t, conn.addrs, 6)
+	conn.Unlock()
+	assert.Equal(t, before+6, hm.metricSendTimeout.Count())
+}
+
+func Test_HandshakeManagerRelayRetries(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	relay := netip.MustParseAddr("172.1.1.10")
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	// run handshakes until the handshake for ip times out, returning the number of direct and relayed attempts
+	run := func(retries, relayRetries int64) (int, int64) {
+		preferredRanges := []netip.Prefix{}
+		mainHM := newHostMap(l, vpncidr)
+		mainHM.preferredRanges.Store(&preferredRanges)
+
+		config := defaultHandshakeConfig
+		config.retries = retries
+		config.relayRetries = relayRetries
+		conn := &countingConn{}
+		hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, config)
+		hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+		hm.f.pki.cs.Store(cs)
+
+		var hh *HandshakeHostInfo
+		hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+			hh = h
+			h.ready = true
+			h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+		})
+		hi.remotes = NewRemoteList(nil)
+		hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+		hi.remotes.unlockedSetRelay(ip, ip, []netip.Addr{relay})
+
+		for i := 0; i < 100 && hm.queryVpnIp(ip) != nil; i++ {
+			hm.handleOutbound(ip, false)
+		}
+		assert.Nil(t, hm.queryVpnIp(ip))
+
+		return conn.writes, hh.relayCount
+	}
+
+	// Direct attempts continue after the relay budget is spent
+	writes, relayed := run(5, 2)
+	assert.Equal(t, 5, writes)
+	assert.Equal(t, int64(2), relayed)
+
+	// Relay attempts continue after the direct budget is spent
+	writes, relayed = run(2, 4)
+	assert.Equal(t, 2, writes)
+	assert.Equal(t, int64(4), relayed)
+
+	// Defaults share the same budget
+	writes, relayed = run(defaultHandshakeConfig.retries, defaultHandshakeConfig.relayRetries)
+	assert.Equal(t, DefaultHandshakeRetries, writes)
+	assert.Equal(t, int64(DefaultHandshakeRetries), relayed)
+}
+
+func Test_HandshakeManagerMaxRemotesPerAttempt(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	config := defaultHandshakeConfig
+	config.maxRemotesPerAttempt = 2
+	conn := &countingConn{}
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, config)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	for i := 1; i <= 5; i++ {
+		hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.AddrFrom4([4]byte{10, 1, 1, byte(i)}), 4242))
+	}
+
+	contacted := map[netip.AddrPort]int{}
+	for tick := 1; tick <= 3; tick++ {
+		conn.addrs = nil
+		hm.handleOutbound(ip, false)
+		assert.LessOrEqual(t, len(conn.addrs), 2)
+		for _, addr := range conn.addrs {
+			contacted[addr]++
+		}
+	}
+
+	// Every remote was tried within 3 attempts, with only 1 contacted twice
+	assert.Len(t, contacted, 5)
+	assert.Equal(t, 6, conn.writes)
+
+	// No limit sends to everything each attempt
+	hm.config.maxRemotesPerAttempt = 0
+	conn.addrs = nil
+	hm.handleOutbound(ip, false)
+	assert.Len(t, conn.addrs, 5)
+}
+
+func Test_HandshakeManagerCoalesceTrigger(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	conn := &countingConn{}
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), conn, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(cs)
+
+	hi := hm.StartHandshake(ip, func(h *HandshakeHostInfo) {
+		h.ready = true
+		h.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+	})
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+
+	// A timer attempt followed immediately by a lighthouse trigger with a new remote only sends once
+	hm.handleOutbound(ip, false)
+	assert.Equal(t, 1, conn.writes)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.2"), 4242))
+	hm.handleOutbound(ip, true)
+	assert.Equal(t, 1, conn.writes)
+
+	// Once the window has passed the trigger sends to the new remotes
+	hh := hm.queryVpnIp(ip)
+	hh.lastSend = time.Now().Add(-handshakeSendCoalesceWindow)
+	hm.handleOutbound(ip, true)
+	assert.Equal(t, 3, conn.writes)
+}
+
+func Test_HandshakeManagerRequeryBackoff(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	cs := &CertState{
+		RawCertificate:      []byte{},
+		PrivateKey:          []byte{},
+		Certificate:         &dummyCert{},
+		RawCertificateNoKey: []byte{},
+	}
+
+	// queries runs a handshake through every attempt and returns how many lighthouse queries it sent
+	queries := func(retries, requeryInterval int64) int {
+		preferredRanges := []netip.Prefix{}
+		mainHM := newHostMap(l, vpncidr)
+		mainHM.preferredRanges.Store(&preferredRanges)
+
+		lh := newTestLighthouse()
+		lh.queryChan = make(chan netip.Addr, 100)
+
+		config := defaultHandshakeConfig
+		config.retries = retries
+		config.relayRetries = 0
+		config.requeryInterval = requeryInterval
+		hm := NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, config)
+		hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+		hm.f.pki.cs.Store(cs)
+
+		hi := hm.StartHandshake(ip, func(hh *HandshakeHostInfo) {
+			hh.ready = true
+			hh.hostinfo.HandshakePacket[0] = make([]byte, header.Len)
+		})
+		hi.remotes = NewRemoteList(nil)
+		hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(netip.MustParseAddr("10.1.1.1"), 4242))
+
+		// The first query is sent right away
+		assert.Len(t, lh.queryChan, 1)
+
+		for i := 0; i < 100 && hm.queryVpnIp(ip) != nil; i++ {
+			hm.handleOutbound(ip, false)
+		}
+		assert.Nil(t, hm.queryVpnIp(ip))
+		return len(lh.queryChan)
+	}
+
+	// The defaults send no more queries than before, the initial one and one after 5 attempts
+	assert.Equal(t, 2, queries(DefaultHandshakeRetries, DefaultHandshakeRequeryInterval))
+
+	// A long handshake backs off, querying after attempts 5, 15, and 35
+	assert.Equal(t, 4, queries(40, DefaultHandshakeRequeryInterval))
+
+	// The interval is configurable, 0 only sends the initial query
+	assert.Equal(t, 3, queries(40, 10))
+	assert.Equal(t, 1, queries(40, 0))
+}
+
+func Test_HandshakeManagerExportImportPending(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+	stale := netip.MustParseAddr("172.1.1.3")
+	remote := netip.MustParseAddrPort("10.1.1.1:4242")
+
+	newHM := func() *HandshakeManager {
+		preferredRanges := []netip.Prefix{}
+		mainHM := newHostMap(l, vpncidr)
+		mainHM.preferredRanges.Store(&preferredRanges)
+		lh := newTestLighthouse()
+		lh.myVpnNet = vpncidr
+		lh.remoteAllowList.Store(&RemoteAllowList{})
+		return NewHandshakeManager(l, mainHM, lh, &udp.NoopConn{}, defaultHandshakeConfig)
+	}
+
+	old := newHM()
+	hi := old.StartHandshake(ip, nil)
+	hi.remotes = NewRemoteList(nil)
+	hi.remotes.unlockedPrependV4(ip, NewIp4AndPortFromNetIP(remote.Addr(), remote.Port()))
+	old.vpnIps[ip].counter = 3
+
+	old.StartHandshake(stale, nil)
+	old.vpnIps[stale].startTime = time.Now().Add(-time.Hour)
+
+	b, err := old.ExportPending()
+	require.NoError(t, err)
+
+	hm := newHM()
+	require.NoError(t, hm.ImportPending(b))
+
+	// The stale entry is not resumed
+	assert.NotContains(t, hm.vpnIps, stale)
+
+	require.Contains(t, hm.vpnIps, ip)
+	hh := hm.vpnIps[ip]
+	assert.Equal(t, int64(3), hh.counter)
+	assert.Equal(t, old.vpnIps[ip].startTime.UnixNano(), hh.startTime.UnixNano())
+	assert.Equal(t, []netip.AddrPort{remote}, hm.lightHouse.QueryCache(ip).CopyAddrs(nil))
+
+	// Importing again leaves the existing handshake alone
+	hh.counter = 4
+	require.NoError(t, hm.ImportPending(b))
+	assert.Equal(t, int64(4), hm.vpnIps[ip].counter)
+
+	assert.Error(t, hm.ImportPending([]byte("nope")))
+}
+
+func Test_HandshakeManagerTriggerAndWait(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+
+	wait := func(ctx context.Context, vpnIp netip.Addr) chan error {
+		res := make(chan error, 1)
+		go func() { res <- hm.TriggerAndWait(ctx, vpnIp) }()
+		assert.Eventually(t, func() bool {
+			hm.RLock()
+			defer hm.RUnlock()
+			return len(hm.waiters[vpnIp]) > 0 && hm.vpnIps[vpnIp] != nil
+		}, time.Second, time.Millisecond)
+		return res
+	}
+
+	// Completing the handshake wakes the waiter
+	res := wait(context.Background(), ip)
+	hm.Complete(hm.QueryVpnIp(ip), hm.f)
+	assert.NoError(t, <-res)
+	assert.Empty(t, hm.waiters)
+
+	// An established tunnel returns right away
+	assert.NoError(t, hm.TriggerAndWait(context.Background(), ip))
+	assert.Empty(t, hm.waiters)
+
+	// The context running out leaves the handshake pending
+	ip = netip.MustParseAddr("172.1.1.3")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, <-wait(ctx, ip), context.DeadlineExceeded)
+	assert.NotNil(t, hm.QueryVpnIp(ip))
+	assert.Empty(t, hm.waiters)
+
+	// A handshake that fails reports why
+	res = wait(context.Background(), ip)
+	hm.DeleteHostInfo(hm.QueryVpnIp(ip))
+	assert.ErrorIs(t, <-res, ErrHandshakeAbandoned)
+
+	// The wrong host responding fails the waiters for the intended host and leaves those for the responder alone
+	wrongIp := netip.MustParseAddr("172.1.1.4")
+	res = wait(context.Background(), ip)
+	wrongRes := wait(context.Background(), wrongIp)
+	hh := hm.queryVpnIp(ip)
+	hm.deleteHostInfo(hh.hostinfo, ErrHandshakeWrongHost)
+	hh.hostinfo.vpnIp = wrongIp
+	hm.abandonPending(hh)
+	assert.ErrorIs(t, <-res, ErrHandshakeWrongHost)
+	assert.NotNil(t, hm.QueryVpnIp(wrongIp))
+	assert.Len(t, hm.waiters[wrongIp], 1)
+
+	hm.abandonPending(hm.queryVpnIp(wrongIp))
+	assert.ErrorIs(t, <-wrongRes, ErrHandshakeAbandoned)
+	assert.Nil(t, hm.QueryVpnIp(wrongIp))
+
+	assert.ErrorIs(t, hm.TriggerAndWait(context.Background(), netip.MustParseAddr("10.1.1.1")), ErrHandshakeOutOfRange)
+	assert.Empty(t, hm.waiters)
+}
+
+func Test_HandshakeManagerStyleMetrics(t *testing.T) {
+	l := test.NewLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+	ip := netip.MustParseAddr("172.1.1.2")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+
+	// The default style keeps the original names
+	ix := hm.styleMetrics(header.HandshakeIXPSK0)
+	assert.Same(t, metrics.GetOrRegisterCounter("handshake_manager.initiated", nil), ix.initiated)
+	assert.Same(t, metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil), ix.timedOut)
+
+	before := ix.initiated.Count()
+	hm.StartHandshake(ip, nil)
+	assert.Equal(t, before+1, ix.initiated.Count())
+
+	// Other styles get their own counters
+	xx := hm.styleMetrics(header.HandshakeXXPSK0)
+	assert.Same(t, xx, hm.styleMetrics(header.HandshakeXXPSK0))
+	assert.NotSame(t, ix.initiated, xx.initiated)
+	assert.Same(t, metrics.GetOrRegisterCounter("handshake_manager.unknown_1.initiated", nil), xx.initiated)
+	assert.Same(t, metrics.GetOrRegisterCounter("handshake_manager.unknown_1.timed_out", nil), xx.timedOut)
+}
+
+func Test_HandshakeManagerTimeoutLogStyle(t *testing.T) {
+	l, hook := logtest.NewNullLogger()
+	vpncidr := netip.MustParsePrefix("172.1.1.1/24")
+
+	preferredRanges := []netip.Prefix{}
+	mainHM := newHostMap(l, vpncidr)
+	mainHM.preferredRanges.Store(&preferredRanges)
+
+	hm := NewHandshakeManager(l, mainHM, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, myVpnNet: vpncidr, pki: &PKI{}, l: l}
+
+	for i, style := range []header.MessageSubType{header.HandshakeIXPSK0, header.HandshakeXXPSK0} {
+		ip := netip.AddrFrom4([4]byte{172, 1, 1, byte(2 + i)})
+		hm.StartHandshake(ip, nil)
+		hh := hm.queryVpnIp(ip)
+		hh.style = style
+		hh.counter = hm.config.maxRetries()
+
+		hm.handleOutbound(ip, false)
+		require.NotNil(t, hook.LastEntry())
+		assert.Equal(t, "Handshake timed out", hook.LastEntry().Message)
+		assert.Equal(t, m{"stage": 1, "style": header.SubTypeName(header.Handshake, style)}, hook.LastEntry().Data["handshake"])
+		assert.Nil(t, hm.QueryVpnIp(ip))
+	}
+}
@@ -216,6 +216,9 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote netip.AddrPort
 
+	// relayOnly is true if the handshake, as initiator or responder, completed through a relay without a direct address
+	relayOnly bool
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -290,19 +293,35 @@ func (hm *HostMap) reload(c *config.C, initial bool) {
 	}
 }
 
-// EmitStats reports host, index, and relay counts to the stats collection system
-func (hm *HostMap) EmitStats() {
+// hostMapStats are the counts EmitStats reports, taken together under a single read lock
+type hostMapStats struct {
+	hosts         int
+	indexes       int
+	remoteIndexes int
+	relays        int
+}
+
+func (hm *HostMap) stats() hostMapStats {
 	hm.RLock()
-	hostLen := len(hm.Hosts)
-	indexLen := len(hm.Indexes)
-	remoteIndexLen := len(hm.RemoteIndexes)
-	relaysLen := len(hm.Relays)
-	hm.RUnlock()
+	defer hm.RUnlock()
+	return hostMapStats{
+		hosts:         len(hm.Hosts),
+		indexes:       len(hm.Indexes),
+		remoteIndexes: len(hm.RemoteIndexes),
+		relays:        len(hm.Relays),
+	}
+}
+
+func (s hostMapStats) emit() {
+	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(s.hosts))
+	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(s.indexes))
+	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(s.remoteIndexes))
+	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(s.relays))
+}
 
-	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(hostLen))
-	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(indexLen))
-	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(remoteIndexLen))
-	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
+// EmitStats reports host, index, and relay counts to the stats collection system
+func (hm *HostMap) EmitStats() {
+	hm.stats().emit()
 }
 
 func (hm *HostMap) RemoveRelay(localIdx uint32) {
@@ -406,6 +406,7 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 	defer ticker.Stop()
 
 	udpStats := udp.NewUDPStatsEmitter(f.writers)
+	tunStats := overlay.NewStatsEmitter(f.inside)
 
 	certExpirationGauge := metrics.GetOrRegisterGauge("certificate.ttl_seconds", nil)
 
@@ -417,6 +418,7 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 			f.firewall.EmitStats()
 			f.handshakeManager.EmitStats()
 			udpStats()
+			tunStats()
 			certExpirationGauge.Update(int64(f.pki.GetCertState().Certificate.NotAfter().Sub(time.Now()) / time.Second))
 		}
 	}
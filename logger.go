@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -24,7 +25,13 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 		timestampFormat = time.RFC3339
 	}
 
-	logFormat := strings.ToLower(c.GetString("logging.format", "text"))
+	logFormat, err := c.LookupEnum("logging.format", []string{"text", "json"})
+	if errors.Is(err, config.ErrKeyNotFound) {
+		logFormat = "text"
+	} else if err != nil {
+		return err
+	}
+
 	switch logFormat {
 	case "text":
 		l.Formatter = &logrus.TextFormatter{
@@ -37,8 +44,6 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 			TimestampFormat:  timestampFormat,
 			DisableTimestamp: disableTimestamp,
 		}
-	default:
-		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
 	return nil
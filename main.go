@@ -49,7 +49,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
 	}
 
-	c.RegisterReloadCallback(func(c *config.C) {
+	c.OnKeyChange("logging", func(_, _ interface{}) {
 		err := configLogger(l, c)
 		if err != nil {
 			l.WithError(err).Error("Failed to configure the logger")
@@ -202,12 +202,32 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	}
 
 	useRelays := c.GetBool("relay.use_relays", DefaultUseRelays) && !c.GetBool("relay.am_relay", false)
+	relayDenylist, err := parseRelayDenylist(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to parse relay.denylist", err)
+	}
 
+	relayOrder := c.GetString("handshakes.relay_order", RelayOrderStored)
+	if relayOrder != RelayOrderStored && relayOrder != RelayOrderPreferredRanges {
+		return nil, util.NewContextualError("Invalid handshakes.relay_order", m{"relayOrder": relayOrder}, nil)
+	}
+
+	tryInterval := c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval)
+	retries := int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries))
 	handshakeConfig := HandshakeConfig{
-		tryInterval:   c.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
-		retries:       int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
+		tryInterval:   tryInterval,
+		initialDelay:  c.GetDuration("handshakes.initial_delay", tryInterval),
+		retries:       retries,
+		relayRetries:  int64(c.GetInt("handshakes.relay_retries", int(retries))),
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
 		useRelays:     useRelays,
+		relayDenylist: relayDenylist,
+
+		maxRemotesPerAttempt: c.GetInt("handshakes.max_remotes_per_attempt", 0),
+		requeryInterval:      int64(c.GetInt("handshakes.requery_interval", DefaultHandshakeRequeryInterval)),
+		relayOrder:           relayOrder,
+		statsInterval:        c.GetDuration("handshakes.stats_interval", 0),
+		sendTimeout:          c.GetDuration("handshakes.send_timeout", 0),
 
 		messageMetrics: messageMetrics,
 	}
@@ -224,8 +244,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
-	checkInterval := c.GetInt("timers.connection_alive_interval", 5)
-	pendingDeletionInterval := c.GetInt("timers.pending_deletion_interval", 10)
+	checkInterval := c.GetSeconds("timers.connection_alive_interval", 5)
+	pendingDeletionInterval := c.GetSeconds("timers.pending_deletion_interval", 10)
 
 	ifConfig := &InterfaceConfig{
 		HostMap:                 hostMap,
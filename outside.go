@@ -509,7 +509,7 @@ func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPo
 		return nil, fmt.Errorf("error unmarshaling cert: %w", err)
 	}
 
-	cc, err := caPool.VerifyCertificate(time.Now(), c)
+	cc, err := caPool.Verify(c)
 	if err != nil {
 		return nil, fmt.Errorf("certificate validation failed: %w", err)
 	}
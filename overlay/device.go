@@ -3,6 +3,8 @@ package overlay
 import (
 	"io"
 	"net/netip"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 type Device interface {
@@ -13,3 +15,30 @@ type Device interface {
 	RouteFor(netip.Addr) netip.Addr
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
+
+// StatsDevice is implemented by devices that count the traffic passing through them
+type StatsDevice interface {
+	// Stats returns the total bytes read and written and the number of failed reads and writes
+	Stats() (rx, tx, rxErr, txErr uint64)
+}
+
+// NewStatsEmitter returns a function that publishes the tun.* gauges for d, it does nothing if d is not a StatsDevice
+func NewStatsEmitter(d Device) func() {
+	sd, ok := d.(StatsDevice)
+	if !ok {
+		return func() {}
+	}
+
+	rxBytes := metrics.GetOrRegisterGauge("tun.rx_bytes", nil)
+	txBytes := metrics.GetOrRegisterGauge("tun.tx_bytes", nil)
+	rxErrors := metrics.GetOrRegisterGauge("tun.rx_errors", nil)
+	txErrors := metrics.GetOrRegisterGauge("tun.tx_errors", nil)
+
+	return func() {
+		rx, tx, rxErr, txErr := sd.Stats()
+		rxBytes.Update(int64(rx))
+		txBytes.Update(int64(tx))
+		rxErrors.Update(int64(rxErr))
+		txErrors.Update(int64(txErr))
+	}
+}
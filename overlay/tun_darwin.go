@@ -10,6 +10,8 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"unsafe"
@@ -27,13 +29,22 @@ type tun struct {
 	Device     string
 	cidr       netip.Prefix
 	DefaultMTU int
+	TXQueueLen int
+	clampMTU   bool
 	Routes     atomic.Pointer[[]Route]
 	routeTree  atomic.Pointer[bart.Table[netip.Addr]]
 	linkAddr   *netroute.LinkAddr
+	fd         int
 	l          *logrus.Logger
 
 	// cache out buffer since we need to prepend 4 bytes for tun metadata
 	out []byte
+
+	// traffic counters, see Stats
+	rxBytes  atomic.Uint64
+	txBytes  atomic.Uint64
+	rxErrors atomic.Uint64
+	txErrors atomic.Uint64
 }
 
 type sockaddrCtl struct {
@@ -61,6 +72,16 @@ const (
 	utunControlName   = "com.apple.net.utun_control"
 )
 
+// tunOverhead is what nebula adds to every tun packet before it is sent on the underlying interface, an IPv6 header
+// (40), a UDP header (8), the nebula header (16), and the AEAD tag (16)
+const tunOverhead = 80
+
+// setsockoptInt is swapped out in tests
+var setsockoptInt = unix.SetsockoptInt
+
+// underlayMTU is swapped out in tests
+var underlayMTU = defaultRouteMTU
+
 type ifreqAddr struct {
 	Name [16]byte
 	Addr unix.RawSockaddrInet4
@@ -73,17 +94,44 @@ type ifreqMTU struct {
 	pad  [8]byte
 }
 
+// parseUtunUnit returns the unit number requested by a device name of the form utun<N>, or -1 if the kernel should
+// choose the unit because name is empty or just utun.
+func parseUtunUnit(name string) (int, error) {
+	if name == "" || name == "utun" {
+		return -1, nil
+	}
+
+	n, ok := strings.CutPrefix(name, "utun")
+	if !ok {
+		return -1, fmt.Errorf("%q does not start with utun", name)
+	}
+
+	unit, err := strconv.ParseUint(n, 10, 31)
+	if err != nil {
+		return -1, fmt.Errorf("%q has an invalid unit number: %w", name, err)
+	}
+
+	return int(unit), nil
+}
+
+func connectCtl(fd int, sc *sockaddrCtl) syscall.Errno {
+	_, _, errno := unix.RawSyscall(
+		unix.SYS_CONNECT,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(sc)),
+		sockaddrCtlSize,
+	)
+	return errno
+}
+
 func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, _ bool) (*tun, error) {
 	name := c.GetString("tun.dev", "")
-	ifIndex := -1
-	if name != "" && name != "utun" {
-		_, err := fmt.Sscanf(name, "utun%d", &ifIndex)
-		if err != nil || ifIndex < 0 {
-			// NOTE: we don't make this error so we don't break existing
-			// configs that set a name before it was used.
-			l.Warn("interface name must be utun[0-9]+ on Darwin, ignoring")
-			ifIndex = -1
-		}
+	ifIndex, err := parseUtunUnit(name)
+	if err != nil {
+		// NOTE: we don't make this error so we don't break existing
+		// configs that set a name before it was used.
+		l.WithError(err).Warn("interface name must be utun[0-9]+ on Darwin, ignoring")
+		ifIndex = -1
 	}
 
 	fd, err := unix.Socket(_PF_SYSTEM, unix.SOCK_DGRAM, _SYSPROTO_CONTROL)
@@ -111,12 +159,13 @@ func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, _ bool) (*tun, err
 		scUnit:    uint32(ifIndex) + 1,
 	}
 
-	_, _, errno := unix.RawSyscall(
-		unix.SYS_CONNECT,
-		uintptr(fd),
-		uintptr(unsafe.Pointer(&sc)),
-		sockaddrCtlSize,
-	)
+	errno := connectCtl(fd, &sc)
+	if errno == unix.EBUSY && ifIndex >= 0 {
+		// The requested unit is taken, let the kernel pick one rather than failing to start
+		l.WithField("requestedDevice", name).Warn("requested utun device is in use, using the next available device")
+		sc.scUnit = 0
+		errno = connectCtl(fd, &sc)
+	}
 	if errno != 0 {
 		return nil, fmt.Errorf("SYS_CONNECT: %v", errno)
 	}
@@ -147,6 +196,9 @@ func newTun(c *config.C, l *logrus.Logger, cidr netip.Prefix, _ bool) (*tun, err
 		Device:          name,
 		cidr:            cidr,
 		DefaultMTU:      c.GetInt("tun.mtu", DefaultMTU),
+		TXQueueLen:      c.GetInt("tun.tx_queue", 0),
+		clampMTU:        c.GetBool("tun.clamp_mtu", false),
+		fd:              fd,
 		l:               l,
 	}
 
@@ -234,19 +286,14 @@ func (t *tun) Activate() error {
 	}
 
 	// Set the MTU on the device
+	t.DefaultMTU = t.effectiveMTU(t.DefaultMTU)
 	ifm := ifreqMTU{Name: devName, MTU: int32(t.DefaultMTU)}
 	if err = ioctl(fd, unix.SIOCSIFMTU, uintptr(unsafe.Pointer(&ifm))); err != nil {
 		return fmt.Errorf("failed to set tun mtu: %v", err)
 	}
 
-	/*
-		// Set the transmit queue length
-		ifrq := ifreqQLEN{Name: devName, Value: int32(t.TXQueueLen)}
-		if err = ioctl(fd, unix.SIOCSIFTXQLEN, uintptr(unsafe.Pointer(&ifrq))); err != nil {
-			// If we can't set the queue length nebula will still work but it may lead to packet loss
-			l.WithError(err).Error("Failed to set tun tx queue length")
-		}
-	*/
+	// Set the transmit queue length
+	t.setTxQueueLen()
 
 	// Bring up the interface
 	ifrf.Flags = ifrf.Flags | unix.IFF_UP
@@ -297,7 +344,119 @@ func (t *tun) Activate() error {
 	return t.addRoutes(false)
 }
 
+// SetMTU changes the MTU of the running device. mtu is clamped to fit the underlying interface the same as tun.mtu.
+func (t *tun) SetMTU(mtu int) error {
+	mtu = t.effectiveMTU(mtu)
+
+	s, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_IP)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(s)
+
+	ifm := ifreqMTU{Name: t.deviceBytes(), MTU: int32(mtu)}
+	if err = ioctl(uintptr(s), unix.SIOCSIFMTU, uintptr(unsafe.Pointer(&ifm))); err != nil {
+		return fmt.Errorf("failed to set tun mtu: %v", err)
+	}
+
+	t.DefaultMTU = mtu
+	return nil
+}
+
+// effectiveMTU returns mtu clamped to the MTU of the interface holding the default route when tun.clamp_mtu is
+// enabled. A tun packet larger than that can not be sent once nebula wraps it and would be dropped without a trace.
+func (t *tun) effectiveMTU(mtu int) int {
+	if !t.clampMTU {
+		return mtu
+	}
+
+	underlay, err := underlayMTU(t.Device)
+	if err != nil {
+		t.l.WithError(err).Debug("Unable to discover the underlying interface mtu, not clamping the tun mtu")
+		return mtu
+	}
+
+	clamped := clampMTU(mtu, underlay)
+	if clamped != mtu {
+		t.l.WithField("mtu", mtu).WithField("underlayMtu", underlay).WithField("clampedMtu", clamped).
+			Info("Clamping the tun mtu to fit the underlying interface")
+	}
+
+	return clamped
+}
+
+// clampMTU caps mtu so a full sized tun packet still fits in a single packet of underlay once nebula wraps it. An
+// underlay too small to carry anything is ignored.
+func clampMTU(mtu, underlay int) int {
+	if underlay <= tunOverhead {
+		return mtu
+	}
+
+	return min(mtu, underlay-tunOverhead)
+}
+
+// defaultRouteMTU returns the MTU of the interface holding the IPv4 default route, ignoring the named tun device
+func defaultRouteMTU(tunName string) (int, error) {
+	rib, err := netroute.FetchRIB(unix.AF_INET, unix.NET_RT_DUMP, 0)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := netroute.ParseRIB(unix.NET_RT_DUMP, rib)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range msgs {
+		rm, ok := m.(*netroute.RouteMessage)
+		if !ok || len(rm.Addrs) <= unix.RTAX_NETMASK {
+			continue
+		}
+
+		dst, ok := rm.Addrs[unix.RTAX_DST].(*netroute.Inet4Addr)
+		if !ok || dst.IP != [4]byte{} {
+			continue
+		}
+
+		// A missing netmask is a zero length mask
+		if mask, ok := rm.Addrs[unix.RTAX_NETMASK].(*netroute.Inet4Addr); ok && mask.IP != [4]byte{} {
+			continue
+		}
+
+		iface, err := net.InterfaceByIndex(rm.Index)
+		if err != nil || iface.Name == tunName {
+			continue
+		}
+
+		return iface.MTU, nil
+	}
+
+	return 0, fmt.Errorf("no default route found")
+}
+
+// setTxQueueLen applies tun.tx_queue, if it was configured. Darwin has no interface transmit queue length so the
+// send buffer of the utun socket is sized to hold that many packets of DefaultMTU instead.
+func (t *tun) setTxQueueLen() {
+	if t.TXQueueLen <= 0 {
+		return
+	}
+
+	err := setsockoptInt(t.fd, unix.SOL_SOCKET, unix.SO_SNDBUF, t.TXQueueLen*t.DefaultMTU)
+	if err != nil {
+		// If we can't set the queue length nebula will still work but it may lead to packet loss
+		t.l.WithError(err).WithField("txQueueLen", t.TXQueueLen).
+			Warn("Unable to honor tun.tx_queue, using the system default send buffer")
+	}
+}
+
 func (t *tun) reload(c *config.C, initial bool) error {
+	if !initial && (c.HasChanged("tun.mtu") || c.HasChanged("tun.clamp_mtu")) {
+		t.clampMTU = c.GetBool("tun.clamp_mtu", false)
+		err := t.SetMTU(c.GetInt("tun.mtu", DefaultMTU))
+		if err != nil {
+			util.LogWithContextIfNeeded("Failed to set tun mtu", err, t.l)
+		}
+	}
+
 	change, routes, err := getAllRoutesFromConfig(c, t.cidr, initial)
 	if err != nil {
 		return err
@@ -517,6 +676,11 @@ func (t *tun) Read(to []byte) (int, error) {
 	buf := make([]byte, len(to)+4)
 
 	n, err := t.ReadWriteCloser.Read(buf)
+	if err != nil {
+		t.rxErrors.Add(1)
+	} else if n > 4 {
+		t.rxBytes.Add(uint64(n - 4))
+	}
 
 	copy(to, buf[4:])
 	return n - 4, err
@@ -524,6 +688,16 @@ func (t *tun) Read(to []byte) (int, error) {
 
 // Write is only valid for single threaded use
 func (t *tun) Write(from []byte) (int, error) {
+	n, err := t.write(from)
+	if err != nil {
+		t.txErrors.Add(1)
+	} else {
+		t.txBytes.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (t *tun) write(from []byte) (int, error) {
 	buf := t.out
 	if cap(buf) < len(from)+4 {
 		buf = make([]byte, len(from)+4)
@@ -551,6 +725,11 @@ func (t *tun) Write(from []byte) (int, error) {
 	return n - 4, err
 }
 
+// Stats returns the bytes read from and written to the tun device along with the number of failed reads and writes
+func (t *tun) Stats() (rx, tx, rxErr, txErr uint64) {
+	return t.rxBytes.Load(), t.txBytes.Load(), t.rxErrors.Load(), t.txErrors.Load()
+}
+
 func (t *tun) Cidr() netip.Prefix {
 	return t.cidr
 }
@@ -0,0 +1,158 @@
+//go:build !ios && !e2e_testing
+// +build !ios,!e2e_testing
+
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestTunSetTxQueueLen(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	defer func() { setsockoptInt = unix.SetsockoptInt }()
+
+	var calls int
+	var gotFd, gotOpt, gotValue int
+	var sockErr error
+	setsockoptInt = func(fd, level, opt, value int) error {
+		calls++
+		gotFd, gotOpt, gotValue = fd, opt, value
+		return sockErr
+	}
+
+	tn := &tun{fd: 7, DefaultMTU: 1300, TXQueueLen: 500, l: l}
+	tn.setTxQueueLen()
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 7, gotFd)
+	assert.Equal(t, unix.SO_SNDBUF, gotOpt)
+	assert.Equal(t, 500*1300, gotValue)
+	assert.Empty(t, hook.AllEntries())
+
+	// A failure is logged as a warning
+	sockErr = errors.New("nope")
+	tn.setTxQueueLen()
+	assert.Equal(t, 2, calls)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+
+	// Nothing happens when tun.tx_queue is not set
+	tn.TXQueueLen = 0
+	tn.setTxQueueLen()
+	assert.Equal(t, 2, calls)
+}
+
+type stubRWC struct {
+	bytes.Buffer
+}
+
+func (s *stubRWC) Close() error {
+	return nil
+}
+
+func TestTunStats(t *testing.T) {
+	rwc := &stubRWC{}
+	tn := &tun{ReadWriteCloser: rwc}
+
+	p := make([]byte, 20)
+	p[0] = 4 << 4
+	n, err := tn.Write(p)
+	require.NoError(t, err)
+	require.Equal(t, len(p), n)
+
+	// The 4 byte header is not counted
+	rx, tx, rxErr, txErr := tn.Stats()
+	assert.Equal(t, uint64(0), rx)
+	assert.Equal(t, uint64(len(p)), tx)
+	assert.Equal(t, uint64(0), rxErr)
+	assert.Equal(t, uint64(0), txErr)
+
+	// Unknown ip versions are counted as errors
+	_, err = tn.Write([]byte{0})
+	assert.Error(t, err)
+
+	out := make([]byte, 100)
+	n, err = tn.Read(out)
+	require.NoError(t, err)
+	require.Equal(t, len(p), n)
+
+	rx, tx, rxErr, txErr = tn.Stats()
+	assert.Equal(t, uint64(len(p)), rx)
+	assert.Equal(t, uint64(len(p)), tx)
+	assert.Equal(t, uint64(0), rxErr)
+	assert.Equal(t, uint64(1), txErr)
+}
+
+func TestParseUtunUnit(t *testing.T) {
+	for name, want := range map[string]int{"": -1, "utun": -1, "utun0": 0, "utun7": 7, "utun42": 42} {
+		unit, err := parseUtunUnit(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, unit, name)
+	}
+
+	for _, name := range []string{"tun0", "utun-1", "utun5abc", "utunx", "nebula1", "utun99999999999"} {
+		unit, err := parseUtunUnit(name)
+		assert.Error(t, err, name)
+		assert.Equal(t, -1, unit, name)
+	}
+}
+
+func TestTunEffectiveMTU(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	defer func() { underlayMTU = defaultRouteMTU }()
+
+	var gotName string
+	var underlay int
+	var underlayErr error
+	underlayMTU = func(name string) (int, error) {
+		gotName = name
+		return underlay, underlayErr
+	}
+
+	tn := &tun{Device: "utun9", clampMTU: true, l: l}
+
+	// A 1400 byte link can not carry a 1400 byte tun packet once it is wrapped
+	underlay = 1400
+	assert.Equal(t, 1400-tunOverhead, tn.effectiveMTU(1400))
+	assert.Equal(t, "utun9", gotName)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.InfoLevel, hook.LastEntry().Level)
+	assert.Equal(t, 1400-tunOverhead, hook.LastEntry().Data["clampedMtu"])
+
+	// Already fits
+	hook.Reset()
+	underlay = 1500
+	assert.Equal(t, 1300, tn.effectiveMTU(1300))
+	assert.Empty(t, hook.AllEntries())
+
+	// Discovery failing leaves the mtu alone
+	underlayErr = errors.New("nope")
+	assert.Equal(t, 9001, tn.effectiveMTU(9001))
+
+	// Clamping is off unless tun.clamp_mtu is set
+	underlayErr = nil
+	underlay = 1400
+	tn.clampMTU = false
+	assert.Equal(t, 1400, tn.effectiveMTU(1400))
+}
+
+func TestClampMTU(t *testing.T) {
+	for _, tt := range []struct{ mtu, underlay, want int }{
+		{1300, 1500, 1300},
+		{1500, 1500, 1500 - tunOverhead},
+		{9001, 9001, 9001 - tunOverhead},
+		{1300, 1400, 1300},
+		{1400, 1400, 1400 - tunOverhead},
+		{1300, tunOverhead, 1300},
+		{1300, 0, 1300},
+	} {
+		assert.Equal(t, tt.want, clampMTU(tt.mtu, tt.underlay), "clampMTU(%d, %d)", tt.mtu, tt.underlay)
+	}
+}
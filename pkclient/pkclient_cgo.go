@@ -146,7 +146,16 @@ func (c *PKClient) listDeriveKeys(id []byte, label []byte, private bool) {
 
 // SignASN1 signs some data. Returns the ASN.1 encoded signature.
 func (c *PKClient) SignASN1(data []byte) ([]byte, error) {
-	mech := pkcs11.NewMechanism(pkcs11.CKM_ECDSA_SHA256, nil)
+	return c.sign(pkcs11.CKM_ECDSA_SHA256, data)
+}
+
+// SignDigestASN1 signs a digest that has already been computed by the caller. Returns the ASN.1 encoded signature.
+func (c *PKClient) SignDigestASN1(digest []byte) ([]byte, error) {
+	return c.sign(pkcs11.CKM_ECDSA, digest)
+}
+
+func (c *PKClient) sign(mechanism uint, data []byte) ([]byte, error) {
+	mech := pkcs11.NewMechanism(mechanism, nil)
 	sk := p11.PrivateKey(c.privKeyObj)
 	rawSig, err := sk.Sign(*mech, data)
 	if err != nil {
@@ -21,6 +21,10 @@ func (c *PKClient) SignASN1(data []byte) ([]byte, error) {
 	return nil, notImplemented
 }
 
+func (c *PKClient) SignDigestASN1(digest []byte) ([]byte, error) {
+	return nil, notImplemented
+}
+
 func (c *PKClient) DeriveNoise(_ []byte) ([]byte, error) {
 	return nil, notImplemented
 }
@@ -85,6 +85,11 @@ func (p *PKI) reloadCert(c *config.C, initial bool) *util.ContextualError {
 
 		// did IP in cert change? if so, don't set
 		currentCert := p.cs.Load().Certificate
+		if cert.Equal(currentCert, cs.Certificate) {
+			p.l.Debug("Client cert on disk is unchanged")
+			return nil
+		}
+
 		oldIPs := currentCert.Networks()
 		newIPs := cs.Certificate.Networks()
 		if len(oldIPs) > 0 && len(newIPs) > 0 && oldIPs[0].String() != newIPs[0].String() {
@@ -255,6 +260,8 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.CAPool, error) {
 		return nil, fmt.Errorf("error while adding CA certificate to CA trust store: %s", err)
 	}
 
+	caPool.SkewTolerance = c.GetDuration("pki.skew_tolerance", 0)
+
 	for _, fp := range c.GetStringSlice("pki.blocklist", []string{}) {
 		l.WithField("fingerprint", fp).Info("Blocklisting cert")
 		caPool.BlocklistFingerprint(fp)
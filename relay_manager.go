@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"strings"
 	"sync/atomic"
 
+	"github.com/gaissmai/bart"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/header"
@@ -41,6 +43,37 @@ func (rm *relayManager) reload(c *config.C, initial bool) error {
 	return nil
 }
 
+// parseRelayDenylist reads relay.denylist, a list of vpn ips or networks that must never be used as a relay
+// or be reached through one.
+func parseRelayDenylist(c *config.C) (*bart.Table[struct{}], error) {
+	raw := c.GetStringSlice("relay.denylist", nil)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	denylist := new(bart.Table[struct{}])
+	for _, v := range raw {
+		var prefix netip.Prefix
+		if strings.Contains(v, "/") {
+			var err error
+			prefix, err = netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid relay.denylist entry %q: %w", v, err)
+			}
+		} else {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid relay.denylist entry %q: %w", v, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		denylist.Insert(prefix.Masked(), struct{}{})
+	}
+
+	return denylist, nil
+}
+
 func (rm *relayManager) GetAmRelay() bool {
 	return rm.amRelay.Load()
 }
@@ -641,6 +641,10 @@ func sshCreateTunnel(ifce *Interface, fs interface{}, a []string, w sshd.StringW
 	}
 
 	hostInfo = ifce.handshakeManager.StartHandshake(vpnIp, nil)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn ip is not within our vpn network: %s", vpnIp))
+	}
+
 	if addr.IsValid() {
 		hostInfo.SetRemote(addr)
 	}